@@ -8,6 +8,7 @@ require (
 	github.com/jm-lemmi/ical-relay/compare v0.0.0-00010101000000-000000000000
 	github.com/jm-lemmi/ical-relay/datastore v0.0.0-00010101000000-000000000000
 	github.com/jm-lemmi/ical-relay/helpers v0.0.0-00010101000000-000000000000
+	github.com/jm-lemmi/ical-relay/modules v0.0.0-00010101000000-000000000000
 	github.com/sirupsen/logrus v1.9.3
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/yaml.v3 v3.0.1
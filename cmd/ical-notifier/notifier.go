@@ -18,6 +18,7 @@ import (
 	"github.com/jm-lemmi/ical-relay/compare"
 	"github.com/jm-lemmi/ical-relay/datastore"
 	"github.com/jm-lemmi/ical-relay/helpers"
+	"github.com/jm-lemmi/ical-relay/modules"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,6 +33,8 @@ func notifyChanges(notifierName string, notifier datastore.Notifier) error {
 		log.Error("Failed to get source for notifier", notifierName, err)
 		return err
 	}
+	// the source tags of the relay are internal and not part of the notifications
+	modules.StripSources(currentICS)
 	// compare to history on file
 	historyFilename := conf.General.StoragePath + "notifystore/" + notifierName + "-past.ics"
 	historyICS, err := helpers.LoadCalFile(historyFilename)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,8 +15,10 @@ import (
 	ics "github.com/arran4/golang-ical"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jm-lemmi/ical-relay/compare"
 	"github.com/jm-lemmi/ical-relay/datastore"
 	"github.com/jm-lemmi/ical-relay/helpers"
+	"github.com/jm-lemmi/ical-relay/modules"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -64,6 +67,39 @@ func calendarlistApiHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(caljson)
 }
 
+// Path: /api/modules
+func modulesApiHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := log.WithFields(log.Fields{"client": GetIP(r), "api": "/api/modules"})
+	requestLogger.Infoln("New API-Request!")
+
+	w.Header().Set("Content-Type", "application/json")
+	schemas, err := json.Marshal(map[string][]modules.ModuleSchema{
+		"filters": modules.GetFilterSchemas(),
+		"actions": modules.GetActionSchemas(),
+	})
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(schemas)
+}
+
+// checkSources checks the URLs and rules of all sources, including rule sets have to exist.
+func checkSources(sources []datastore.Source) error {
+	for i, source := range sources {
+		if err := source.CheckSourceIntegrity(); err != nil {
+			return fmt.Errorf("source %d: %s", i, err.Error())
+		}
+		for j, rule := range source.Rules {
+			if rule.Include != "" && !dataStore.RuleSetExists(rule.Include) {
+				return fmt.Errorf("source %d: rule %d: rule set %s not found", i, j, rule.Include)
+			}
+		}
+	}
+	return nil
+}
+
 // Path: /api/profiles/{profile}
 func profileApiHandler(w http.ResponseWriter, r *http.Request) {
 	requestLogger := log.WithFields(log.Fields{"client": GetIP(r), "api": r.Method + " " + r.URL.Path})
@@ -80,9 +116,11 @@ func profileApiHandler(w http.ResponseWriter, r *http.Request) {
 	profileName := mux.Vars(r)["profile"]
 
 	type profileJson struct {
-		Sources       []string `json:"sources"`
-		Public        bool     `json:"public"`
-		ImmutablePast bool     `json:"immutable_past"`
+		Sources       []datastore.Source `json:"sources"`
+		Public        bool               `json:"public"`
+		ImmutablePast bool               `json:"immutable_past"`
+		HideCancelled bool               `json:"hide_cancelled"`
+		Timezone      string             `json:"timezone"`
 	}
 
 	switch r.Method {
@@ -99,6 +137,22 @@ func profileApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if err := checkSources(newProfile.Sources); err != nil {
+			requestLogger.Errorln("Source is invalid: " + err.Error())
+			http.Error(w, "Source is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := datastore.CheckTimezone(newProfile.Timezone); err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkProfileReferences(profileName, datastore.Profile{Sources: newProfile.Sources}); err != nil {
+			requestLogger.Errorln("Source is invalid: " + err.Error())
+			http.Error(w, "Source is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		if dataStore.ProfileExists(profileName) {
 			requestLogger.Errorln("Profile already exists!")
 			w.WriteHeader(http.StatusConflict)
@@ -106,7 +160,7 @@ func profileApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		dataStore.AddProfile(profileName, newProfile.Sources, newProfile.Public, newProfile.ImmutablePast)
+		dataStore.AddProfile(profileName, newProfile.Sources, newProfile.Public, newProfile.ImmutablePast, newProfile.HideCancelled, newProfile.Timezone)
 
 		requestLogger.Infoln("Created new profile: " + profileName)
 		w.WriteHeader(http.StatusOK)
@@ -127,6 +181,22 @@ func profileApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if err := checkSources(newProfile.Sources); err != nil {
+			requestLogger.Errorln("Source is invalid: " + err.Error())
+			http.Error(w, "Source is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := datastore.CheckTimezone(newProfile.Timezone); err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkProfileReferences(profileName, datastore.Profile{Sources: newProfile.Sources}); err != nil {
+			requestLogger.Errorln("Source is invalid: " + err.Error())
+			http.Error(w, "Source is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		if !dataStore.ProfileExists(profileName) {
 			requestLogger.Errorln("Profile doesnt exist!")
 			w.WriteHeader(http.StatusBadRequest)
@@ -134,7 +204,7 @@ func profileApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		dataStore.EditProfile(profileName, newProfile.Sources, newProfile.Public, newProfile.ImmutablePast)
+		dataStore.EditProfile(profileName, newProfile.Sources, newProfile.Public, newProfile.ImmutablePast, newProfile.HideCancelled, newProfile.Timezone)
 
 		requestLogger.Infoln("Edited profile: " + profileName)
 		w.WriteHeader(http.StatusOK)
@@ -157,6 +227,104 @@ func profileApiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Path: /api/rulesets
+func ruleSetListApiHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := log.WithFields(log.Fields{"client": GetIP(r), "api": "/api/rulesets"})
+	requestLogger.Infoln("New API-Request!")
+
+	token := r.Header.Get("Authorization")
+	if !checkSuperAuthorization(token) {
+		requestLogger.Warnln("Authorization not successful!")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized!\n")
+		return
+	}
+
+	ruleSets := []datastore.RuleSet{}
+	for _, name := range dataStore.GetRuleSetNames() {
+		ruleSets = append(ruleSets, dataStore.GetRuleSet(name))
+	}
+	sort.Slice(ruleSets, func(i, j int) bool {
+		return ruleSets[i].Name < ruleSets[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	ruleSetsJson, err := json.Marshal(ruleSets)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(ruleSetsJson)
+}
+
+// Path: /api/rulesets/{ruleset}
+func ruleSetApiHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := log.WithFields(log.Fields{"client": GetIP(r), "api": r.Method + " " + r.URL.Path})
+	requestLogger.Infoln("New API-Request!")
+
+	token := r.Header.Get("Authorization")
+	if !checkSuperAuthorization(token) {
+		requestLogger.Warnln("Authorization not successful!")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized!\n")
+		return
+	}
+
+	ruleSetName := mux.Vars(r)["ruleset"]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !dataStore.RuleSetExists(ruleSetName) {
+			http.Error(w, "Rule set "+ruleSetName+" not found!", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		ruleSetJson, err := json.Marshal(dataStore.GetRuleSet(ruleSetName))
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(ruleSetJson)
+
+	case http.MethodPut:
+		// create or replace the rule set
+		var ruleSet datastore.RuleSet
+		err := json.NewDecoder(r.Body).Decode(&ruleSet)
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ruleSet.Name = ruleSetName
+		if err := ruleSet.CheckRuleSetIntegrity(); err != nil {
+			requestLogger.Errorln("Rule set is invalid: " + err.Error())
+			http.Error(w, "Rule set is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = dataStore.WriteRuleSet(ruleSet)
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ok(w, requestLogger)
+
+	case http.MethodDelete:
+		err := dataStore.DeleteRuleSet(ruleSetName)
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		ok(w, requestLogger)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // Path: /api/notifier/{notifier}/recipient
 func NotifyRecipientApiHandler(w http.ResponseWriter, r *http.Request) {
 	requestLogger := log.WithFields(log.Fields{"client": GetIP(r), "api": r.Method + " " + r.URL.Path})
@@ -318,6 +486,21 @@ func calendarEntryApiHandler(w http.ResponseWriter, r *http.Request) {
 			rule.Action["new-description"] = entry["description"].(string)
 		}
 
+		if expiry, ok := entry["expiry"]; ok {
+			rule.Expiry, ok = expiry.(string)
+			if !ok {
+				requestLogger.Errorln("expiry is not a string")
+				http.Error(w, "expiry has to be a string", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := rule.CheckRuleIntegrity(); err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		dataStore.AddRule(profileName, rule)
 
 		w.WriteHeader(http.StatusOK)
@@ -536,9 +719,15 @@ func rulesApiHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodGet:
-		// TODO: Implement
-		w.WriteHeader(http.StatusNotImplemented)
-		fmt.Fprint(w, "Not implemented yet!\n")
+		// rules are listed in order of execution
+		w.Header().Set("Content-Type", "application/json")
+		rules, err := json.Marshal(dataStore.GetProfileByName(profileName).Rules)
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(rules)
 	case http.MethodPost:
 		var rule datastore.Rule
 
@@ -553,10 +742,19 @@ func rulesApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// TODO implement
-		if !rule.CheckRuleIntegrity() {
-			requestLogger.Errorln("Rule is invalid!")
-			http.Error(w, "Rule is invalid!", http.StatusBadRequest)
+		if err := rule.CheckRuleIntegrity(); err != nil {
+			requestLogger.Errorln("Rule is invalid: " + err.Error())
+			http.Error(w, "Rule is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rule.Include != "" && !dataStore.RuleSetExists(rule.Include) {
+			requestLogger.Errorln("Rule set " + rule.Include + " not found!")
+			http.Error(w, "Rule set "+rule.Include+" not found!", http.StatusBadRequest)
+			return
+		}
+		if err := checkProfileReferences(profileName, datastore.Profile{Rules: []datastore.Rule{rule}}); err != nil {
+			requestLogger.Errorln("Rule is invalid: " + err.Error())
+			http.Error(w, "Rule is invalid: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -578,7 +776,271 @@ func rulesApiHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		dataStore.RemoveRule(profileName, datastore.Rule{Id: idint})
+	case http.MethodPatch:
+		idint, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, "No valid id given!", http.StatusBadRequest)
+			return
+		}
+		rule := datastore.Rule{Id: idint}
+
+		// all fields are optional, only the given ones are changed
+		var patch struct {
+			Position    *int    `json:"position"`
+			Name        *string `json:"name"`
+			Description *string `json:"description"`
+			Enabled     *bool   `json:"enabled"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if patch.Name != nil || patch.Description != nil {
+			// keep the current value of the field that is not given
+			for _, current := range dataStore.GetProfileByName(profileName).Rules {
+				if current.Id == idint {
+					rule = current
+				}
+			}
+			name, description := rule.Name, rule.Description
+			if patch.Name != nil {
+				name = *patch.Name
+			}
+			if patch.Description != nil {
+				description = *patch.Description
+			}
+			err = dataStore.RenameRule(profileName, rule, name, description)
+		}
+		if err == nil && patch.Enabled != nil {
+			err = dataStore.SetRuleEnabled(profileName, rule, *patch.Enabled)
+		}
+		if err == nil && patch.Position != nil {
+			err = dataStore.MoveRule(profileName, rule, *patch.Position)
+		}
+		if err != nil {
+			requestLogger.Errorln(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		ok(w, requestLogger)
+	}
+}
+
+// calEntryJson is the JSON representation of a calendar entry, as used in the calentry API.
+type calEntryJson struct {
+	Id          string `json:"id"`
+	Summary     string `json:"summary,omitempty"`
+	Description string `json:"description,omitempty"`
+	Start       string `json:"start,omitempty"`
+	End         string `json:"end,omitempty"`
+	Location    string `json:"location,omitempty"`
+}
+
+func newCalEntryJson(event ics.VEvent) calEntryJson {
+	entry := calEntryJson{Id: event.Id()}
+	if event.GetProperty(ics.ComponentPropertySummary) != nil {
+		entry.Summary = event.GetSummary()
+	}
+	if event.GetProperty(ics.ComponentPropertyDescription) != nil {
+		entry.Description = event.GetDescription()
+	}
+	if event.GetProperty(ics.ComponentPropertyLocation) != nil {
+		entry.Location = event.GetLocation()
+	}
+	if start, err := event.GetStartAt(); err == nil {
+		entry.Start = start.Format(time.RFC3339)
+	} else if start, err := event.GetAllDayStartAt(); err == nil {
+		entry.Start = start.Format(time.DateOnly)
+	}
+	if end, err := event.GetEndAt(); err == nil {
+		entry.End = end.Format(time.RFC3339)
+	} else if end, err := event.GetAllDayEndAt(); err == nil {
+		entry.End = end.Format(time.DateOnly)
+	}
+	return entry
+}
+
+// Path: /api/profiles/{profile}/rules/preview
+// Runs the profile with and without the rule in the body and returns the differences, without saving the rule.
+func rulePreviewApiHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	requestLogger := log.WithFields(log.Fields{"client": GetIP(r), "api": r.URL.Path})
+	requestLogger.Infoln("New API-Request!")
+
+	token := r.Header.Get("Authorization")
+	profileName := vars["profile"]
+
+	if !checkAuthorization(token, profileName) {
+		requestLogger.Warnln("Authorization not successful!")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized!\n")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var rule datastore.Rule
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rule.CheckRuleIntegrity(); err != nil {
+		requestLogger.Errorln("Rule is invalid: " + err.Error())
+		http.Error(w, "Rule is invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile := dataStore.GetProfileByName(profileName)
+	// the rule is added at the end, unless a position is given
+	position := len(profile.Rules)
+	if r.URL.Query().Get("position") != "" {
+		position, err = strconv.Atoi(r.URL.Query().Get("position"))
+		if err != nil || position < 0 || position > len(profile.Rules) {
+			http.Error(w, "Invalid position!", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// immutable past is not applied, so the preview does not touch the history file
+	withoutRule, err := getProfileSources(profile, nil)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	withRule, err := helpers.CopyCalendar(withoutRule)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = runRules(withoutRule, profile.Rules, nil)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = runRules(withRule, profile.Rules[:position], nil)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var matched []*ics.VEvent
+	if rule.Include != "" {
+		// the rules of an included set are not traced individually
+		err = runRules(withRule, []datastore.Rule{rule}, nil)
+	} else {
+		matched, err = runRule(withRule, rule)
+	}
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	err = runRules(withRule, profile.Rules[position:], nil)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if profile.HideCancelled {
+		for _, calendar := range []*ics.Calendar{withoutRule, withRule} {
+			if err := runHideCancelled(calendar, len(profile.Rules), nil); err != nil {
+				requestLogger.Errorln(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	type changedJson struct {
+		Old calEntryJson `json:"old"`
+		New calEntryJson `json:"new"`
+	}
+	preview := struct {
+		Matched []string       `json:"matched"`
+		Added   []calEntryJson `json:"added"`
+		Removed []calEntryJson `json:"removed"`
+		Changed []changedJson  `json:"changed"`
+	}{[]string{}, []calEntryJson{}, []calEntryJson{}, []changedJson{}}
+
+	for _, event := range matched {
+		preview.Matched = append(preview.Matched, event.Id())
+	}
+	modules.StripSources(withoutRule)
+	modules.StripSources(withRule)
+	added, removed, changedOld, changedNew := compare.Compare(withoutRule, withRule)
+	for _, event := range added {
+		preview.Added = append(preview.Added, newCalEntryJson(event))
+	}
+	for _, event := range removed {
+		preview.Removed = append(preview.Removed, newCalEntryJson(event))
+	}
+	for i := range changedOld {
+		preview.Changed = append(preview.Changed, changedJson{newCalEntryJson(changedOld[i]), newCalEntryJson(changedNew[i])})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	previewJson, err := json.Marshal(preview)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(previewJson)
+}
+
+// Path: /api/profiles/{profile}/trace
+// Returns for every event of the profile, which source it came from and which rules matched and changed it.
+func traceApiHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	requestLogger := log.WithFields(log.Fields{"client": GetIP(r), "api": r.URL.Path})
+	requestLogger.Infoln("New API-Request!")
+
+	token := r.Header.Get("Authorization")
+	profileName := vars["profile"]
+
+	if !checkAuthorization(token, profileName) {
+		requestLogger.Warnln("Authorization not successful!")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized!\n")
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	trace := newCalendarTrace()
+	calendar, err := getProfileCalendar(dataStore.GetProfileByName(profileName), profileName, trace)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	modules.StripSources(calendar)
+	writeTraceReport(w, requestLogger, trace.report(calendar))
+}
+
+func writeTraceReport(w http.ResponseWriter, requestLogger *log.Entry, report []eventTrace) {
+	w.Header().Set("Content-Type", "application/json")
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		requestLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Write(reportJson)
 }
 
 // Path: /api/profiles/{profile}/checkAuth
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jm-lemmi/ical-relay/datastore"
+)
+
+func TestRulePreviewApiHandler(t *testing.T) {
+	useTestProfile(t, datastore.Profile{
+		Sources: []datastore.Source{{URL: base64Source("UID:lecture\nSUMMARY:Lecture", "UID:exam\nSUMMARY:Exam", "UID:party\nSUMMARY:Party")}},
+		Rules: []datastore.Rule{{
+			Filters: []map[string]string{{"type": "property", "property": "summary", "mode": "equals", "value": "party"}},
+			Action:  map[string]string{"type": "delete"},
+		}},
+		Tokens: []datastore.Token{{Token: "token"}},
+	})
+
+	preview := func(query string, token string, rule string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/profiles/test/rules/preview"+query, strings.NewReader(rule))
+		r.Header.Set("Authorization", token)
+		r = mux.SetURLVars(r, map[string]string{"profile": "test"})
+		w := httptest.NewRecorder()
+		rulePreviewApiHandler(w, r)
+		return w
+	}
+
+	w := preview("", "token", `{"filters": [{"type": "property", "property": "summary", "mode": "equals", "value": "lecture"}],
+		"action": {"type": "edit", "new-description": "Lecture in room 1"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s -- should be 200", w.Code, w.Body.String())
+	}
+	var result struct {
+		Matched []string
+		Added   []calEntryJson
+		Removed []calEntryJson
+		Changed []struct{ Old, New calEntryJson }
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Matched) != 1 || result.Matched[0] != "lecture" {
+		t.Errorf("got matched %v -- should be [lecture]", result.Matched)
+	}
+	if len(result.Added) != 0 || len(result.Removed) != 0 || len(result.Changed) != 1 {
+		t.Fatalf("got %d added, %d removed and %d changed -- should be only 1 changed", len(result.Added), len(result.Removed), len(result.Changed))
+	}
+	if result.Changed[0].Old.Description != "" || result.Changed[0].New.Description != "Lecture in room 1" {
+		t.Errorf("got change %v -- should add the description Lecture in room 1", result.Changed[0])
+	}
+
+	// before the rule of the profile, the party is still there to be removed
+	w = preview("?position=0", "token", `{"filters": [{"type": "all"}], "action": {"type": "delete"}}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Matched) != 3 || len(result.Removed) != 2 {
+		t.Errorf("got %d matched and %d removed -- should be 3 and 2", len(result.Matched), len(result.Removed))
+	}
+
+	for _, test := range []struct {
+		query  string
+		token  string
+		rule   string
+		status int
+	}{
+		{"", "wrong", `{"filters": [{"type": "all"}], "action": {"type": "delete"}}`, http.StatusUnauthorized},
+		{"?position=2", "token", `{"filters": [{"type": "all"}], "action": {"type": "delete"}}`, http.StatusBadRequest},
+		{"", "token", `{"filters": [{"type": "all"}], "action": {"type": "unknown"}}`, http.StatusBadRequest},
+	} {
+		if w := preview(test.query, test.token, test.rule); w.Code != test.status {
+			t.Errorf("preview %s %s: got status %d -- should be %d", test.query, test.rule, w.Code, test.status)
+		}
+	}
+}
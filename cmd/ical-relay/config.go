@@ -34,6 +34,10 @@ type serverConfig struct {
 	DB              dbConfig   `yaml:"db,omitempty"`
 	Mail            mailConfig `yaml:"mail,omitempty"`
 	SuperTokens     []string   `yaml:"super-tokens,omitempty"`
+	// named lists of dates, usable in date expressions like "start of next semester"
+	DateAnchors map[string][]string `yaml:"date-anchors,omitempty"`
+	// directory with filters and actions compiled to WebAssembly
+	PluginPath string `yaml:"plugin-path,omitempty"`
 }
 
 type dbConfig struct {
@@ -88,6 +88,9 @@ func TestExampleConfig(t *testing.T) {
 			SuperTokens: []string{
 				"rA4nhdhmr34lL6x6bLyGoJSHE9o9cA2BwjsMOeqV5SEzm61apcRRzWybtGVjLKiB",
 			},
+			DateAnchors: map[string][]string{
+				"semester": {"2024-04-01", "2024-10-01"},
+			},
 		},
 	}
 	if !reflect.DeepEqual(conf, test_conf) {
@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/arran4/golang-ical v0.2.4
 	github.com/gorilla/mux v1.8.1
+	github.com/jm-lemmi/ical-relay/compare v0.0.0-00010101000000-000000000000
 	github.com/jm-lemmi/ical-relay/helpers v0.0.0-00010101000000-000000000000
 	github.com/jm-lemmi/ical-relay/modules v0.0.0-00010101000000-000000000000
 	github.com/sirupsen/logrus v1.9.3
@@ -16,6 +17,7 @@ require (
 	github.com/alexflint/go-arg v1.4.3
 	github.com/google/uuid v1.6.0
 	github.com/juliangruber/go-intersect/v2 v2.0.1
+	github.com/tetratelabs/wazero v1.8.0
 )
 
 require (
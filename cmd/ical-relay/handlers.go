@@ -14,6 +14,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/jm-lemmi/ical-relay/datastore"
 	"github.com/jm-lemmi/ical-relay/helpers"
+	"github.com/jm-lemmi/ical-relay/modules"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -29,6 +30,7 @@ func initHandlersProfile() {
 	router.HandleFunc("/notifier/{notifier}/rss", rssHandler).Name("rss")
 
 	router.HandleFunc("/api/calendars", calendarlistApiHandler) // listed here because it lists all profiles and is a read only API
+	router.HandleFunc("/api/modules", modulesApiHandler)        // read only schema of all filters and actions
 
 	router.HandleFunc("/health", healthHandler).Name("healthcheck")
 }
@@ -36,10 +38,14 @@ func initHandlersProfile() {
 func initHandlersApi() {
 	router.HandleFunc("/api/profiles/{profile}", profileApiHandler)
 	router.HandleFunc("/api/checkSuperAuth", checkSuperAuthorizationApiHandler)
+	router.HandleFunc("/api/rulesets", ruleSetListApiHandler)
+	router.HandleFunc("/api/rulesets/{ruleset}", ruleSetApiHandler).Name("ruleset")
 	router.HandleFunc("/api/notifier/{notifier}/recipient", NotifyRecipientApiHandler).Name("notifier")
 	router.HandleFunc("/api/profiles/{profile}/checkAuth", checkAuthorizationApiHandler).Name("apiCheckAuth")
 	router.HandleFunc("/api/profiles/{profile}/calentry", calendarEntryApiHandler).Name("calentry")
 	router.HandleFunc("/api/profiles/{profile}/rules", rulesApiHandler).Name("rules")
+	router.HandleFunc("/api/profiles/{profile}/rules/preview", rulePreviewApiHandler).Name("rulesPreview")
+	router.HandleFunc("/api/profiles/{profile}/trace", traceApiHandler).Name("trace")
 	router.HandleFunc("/api/profiles/{profile}/newentryjson", newentryjsonApiHandler).Name("newentryjson")
 	router.HandleFunc("/api/profiles/{profile}/newentryfile", newentryfileApiHandler).Name("newentryfile")
 	router.HandleFunc("/api/profiles/{profile}/tokens", tokenEndpoint).Name("tokens")
@@ -134,12 +140,13 @@ func editViewHandler(w http.ResponseWriter, r *http.Request) {
 
 	// find event by uid in profile
 	uid := vars["uid"]
-	calendar, err := getProfileCalendar(profile, vars["profile"])
+	calendar, err := getProfileCalendar(profile, vars["profile"], nil)
 	if err != nil {
 		requestLogger.Errorln(err)
 		tryRenderErrorOrFallback(w, r, http.StatusInternalServerError, err, err.Error())
 		return
 	}
+	modules.StripSources(calendar)
 	var event *ics.VEvent
 	for _, e := range calendar.Events() {
 		if e.GetProperty("UID").Value == uid {
@@ -199,11 +206,12 @@ func calendarViewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	profile := dataStore.GetProfileByName(profileName)
-	calendar, err := getProfileCalendar(profile, vars["profile"])
+	calendar, err := getProfileCalendar(profile, vars["profile"], nil)
 	if err != nil {
 		tryRenderErrorOrFallback(w, r, http.StatusInternalServerError, err, "Internal Server Error")
 		return
 	}
+	modules.StripSources(calendar)
 	allEvents := getEventsByDay(calendar, profileName)
 	data := getGlobalTemplateData()
 	data["ProfileName"] = profileName
@@ -283,25 +291,70 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 	profile := dataStore.GetProfileByName(profileName)
 
 	// load params
-	time := r.URL.Query().Get("reminder")
-	if time != "" {
+	// subscribers can add display reminders to all events, e.g. ?reminder=24h,15m&reminder-related=start
+	if reminder := r.URL.Query().Get("reminder"); reminder != "" {
+		action := map[string]string{
+			"type":            "add-reminder",
+			"before":          reminder,
+			"related":         r.URL.Query().Get("reminder-related"),
+			"remove-existing": r.URL.Query().Get("reminder-remove-existing"),
+		}
+		for key, value := range action {
+			if value == "" {
+				delete(action, key)
+			}
+		}
+		if err := modules.ValidateAction(action); err != nil {
+			requestLogger.Warnln("Invalid reminder: " + err.Error())
+			http.Error(w, "Invalid reminder: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		profile.Rules = append(profile.Rules, datastore.Rule{
+			Name: "reminder",
 			Filters: []map[string]string{
 				{"type": "all"},
 			},
-			Action: map[string]string{
-				"type": "reminder",
-				"time": time,
-			},
+			Action: action,
 		})
 	}
 
-	calendar, err := getProfileCalendar(profile, profileName)
+	// trace mode for debugging, the token is only accepted as header, so it doesn't end up in access logs
+	// show-sources keeps the internal source tags of the events, which may contain secret source URLs
+	var trace *calendarTrace
+	traceMode := r.URL.Query().Get("trace")
+	showSources := r.URL.Query().Get("show-sources") == "true"
+	if traceMode != "" || showSources {
+		token := r.Header.Get("Authorization")
+		if !checkAuthorization(token, profileName) {
+			requestLogger.Warnln("Authorization for trace or sources not successful!")
+			http.Error(w, "Unauthorized!", http.StatusUnauthorized)
+			return
+		}
+	}
+	if traceMode != "" {
+		if traceMode != "ics" && traceMode != "json" {
+			http.Error(w, "trace must be 'ics' or 'json'", http.StatusBadRequest)
+			return
+		}
+		trace = newCalendarTrace()
+	}
+
+	calendar, err := getProfileCalendar(profile, profileName, trace)
 	if err != nil {
 		requestLogger.Errorln(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if traceMode == "json" {
+		writeTraceReport(w, requestLogger, trace.report(calendar))
+		return
+	}
+	if traceMode == "ics" {
+		trace.annotate(calendar)
+	}
+	if !showSources {
+		modules.StripSources(calendar)
+	}
 	// return new calendar
 	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.ics", profileName))
@@ -333,7 +386,7 @@ func combineProfileHandler(w http.ResponseWriter, r *http.Request) {
 		if i == 0 {
 			// first source gets assigned to base calendar
 			log.Debug("Loading source ", profileName, " as base calendar")
-			calendar, err = getProfileCalendar(profile, profileName)
+			calendar, err = getProfileCalendar(profile, profileName, nil)
 			if err != nil {
 				err := fmt.Errorf("error loading profile %s", profileName)
 				tryRenderErrorOrFallback(w, r, http.StatusBadRequest, err, err.Error())
@@ -342,7 +395,7 @@ func combineProfileHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			// all other calendars only load events
 			log.Debug("Loading source ", profileName, " as additional calendar")
-			ncalendar, err = getProfileCalendar(profile, profileName)
+			ncalendar, err = getProfileCalendar(profile, profileName, nil)
 			if err != nil {
 				err := fmt.Errorf("error loading profile %s", profileName)
 				tryRenderErrorOrFallback(w, r, http.StatusBadRequest, err, err.Error())
@@ -351,6 +404,7 @@ func combineProfileHandler(w http.ResponseWriter, r *http.Request) {
 			helpers.AddEvents(calendar, ncalendar)
 		}
 	}
+	modules.StripSources(calendar)
 
 	// return new calendar
 	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
@@ -7,9 +7,11 @@ import (
 	"html/template"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/jm-lemmi/ical-relay/datastore"
 	"github.com/jm-lemmi/ical-relay/helpers"
+	"github.com/jm-lemmi/ical-relay/modules"
 
 	"github.com/alexflint/go-arg"
 	"github.com/gorilla/mux"
@@ -68,6 +70,20 @@ func main() {
 
 	log.Tracef("%+v\n", conf)
 
+	err = modules.SetDateAnchors(conf.Server.DateAnchors)
+	if err != nil {
+		log.Fatalf("Error in date anchors: %v", err)
+	}
+	// allows filters to compare with other profiles and sources
+	modules.LoadSource = loadRuleSource
+
+	if conf.Server.PluginPath != "" {
+		err = loadPlugins(conf.Server.PluginPath)
+		if err != nil {
+			log.Fatalf("Error loading plugins: %v", err)
+		}
+	}
+
 	if !helpers.DirectoryExists(conf.Server.StoragePath + "calstore/") {
 		log.Info("Creating calstore directory")
 		err = os.MkdirAll(conf.Server.StoragePath+"calstore/", 0750)
@@ -121,6 +137,18 @@ func main() {
 		initHandlersProfile()
 	}
 
+	// Cleanup. Not in lite mode, where nothing is saved and expired rules are skipped anyway, as the data file
+	// isn't safe for concurrent changes while the handlers read it.
+	if !conf.Server.LiteMode {
+		go func() {
+			for {
+				log.Debug("Removing expired rules")
+				removeExpiredRules()
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+
 	// Telemetry
 	if !args.DisableTele {
 		// in own thread, to avoid hanging up the startup, if telemetry fails for some reason
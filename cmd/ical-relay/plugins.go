@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/jm-lemmi/ical-relay/modules"
+	log "github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugins are filters and actions compiled to WebAssembly. They run sandboxed without access to files, network or
+// environment, with limited memory and time. All data is exchanged as JSON in the memory of the plugin, see
+// development.md for the exports a plugin has to provide.
+const (
+	pluginMemoryPages = 256 // 16 MiB
+	pluginTimeout     = 10 * time.Second
+)
+
+// pluginEvent is an event as passed to and returned from plugins.
+type pluginEvent struct {
+	Index      int              `json:"index"`
+	Properties []pluginProperty `json:"properties"`
+}
+
+// pluginProperty is a property of an event, the value as it appears in the iCalendar data.
+type pluginProperty struct {
+	Name       string              `json:"name"`
+	Parameters map[string][]string `json:"parameters,omitempty"`
+	Value      string              `json:"value"`
+}
+
+type pluginInput struct {
+	Params map[string]string `json:"params"`
+	Events []pluginEvent     `json:"events"`
+}
+
+type pluginOutput struct {
+	Error   string        `json:"error,omitempty"`
+	Indices []int         `json:"indices,omitempty"` // filters: indices of the matched events
+	Events  []pluginEvent `json:"events,omitempty"`  // actions: events with their new properties
+	Delete  []int         `json:"delete,omitempty"`  // actions: indices of the events to delete
+}
+
+// plugin is a compiled WebAssembly module. Every call runs in a new instance, so calls can't interfere.
+type plugin struct {
+	name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	schema   modules.ModuleSchema
+}
+
+type pluginFilter struct{ *plugin }
+type pluginAction struct{ *plugin }
+
+// loadPlugins registers all plugins (*.wasm) in the directory as filters and actions named like the file.
+// A plugin exporting "filter" is registered as filter, one exporting "action" as action.
+func loadPlugins(path string) error {
+	files, err := filepath.Glob(filepath.Join(path, "*.wasm"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		log.Warnf("No plugins found in %s", path)
+		return nil
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pluginMemoryPages).
+		WithCloseOnContextDone(true))
+	// WASI is provided for plugins built with Go, TinyGo or Rust. Without mounts and variables it gives no access.
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".wasm")
+		code, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %s", name, err.Error())
+		}
+		p, err := newPlugin(ctx, runtime, name, code)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %s", name, err.Error())
+		}
+		exports := p.compiled.ExportedFunctions()
+		if exports["filter"] == nil && exports["action"] == nil {
+			return fmt.Errorf("plugin %s exports neither filter nor action", name)
+		}
+		if exports["filter"] != nil {
+			if _, exists := modules.GetFilter(name); exists {
+				return fmt.Errorf("plugin %s: filter %s already exists", name, name)
+			}
+			modules.RegisterFilter(pluginFilter{p})
+			log.Infof("Loaded filter plugin %s", name)
+		}
+		if exports["action"] != nil {
+			if _, exists := modules.GetAction(name); exists {
+				return fmt.Errorf("plugin %s: action %s already exists", name, name)
+			}
+			modules.RegisterAction(pluginAction{p})
+			log.Infof("Loaded action plugin %s", name)
+		}
+	}
+	return nil
+}
+
+// newPlugin compiles the plugin and reads its schema.
+func newPlugin(ctx context.Context, runtime wazero.Runtime, name string, code []byte) (*plugin, error) {
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	for _, export := range []string{"alloc", "schema"} {
+		if compiled.ExportedFunctions()[export] == nil {
+			return nil, fmt.Errorf("missing export %s", export)
+		}
+	}
+	p := &plugin{name: name, runtime: runtime, compiled: compiled}
+	schema, err := p.call(ctx, "schema", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(schema, &p.schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err.Error())
+	}
+	p.schema.Name = name
+	p.schema.Check = nil
+	return p, nil
+}
+
+// call instantiates the plugin and calls the exported function with the input, returning its output.
+// Functions with input take its address and length, all functions return address << 32 | length of the output.
+func (p *plugin) call(ctx context.Context, function string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	instance, err := p.runtime.InstantiateModule(ctx, p.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	defer instance.Close(ctx)
+	if instance.Memory() == nil {
+		return nil, fmt.Errorf("missing exported memory")
+	}
+
+	var args []uint64
+	if input != nil {
+		results, err := instance.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+		if err != nil {
+			return nil, fmt.Errorf("alloc: %s", err.Error())
+		}
+		address := uint32(results[0])
+		if !instance.Memory().Write(address, input) {
+			return nil, fmt.Errorf("alloc returned invalid address %d", address)
+		}
+		args = []uint64{uint64(address), uint64(len(input))}
+	}
+	results, err := instance.ExportedFunction(function).Call(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", function, err.Error())
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("%s has to return address and length of the output", function)
+	}
+	output, ok := instance.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, fmt.Errorf("%s returned invalid output address", function)
+	}
+	// the memory is released with the instance
+	return append([]byte{}, output...), nil
+}
+
+// run passes the events at the indices and the parameters to the function of the plugin.
+func (p *plugin) run(ctx context.Context, function string, cal *ics.Calendar, indices []int, params map[string]string) (pluginOutput, error) {
+	var output pluginOutput
+	input := pluginInput{Params: params, Events: []pluginEvent{}}
+	for _, i := range indices {
+		event, ok := cal.Components[i].(*ics.VEvent)
+		if !ok {
+			continue
+		}
+		e := pluginEvent{Index: i, Properties: []pluginProperty{}}
+		for _, prop := range event.Properties {
+			e.Properties = append(e.Properties, pluginProperty{prop.IANAToken, prop.ICalParameters, prop.Value})
+		}
+		input.Events = append(input.Events, e)
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return output, err
+	}
+	data, err = p.call(ctx, function, data)
+	if err != nil {
+		return output, fmt.Errorf("plugin %s: %s", p.name, err.Error())
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return output, fmt.Errorf("plugin %s returned invalid output: %s", p.name, err.Error())
+	}
+	if output.Error != "" {
+		return output, fmt.Errorf("plugin %s: %s", p.name, output.Error)
+	}
+	return output, nil
+}
+
+func (p *plugin) Name() string                 { return p.name }
+func (p *plugin) Schema() modules.ModuleSchema { return p.schema }
+
+func (filter pluginFilter) Apply(ctx context.Context, cal *ics.Calendar, params map[string]string) ([]int, error) {
+	all, _ := modules.FilterAll(cal, params)
+	output, err := filter.run(ctx, "filter", cal, all, params)
+	if err != nil {
+		return nil, err
+	}
+	return checkPluginIndices(filter.name, all, output.Indices)
+}
+
+func (action pluginAction) Apply(ctx context.Context, cal *ics.Calendar, indices []int, params map[string]string) error {
+	output, err := action.run(ctx, "action", cal, indices, params)
+	if err != nil {
+		return err
+	}
+	// check everything before changing the calendar, so a faulty plugin doesn't leave it half edited
+	var changed []int
+	for _, e := range output.Events {
+		changed = append(changed, e.Index)
+		// the events replace the given ones completely, so they have to keep at least their identity and start
+		for _, required := range []string{"UID", "DTSTART"} {
+			found := false
+			for _, prop := range e.Properties {
+				if strings.EqualFold(prop.Name, required) && prop.Value != "" {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("plugin %s returned event %d without %s", action.name, e.Index, required)
+			}
+		}
+	}
+	if _, err := checkPluginIndices(action.name, indices, changed); err != nil {
+		return err
+	}
+	deleted, err := checkPluginIndices(action.name, indices, output.Delete)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range output.Events {
+		event := cal.Components[e.Index].(*ics.VEvent)
+		event.Properties = nil
+		for _, prop := range e.Properties {
+			if prop.Parameters == nil {
+				prop.Parameters = map[string][]string{}
+			}
+			event.Properties = append(event.Properties, ics.IANAProperty{
+				BaseProperty: ics.BaseProperty{IANAToken: strings.ToUpper(prop.Name), ICalParameters: prop.Parameters, Value: prop.Value},
+			})
+		}
+		log.Debug("Plugin " + action.name + " changed event " + event.Id())
+	}
+	return modules.ActionDelete(cal, deleted, params)
+}
+
+// checkPluginIndices checks that the plugin only returned indices it was given and removes duplicates.
+func checkPluginIndices(name string, given []int, returned []int) ([]int, error) {
+	valid := make(map[int]bool)
+	for _, i := range given {
+		valid[i] = true
+	}
+	var indices []int
+	seen := make(map[int]bool)
+	for _, i := range returned {
+		if !valid[i] {
+			return nil, fmt.Errorf("plugin %s returned unknown event index %d", name, i)
+		}
+		if !seen[i] {
+			seen[i] = true
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/jm-lemmi/ical-relay/modules"
+)
+
+// constantPlugin assembles a WebAssembly plugin, whose functions return the given JSON documents.
+func constantPlugin(schema string, filter string, action string) []byte {
+	uleb := func(v uint64) []byte {
+		var b []byte
+		for {
+			c := byte(v & 0x7f)
+			v >>= 7
+			if v != 0 {
+				c |= 0x80
+			}
+			b = append(b, c)
+			if v == 0 {
+				return b
+			}
+		}
+	}
+	sleb := func(v int64) []byte {
+		var b []byte
+		for {
+			c := byte(v & 0x7f)
+			v >>= 7
+			if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+				return append(b, c)
+			}
+			b = append(b, c|0x80)
+		}
+	}
+	vec := func(items ...[]byte) []byte {
+		b := uleb(uint64(len(items)))
+		for _, item := range items {
+			b = append(b, item...)
+		}
+		return b
+	}
+	name := func(s string) []byte { return append(uleb(uint64(len(s))), s...) }
+	section := func(id byte, content []byte) []byte {
+		return append(append([]byte{id}, uleb(uint64(len(content)))...), content...)
+	}
+	body := func(code ...byte) []byte {
+		code = append([]byte{0x00}, append(code, 0x0b)...) // no locals, end
+		return append(uleb(uint64(len(code))), code...)
+	}
+
+	// the outputs are placed in the data section, the functions return their address and length
+	outputs := []string{schema, filter, action}
+	var data, code [][]byte
+	code = append(code, body(append([]byte{0x41}, sleb(8192)...)...)) // alloc: i32.const 8192
+	for i, output := range outputs {
+		address := int64(1024 * (i + 1))
+		data = append(data, append(append(append([]byte{0x00, 0x41}, sleb(address)...), 0x0b), name(output)...))
+		code = append(code, body(append([]byte{0x42}, sleb(address<<32|int64(len(output)))...)...)) // i64.const
+	}
+
+	module := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1, vec(
+		[]byte{0x60, 0x01, 0x7f, 0x01, 0x7f},       // (i32) -> i32
+		[]byte{0x60, 0x00, 0x01, 0x7e},             // () -> i64
+		[]byte{0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e}, // (i32, i32) -> i64
+	))...)
+	module = append(module, section(3, vec([]byte{0}, []byte{1}, []byte{2}, []byte{2}))...)
+	module = append(module, section(5, vec([]byte{0x00, 0x01}))...) // one page
+	module = append(module, section(7, vec(
+		append(name("memory"), 0x02, 0x00),
+		append(name("alloc"), 0x00, 0x00),
+		append(name("schema"), 0x00, 0x01),
+		append(name("filter"), 0x00, 0x02),
+		append(name("action"), 0x00, 0x03),
+	))...)
+	module = append(module, section(10, vec(code...))...)
+	module = append(module, section(11, vec(data...))...)
+	return module
+}
+
+func TestPlugins(t *testing.T) {
+	dir := t.TempDir()
+	plugins := map[string][]byte{
+		"firstplugin": constantPlugin(`{"description": "test plugin"}`,
+			`{"indices": [1, 1]}`,
+			`{"events": [{"index": 1, "properties": [{"name": "UID", "value": "b"}, {"name": "DTSTART", "value": "20240101T100000Z"}, {"name": "SUMMARY", "value": "Changed"}]}], "delete": [0]}`),
+		"brokenplugin": constantPlugin(`{}`, `{"indices": [5]}`, `{"error": "broken"}`),
+		"nouidplugin": constantPlugin(`{}`, `{"indices": []}`,
+			`{"events": [{"index": 0, "properties": [{"name": "DTSTART", "value": "20240101T100000Z"}, {"name": "SUMMARY", "value": "Changed"}]}]}`),
+	}
+	for name, code := range plugins {
+		if err := os.WriteFile(filepath.Join(dir, name+".wasm"), code, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadPlugins(dir); err != nil {
+		t.Fatalf("Error loading plugins: %s", err)
+	}
+	if err := loadPlugins(dir); err == nil {
+		t.Errorf("loading the plugins twice should fail")
+	}
+
+	filter, ok := modules.GetFilter("firstplugin")
+	if !ok || filter.Schema().Description != "test plugin" {
+		t.Fatalf("filter firstplugin not registered with its schema")
+	}
+
+	cal := func() *ics.Calendar {
+		cal, err := ics.ParseCalendar(strings.NewReader("BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+			"BEGIN:VEVENT\r\nUID:a\r\nSUMMARY:First\r\nEND:VEVENT\r\n" +
+			"BEGIN:VEVENT\r\nUID:b\r\nSUMMARY:Second\r\nEND:VEVENT\r\n" +
+			"END:VCALENDAR\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cal
+	}
+
+	ctx := context.Background()
+	indices, err := modules.RunFilter(ctx, cal(), map[string]string{"type": "firstplugin"})
+	if err != nil || fmt.Sprint(indices) != "[1]" {
+		t.Errorf("filter: got %v %v -- should be [1]", indices, err)
+	}
+	_, err = modules.RunFilter(ctx, cal(), map[string]string{"type": "brokenplugin"})
+	if err == nil {
+		t.Errorf("filter returning an unknown index should fail")
+	}
+
+	c := cal()
+	err = modules.RunAction(ctx, c, []int{0, 1}, map[string]string{"type": "firstplugin"})
+	if err != nil {
+		t.Fatalf("Error running action: %s", err)
+	}
+	events := c.Events()
+	if len(events) != 1 || events[0].Id() != "b" || events[0].GetProperty(ics.ComponentPropertySummary).Value != "Changed" {
+		t.Errorf("action: got %v -- should be the changed second event", c.Serialize())
+	}
+	err = modules.RunAction(ctx, cal(), []int{0}, map[string]string{"type": "firstplugin"})
+	if err == nil {
+		t.Errorf("action changing an event it wasn't given should fail")
+	}
+	err = modules.RunAction(ctx, cal(), []int{0}, map[string]string{"type": "nouidplugin"})
+	if err == nil || !strings.Contains(err.Error(), "UID") {
+		t.Errorf("action: got %v -- should fail because of the missing UID", err)
+	}
+	err = modules.RunAction(ctx, cal(), []int{0}, map[string]string{"type": "brokenplugin"})
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("action: got %v -- should be the error of the plugin", err)
+	}
+}
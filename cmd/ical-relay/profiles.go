@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	ics "github.com/arran4/golang-ical"
 	"github.com/jm-lemmi/ical-relay/datastore"
@@ -50,78 +52,30 @@ func getProfilesMetadata() []profileMetadata {
 	return profiles
 }
 
-func getProfileCalendar(profile datastore.Profile, profileName string) (*ics.Calendar, error) {
-	var calendar *ics.Calendar
-
+// getProfileCalendar loads the sources of the profile and applies its rules and immutable past.
+// If trace is not nil, the way of every event through the profile is recorded in it.
+func getProfileCalendar(profile datastore.Profile, profileName string, trace *calendarTrace) (*ics.Calendar, error) {
 	// SOURCES
 
-	if len(profile.Sources) == 0 {
-		log.Debug("No sources, creating empty calendar")
-		calendar = ics.NewCalendar()
-	} else {
-		// loop over sources and combine
-		var ncalendar *ics.Calendar
-		var err error
-
-		for i, s := range profile.Sources {
-			if i == 0 {
-				// first source gets assigned to base calendar
-				log.Debug("Loading source ", s, " as base calendar")
-				calendar, err = getSource(s)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				// all other calendars only load events
-				log.Debug("Loading source ", s, " as additional calendar")
-				ncalendar, err = getSource(s)
-				if err != nil {
-					return nil, err
-				}
-				helpers.AddEvents(calendar, ncalendar)
-			}
-		}
+	calendar, err := getProfileSources(profile, trace)
+	if err != nil {
+		return nil, err
 	}
 
 	// RULES
 
-	for i, rule := range profile.Rules {
-		log.Debug("Executing Rule ", i)
-
-		var indices []int
-
-		// run filters
-		for _, filter := range rule.Filters {
-			filter_name, ok := modules.Filters[filter["type"]]
-			if !ok {
-				return nil, fmt.Errorf("filter type '%s' doesn't exist", filter["type"])
-			}
-			local_indices, err := modules.CallFilter(filter_name, calendar, filter)
-			if err != nil {
-				return nil, err
-			}
+	err = runRules(calendar, profile.Rules, trace)
+	if err != nil {
+		return nil, err
+	}
 
-			log.Trace("Filter operator: ", rule.Operator)
-			if rule.Operator == "and" {
-				indices = intersect.SimpleGeneric(indices, local_indices)
-			} else if rule.Operator == "or" || rule.Operator == "" {
-				indices = append(indices, local_indices...)
-			} else {
-				return nil, fmt.Errorf("Unknown operator '%s'", rule.Operator)
-			}
-		}
-		log.Trace("Indices after all filters: ", indices)
+	// HIDE CANCELLED
 
-		// run action
-		action_name, ok := modules.Actions[rule.Action["type"]]
-		if !ok {
-			return nil, fmt.Errorf("action type '%s' doesn't exist", rule.Action["type"])
-		}
-		err := modules.CallAction(action_name, calendar, indices, rule.Action)
+	if profile.HideCancelled {
+		err = runHideCancelled(calendar, len(profile.Rules), trace)
 		if err != nil {
 			return nil, err
 		}
-		log.Trace("Finished action!")
 	}
 
 	// IMMUTABLE PAST
@@ -137,7 +91,7 @@ func getProfileCalendar(profile datastore.Profile, profileName string) (*ics.Cal
 				log.Errorln(err)
 				return calendar, fmt.Errorf("Error executing immutable past (first-run): %s", err.Error())
 			}
-			helpers.WriteCalFile(calendar, historyFilename)
+			writeHistoryFile(calendar, historyFilename)
 		}
 
 		// load history file
@@ -164,6 +118,7 @@ func getProfileCalendar(profile datastore.Profile, profileName string) (*ics.Cal
 		}
 		// combine calendars
 		log.Debug("Combining calendars")
+		trace.addSource("immutable-past", historyCal)
 		helpers.AddEvents(calendar, historyCal)
 		if err != nil {
 			log.Errorln(err)
@@ -172,7 +127,7 @@ func getProfileCalendar(profile datastore.Profile, profileName string) (*ics.Cal
 
 		//saving history file
 		log.Debugf("Saving history file %s", historyFilename)
-		err = helpers.WriteCalFile(calendar, historyFilename)
+		err = writeHistoryFile(calendar, historyFilename)
 		if err != nil {
 			log.Errorln(err)
 			return calendar, fmt.Errorf("Error saving history file: %s", err.Error())
@@ -191,24 +146,430 @@ func getProfileCalendar(profile datastore.Profile, profileName string) (*ics.Cal
 		}
 	}
 
+	if profile.Timezone != "" {
+		log.Debug("Converting calendar to timezone ", profile.Timezone)
+		indices, _ := modules.FilterAll(calendar, nil)
+		err := modules.ActionTimezone(calendar, indices, map[string]string{"timezone": profile.Timezone})
+		if err != nil {
+			log.Errorln(err)
+			return calendar, fmt.Errorf("error converting to timezone %s: %s", profile.Timezone, err.Error())
+		}
+	}
+
+	return calendar, nil
+}
+
+// getProfileSources loads all sources of the profile, applies the options and rules of each source
+// and combines them into one calendar.
+func getProfileSources(profile datastore.Profile, trace *calendarTrace) (*ics.Calendar, error) {
+	var calendar *ics.Calendar
+
+	if len(profile.Sources) == 0 {
+		log.Debug("No sources, creating empty calendar")
+		calendar = ics.NewCalendar()
+	} else {
+		// loop over sources, apply their rules and combine
+		for i, s := range profile.Sources {
+			log.Debug("Loading source ", s.Name())
+			ncalendar, err := getSource(s.URL)
+			if err != nil {
+				return nil, err
+			}
+			modules.TagSource(ncalendar, s.URL, s.Label)
+			trace.addSource(modules.SourceName(s.URL), ncalendar)
+			if s.Color != "" {
+				for _, event := range ncalendar.Events() {
+					event.SetProperty("COLOR", s.Color)
+				}
+			}
+			if len(s.Rules) > 0 {
+				log.Debug("Executing rules of source ", s.Name())
+				err = runRuleList(ncalendar, s.Rules, "", s.Name(), trace)
+				if err != nil {
+					return nil, fmt.Errorf("source %s: %s", s.Name(), err.Error())
+				}
+			}
+
+			if i == 0 {
+				// first source gets assigned to base calendar, all other calendars only add their events
+				calendar = ncalendar
+			} else {
+				helpers.AddEvents(calendar, ncalendar)
+			}
+		}
+	}
 	return calendar, nil
 }
 
+// runRules executes all enabled and active rules in order on the calendar.
+// Rules including a rule set are replaced by the rules of the set.
+func runRules(calendar *ics.Calendar, rules []datastore.Rule, trace *calendarTrace) error {
+	return runRuleList(calendar, rules, "", "", trace)
+}
+
+// runRuleList executes the rules of a profile, or of the rule set ruleSet.
+// source is the name of the source, if the rules belong to the pipeline of a source.
+func runRuleList(calendar *ics.Calendar, rules []datastore.Rule, ruleSet string, source string, trace *calendarTrace) error {
+	now := time.Now()
+	for i, rule := range rules {
+		if rule.Disabled {
+			log.Debug("Skipping disabled Rule ", i)
+			continue
+		}
+		if !rule.IsActive(now) {
+			log.Debug("Skipping inactive Rule ", i)
+			continue
+		}
+		if rule.Include != "" {
+			if ruleSet != "" {
+				return fmt.Errorf("rule set '%s' can't include rule set '%s'", ruleSet, rule.Include)
+			}
+			if !dataStore.RuleSetExists(rule.Include) {
+				return fmt.Errorf("rule set '%s' doesn't exist", rule.Include)
+			}
+			log.Debug("Executing Rule Set ", rule.Include)
+			err := runRuleList(calendar, dataStore.GetRuleSet(rule.Include).Rules, rule.Include, source, trace)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		log.Debug("Executing Rule ", i)
+		before := trace.snapshot(calendar)
+		matched, err := runRule(calendar, rule)
+		if err != nil {
+			return err
+		}
+		trace.addRule(i, ruleSet, source, rule, matched, before, calendar)
+	}
+	return nil
+}
+
+// runRule executes the filters and the action of a single rule on the calendar.
+// Returns the events matched by the filters, as they were before the action was executed.
+func runRule(calendar *ics.Calendar, rule datastore.Rule) ([]*ics.VEvent, error) {
+	// run filters
+	indices, err := runFilterGroup(calendar, rule.Expression())
+	if err != nil {
+		return nil, err
+	}
+	log.Trace("Indices after all filters: ", indices)
+	var matched []*ics.VEvent
+	for _, i := range indices {
+		matched = append(matched, calendar.Components[i].(*ics.VEvent))
+	}
+
+	// run action
+	err = modules.RunAction(context.Background(), calendar, indices, rule.Action)
+	if err != nil {
+		return nil, err
+	}
+	log.Trace("Finished action!")
+	return matched, nil
+}
+
+// runHideCancelled deletes all cancelled events. It is traced like a rule at position, after the rules of the profile.
+func runHideCancelled(calendar *ics.Calendar, position int, trace *calendarTrace) error {
+	rule := datastore.Rule{
+		Name:    "hide cancelled events",
+		Filters: []map[string]string{{"type": "status", "status": "cancelled"}},
+		Action:  map[string]string{"type": "delete"},
+	}
+	log.Debug("Hiding cancelled events")
+	before := trace.snapshot(calendar)
+	matched, err := runRule(calendar, rule)
+	if err != nil {
+		return err
+	}
+	trace.addRule(position, "", "", rule, matched, before, calendar)
+	return nil
+}
+
+// removeExpiredRules removes all expired rules of all profiles and rule sets from the dataStore.
+func removeExpiredRules() {
+	now := time.Now()
+	for _, profileName := range dataStore.GetAllProfileNames() {
+		profile := dataStore.GetProfileByName(profileName)
+		// remove from the back, so the position based ids of the data file stay valid
+		for i := len(profile.Rules) - 1; i >= 0; i-- {
+			rule := profile.Rules[i]
+			if rule.IsExpired(now) {
+				log.WithFields(log.Fields{
+					"profile": profileName,
+					"rule":    rule.Id,
+					"action":  rule.Action["type"],
+					"expiry":  rule.Expiry,
+				}).Info("Removing expired rule")
+				dataStore.RemoveRule(profileName, rule)
+			}
+		}
+		expired := false
+		for i, source := range profile.Sources {
+			var rules []datastore.Rule
+			for _, rule := range source.Rules {
+				if rule.IsExpired(now) {
+					log.WithFields(log.Fields{
+						"profile": profileName,
+						"source":  source.Name(),
+						"rule":    rule.Id,
+						"action":  rule.Action["type"],
+						"expiry":  rule.Expiry,
+					}).Info("Removing expired rule")
+					expired = true
+				} else {
+					rules = append(rules, rule)
+				}
+			}
+			profile.Sources[i].Rules = rules
+		}
+		if expired {
+			dataStore.EditProfile(profileName, profile.Sources, profile.Public, profile.ImmutablePast, profile.HideCancelled, profile.Timezone)
+		}
+	}
+	for _, ruleSetName := range dataStore.GetRuleSetNames() {
+		ruleSet := dataStore.GetRuleSet(ruleSetName)
+		var rules []datastore.Rule
+		for _, rule := range ruleSet.Rules {
+			if rule.IsExpired(now) {
+				log.WithFields(log.Fields{
+					"rule-set": ruleSetName,
+					"rule":     rule.Id,
+					"action":   rule.Action["type"],
+					"expiry":   rule.Expiry,
+				}).Info("Removing expired rule")
+			} else {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) < len(ruleSet.Rules) {
+			ruleSet.Rules = rules
+			dataStore.WriteRuleSet(ruleSet)
+		}
+	}
+}
+
+// runFilterGroup runs all filters and nested groups of the group and combines their results with the group operator.
+// Returns the sorted indices of all matching events, or of all not matching events if the group is negated.
+func runFilterGroup(calendar *ics.Calendar, group datastore.FilterGroup) ([]int, error) {
+	var indices []int
+	first := true
+	combine := func(localIndices []int) error {
+		log.Trace("Filter operator: ", group.Operator)
+		if group.Operator == "and" {
+			if first {
+				indices = localIndices
+			} else {
+				indices = intersect.SimpleGeneric(indices, localIndices)
+			}
+		} else if group.Operator == "or" || group.Operator == "" {
+			indices = append(indices, localIndices...)
+		} else {
+			return fmt.Errorf("Unknown operator '%s'", group.Operator)
+		}
+		first = false
+		return nil
+	}
+
+	for _, filter := range group.Filters {
+		local_indices, err := modules.RunFilter(context.Background(), calendar, filter)
+		if err != nil {
+			return nil, err
+		}
+		if err = combine(local_indices); err != nil {
+			return nil, err
+		}
+	}
+	for _, subgroup := range group.Groups {
+		local_indices, err := runFilterGroup(calendar, subgroup)
+		if err != nil {
+			return nil, err
+		}
+		if err = combine(local_indices); err != nil {
+			return nil, err
+		}
+	}
+
+	// remove duplicates from "or" and sort
+	matched := make(map[int]bool)
+	for _, i := range indices {
+		matched[i] = true
+	}
+	indices = []int{}
+	for i, component := range calendar.Components {
+		if _, ok := component.(*ics.VEvent); ok && matched[i] != group.Not {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
+
+// writeHistoryFile saves the calendar as history file of the immutable past, without the internal source tags.
+func writeHistoryFile(calendar *ics.Calendar, filename string) error {
+	history, err := helpers.CopyCalendar(calendar)
+	if err != nil {
+		return err
+	}
+	modules.StripSources(history)
+	return helpers.WriteCalFile(history, filename)
+}
+
 // Delete Helper funtion for immutable past.
 // Will delete events from the calendar either before or after now.
 // timeframes: "before": delete up till now, "after" delete everything after now
+// Recurring events are split at now first, so their past occurrences are kept as single events.
 func ImmutablePastDelete(cal *ics.Calendar, timeframe string) error {
-	indices, err := modules.CallFilter(modules.Filters["timeframe"], cal, map[string]string{timeframe: "now"})
+	now := time.Now().Truncate(time.Second)
+	err := modules.SplitRecurringEvents(cal, now)
+	if err != nil {
+		return err
+	}
+	indices, err := modules.FilterTimeframe(cal, map[string]string{timeframe: now.Format(time.RFC3339)})
 	if err != nil {
 		return err
 	}
-	err = modules.CallAction(modules.Actions["delete"], cal, indices, map[string]string{})
+	err = modules.ActionDelete(cal, indices, map[string]string{})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// loadRuleSource loads a source for filters comparing with other calendars.
+// Profiles are loaded without their immutable past, so loading them doesn't write their history file.
+func loadRuleSource(source string) (*ics.Calendar, error) {
+	if !strings.HasPrefix(source, "profile://") {
+		return getSource(source)
+	}
+	profileName := strings.TrimPrefix(source, "profile://")
+	if !dataStore.ProfileExists(profileName) {
+		return nil, fmt.Errorf("Profile does not exist: %s", profileName)
+	}
+	if err := checkProfileCycle(profileName); err != nil {
+		return nil, err
+	}
+	profile := dataStore.GetProfileByName(profileName)
+	calendar, err := getProfileSources(profile, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = runRules(calendar, profile.Rules, nil)
+	if err != nil {
+		return nil, err
+	}
+	if profile.HideCancelled {
+		err = runHideCancelled(calendar, len(profile.Rules), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return calendar, nil
+}
+
+// profileReferences returns the names of the profiles loaded by the sources and rules of the profile.
+func profileReferences(profile datastore.Profile) []string {
+	var names []string
+	var addSource func(source string)
+	var addRules func(rules []datastore.Rule, included map[string]bool)
+	var addGroup func(group datastore.FilterGroup)
+	addSource = func(source string) {
+		if strings.HasPrefix(source, "profile://") {
+			names = append(names, strings.TrimPrefix(source, "profile://"))
+		}
+	}
+	addGroup = func(group datastore.FilterGroup) {
+		for _, filter := range group.Filters {
+			for _, source := range modules.FilterSources(filter) {
+				addSource(source)
+			}
+		}
+		for _, subgroup := range group.Groups {
+			addGroup(subgroup)
+		}
+	}
+	addRules = func(rules []datastore.Rule, included map[string]bool) {
+		for _, rule := range rules {
+			if rule.Include != "" {
+				if !included[rule.Include] && dataStore.RuleSetExists(rule.Include) {
+					included[rule.Include] = true
+					addRules(dataStore.GetRuleSet(rule.Include).Rules, included)
+				}
+				continue
+			}
+			addGroup(rule.Expression())
+		}
+	}
+
+	included := make(map[string]bool)
+	for _, source := range profile.Sources {
+		addSource(source.URL)
+		addRules(source.Rules, included)
+	}
+	addRules(profile.Rules, included)
+	return names
+}
+
+// checkProfileCycle returns an error, if the profile references itself through its sources and rules,
+// directly or through other profiles. Loading such a profile would never end.
+func checkProfileCycle(profileName string) error {
+	visiting := make(map[string]bool)
+	done := make(map[string]bool)
+	var visit func(name string) error
+	visit = func(name string) error {
+		if visiting[name] {
+			return fmt.Errorf("profile %s references itself", name)
+		}
+		if done[name] || !dataStore.ProfileExists(name) {
+			return nil
+		}
+		visiting[name] = true
+		for _, reference := range profileReferences(dataStore.GetProfileByName(name)) {
+			if err := visit(reference); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		done[name] = true
+		return nil
+	}
+	return visit(profileName)
+}
+
+// checkProfileReferences returns an error, if the profile with the given sources and rules would reference itself.
+func checkProfileReferences(profileName string, profile datastore.Profile) error {
+	for _, reference := range profileReferences(profile) {
+		if reference == profileName {
+			return fmt.Errorf("profile %s can't reference itself", profileName)
+		}
+		if profileReachable(reference, profileName) {
+			return fmt.Errorf("profile %s references %s, which references %s again", profileName, reference, profileName)
+		}
+	}
+	return nil
+}
+
+// profileReachable returns whether the profile target is referenced by the profile name, directly or through other profiles.
+func profileReachable(name string, target string) bool {
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if !dataStore.ProfileExists(current) {
+			continue
+		}
+		for _, reference := range profileReferences(dataStore.GetProfileByName(current)) {
+			if reference == target {
+				return true
+			}
+			if !seen[reference] {
+				seen[reference] = true
+				queue = append(queue, reference)
+			}
+		}
+	}
+	return false
+}
+
 func getSource(source string) (*ics.Calendar, error) {
 	var calendar *ics.Calendar
 	var err error
@@ -229,7 +590,10 @@ func getSource(source string) (*ics.Calendar, error) {
 		if !dataStore.ProfileExists(profileName) {
 			return nil, fmt.Errorf("Profile does not exist: %s", profileName)
 		}
-		calendar, err = getProfileCalendar(dataStore.GetProfileByName(profileName), profileName)
+		if err = checkProfileCycle(profileName); err != nil {
+			return nil, err
+		}
+		calendar, err = getProfileCalendar(dataStore.GetProfileByName(profileName), profileName, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/jm-lemmi/ical-relay/datastore"
+)
+
+// parseTestCalendar wraps the given VEVENT lines into a calendar and parses it
+func parseTestCalendar(t *testing.T, events ...string) *ics.Calendar {
+	content := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:test\r\n"
+	for _, event := range events {
+		content += "BEGIN:VEVENT\r\n" + strings.ReplaceAll(strings.TrimSpace(event), "\n", "\r\n") + "\r\nEND:VEVENT\r\n"
+	}
+	content += "END:VCALENDAR\r\n"
+	cal, err := ics.ParseCalendar(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Error parsing test calendar: %s", err)
+	}
+	return cal
+}
+
+// base64Source returns a source URL of a calendar with the given VEVENT lines.
+func base64Source(events ...string) string {
+	content := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:test\r\n"
+	for _, event := range events {
+		content += "BEGIN:VEVENT\r\n" + strings.ReplaceAll(strings.TrimSpace(event), "\n", "\r\n") + "\r\nEND:VEVENT\r\n"
+	}
+	content += "END:VCALENDAR\r\n"
+	return "base64://" + base64.StdEncoding.EncodeToString([]byte(content))
+}
+
+// useTestProfile replaces the dataStore for the test by a data file with the profile "test" and the rule sets.
+func useTestProfile(t *testing.T, profile datastore.Profile, ruleSets ...datastore.RuleSet) {
+	previous := dataStore
+	t.Cleanup(func() { dataStore = previous })
+	data := datastore.DataFile{Profiles: map[string]datastore.Profile{"test": profile}, RuleSets: map[string]datastore.RuleSet{}}
+	for _, ruleSet := range ruleSets {
+		data.RuleSets[ruleSet.Name] = ruleSet
+	}
+	dataStore = data
+}
+
+func TestRunFilterGroup(t *testing.T) {
+	cal := parseTestCalendar(t, "UID:a\nCATEGORIES:A", "UID:b\nCATEGORIES:B", "UID:ab\nCATEGORIES:A,B", "UID:none")
+	categoryA := map[string]string{"type": "property", "property": "categories", "mode": "equals", "value": "a"}
+	categoryB := map[string]string{"type": "property", "property": "categories", "mode": "equals", "value": "b"}
+	anyCategory := map[string]string{"type": "property", "property": "categories"}
+
+	tests := []struct {
+		name     string
+		group    datastore.FilterGroup
+		expected []int
+	}{
+		{"or", datastore.FilterGroup{Filters: []map[string]string{categoryA, categoryB}}, []int{0, 1, 2}},
+		{"and", datastore.FilterGroup{Filters: []map[string]string{categoryA, categoryB}, Operator: "and"}, []int{2}},
+		{"duplicates", datastore.FilterGroup{Filters: []map[string]string{categoryB, categoryA, categoryA}, Operator: "or"}, []int{0, 1, 2}},
+		{"not", datastore.FilterGroup{Filters: []map[string]string{categoryA, categoryB}, Not: true}, []int{3}},
+		{"and not", datastore.FilterGroup{
+			Filters:  []map[string]string{categoryA},
+			Groups:   []datastore.FilterGroup{{Filters: []map[string]string{categoryB}, Not: true}},
+			Operator: "and",
+		}, []int{0}},
+		{"nested", datastore.FilterGroup{
+			Groups: []datastore.FilterGroup{
+				{Filters: []map[string]string{categoryA, categoryB}, Operator: "and"},
+				{Filters: []map[string]string{anyCategory}, Not: true},
+			},
+			Operator: "or",
+		}, []int{2, 3}},
+		{"nested not", datastore.FilterGroup{
+			Groups: []datastore.FilterGroup{{
+				Groups: []datastore.FilterGroup{{Filters: []map[string]string{categoryA}}},
+				Not:    true,
+			}},
+		}, []int{1, 3}},
+	}
+	for _, test := range tests {
+		indices, err := runFilterGroup(cal, test.group)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if fmt.Sprint(indices) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: got %v -- should be %v", test.name, indices, test.expected)
+		}
+	}
+
+	_, err := runFilterGroup(cal, datastore.FilterGroup{Filters: []map[string]string{categoryA, categoryB}, Operator: "xor"})
+	if err == nil {
+		t.Errorf("unknown operator should fail")
+	}
+}
+
+func TestFlatAndRule(t *testing.T) {
+	// earlier versions started "and" rules without any events, so they never matched and the action did nothing
+	profile := datastore.Profile{
+		Sources: []datastore.Source{{URL: base64Source("UID:a\nCATEGORIES:A", "UID:b\nCATEGORIES:B", "UID:ab\nCATEGORIES:A,B")}},
+		Rules: []datastore.Rule{{
+			Filters: []map[string]string{
+				{"type": "property", "property": "categories", "mode": "equals", "value": "a"},
+				{"type": "property", "property": "categories", "mode": "equals", "value": "b"},
+			},
+			Operator: "and",
+			Action:   map[string]string{"type": "delete"},
+		}},
+	}
+	cal, err := getProfileCalendar(profile, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uids []string
+	for _, event := range cal.Events() {
+		uids = append(uids, event.Id())
+	}
+	if fmt.Sprint(uids) != "[a b]" {
+		t.Errorf("got %v -- should be [a b]", uids)
+	}
+}
+
+// appendRule returns a rule appending the text to the summary of all events.
+func appendRule(text string) datastore.Rule {
+	return datastore.Rule{
+		Filters: []map[string]string{{"type": "all"}},
+		Action:  map[string]string{"type": "edit", "new-summary": text, "overwrite": "false"},
+	}
+}
+
+func TestRunRulesRuleSet(t *testing.T) {
+	disabled := appendRule("disabled")
+	disabled.Disabled = true
+	useTestProfile(t, datastore.Profile{}, datastore.RuleSet{Name: "set", Rules: []datastore.Rule{appendRule("2"), disabled, appendRule("3")}})
+
+	cal := parseTestCalendar(t, "UID:event\nSUMMARY:0")
+	err := runRules(cal, []datastore.Rule{appendRule("1"), {Include: "set"}, appendRule("4"), {Include: "set"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary := cal.Events()[0].GetSummary(); summary != "0; 1; 2; 3; 4; 2; 3" {
+		t.Errorf("got %s -- should be 0; 1; 2; 3; 4; 2; 3", summary)
+	}
+
+	err = runRules(cal, []datastore.Rule{{Include: "missing"}}, nil)
+	if err == nil {
+		t.Errorf("including a missing rule set should fail")
+	}
+}
+
+func TestProfileSourceRules(t *testing.T) {
+	profile := datastore.Profile{
+		Sources: []datastore.Source{
+			{URL: base64Source("UID:a\nSUMMARY:a"), Label: "first", Rules: []datastore.Rule{appendRule("first"), {Include: "set"}}},
+			{URL: base64Source("UID:b\nSUMMARY:b"), Label: "second", Rules: []datastore.Rule{appendRule("second")}},
+		},
+		Rules: []datastore.Rule{appendRule("profile")},
+	}
+	useTestProfile(t, profile, datastore.RuleSet{Name: "set", Rules: []datastore.Rule{appendRule("set")}})
+
+	trace := newCalendarTrace()
+	cal, err := getProfileCalendar(profile, "test", trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summaries []string
+	for _, event := range cal.Events() {
+		summaries = append(summaries, event.GetSummary())
+	}
+	if fmt.Sprint(summaries) != "[a; first; set; profile b; second; profile]" {
+		t.Errorf("got %v -- should be [a; first; set; profile b; second; profile]", summaries)
+	}
+
+	trace.annotate(cal)
+	var annotations []string
+	for _, prop := range cal.Events()[0].Properties {
+		if prop.IANAToken == "X-ICAL-RELAY-TRACE" {
+			annotations = append(annotations, prop.Value)
+		}
+	}
+	expected := "[source: base64 rule 0 of source first (edit): modified rule 0 of rule set set of source first (edit): modified rule 0 (edit): modified]"
+	if fmt.Sprint(annotations) != expected {
+		t.Errorf("got annotations %v -- should be %s", annotations, expected)
+	}
+}
+
+func TestProfileReferenceCycle(t *testing.T) {
+	overlap := func(source string) datastore.Rule {
+		return datastore.Rule{
+			Filters: []map[string]string{{"type": "overlap", "source": source}},
+			Action:  map[string]string{"type": "delete"},
+		}
+	}
+	previous := dataStore
+	t.Cleanup(func() { dataStore = previous })
+	previousPath := conf.Server.StoragePath
+	t.Cleanup(func() { conf.Server.StoragePath = previousPath })
+	conf.Server.StoragePath = t.TempDir() + "/"
+
+	dataStore = datastore.DataFile{
+		Profiles: map[string]datastore.Profile{
+			"labs":    {Sources: []datastore.Source{{URL: base64Source("UID:lab\nDTSTART:20240101T100000Z\nDTEND:20240101T120000Z")}}, ImmutablePast: true},
+			"first":   {Rules: []datastore.Rule{overlap("profile://second")}},
+			"second":  {Sources: []datastore.Source{{URL: "profile://first"}}},
+			"grouped": {Sources: []datastore.Source{{URL: "profile://labs"}}},
+		},
+		RuleSets: map[string]datastore.RuleSet{},
+	}
+
+	cal, err := loadRuleSource("profile://labs")
+	if err != nil || len(cal.Events()) != 1 {
+		t.Fatalf("got %v -- should load the profile labs", err)
+	}
+	if _, err := os.Stat(conf.Server.StoragePath + "calstore/labs-past.ics"); !os.IsNotExist(err) {
+		t.Errorf("loading a profile for a filter shouldn't write its history file")
+	}
+	for _, source := range []string{"profile://first", "profile://second"} {
+		if _, err := loadRuleSource(source); err == nil {
+			t.Errorf("loading %s should fail because of the cycle", source)
+		}
+		if _, err := getSource(source); err == nil {
+			t.Errorf("getting %s should fail because of the cycle", source)
+		}
+	}
+
+	tests := []struct {
+		profile string
+		rule    datastore.Rule
+		valid   bool
+	}{
+		{"labs", overlap("profile://labs"), false},
+		{"labs", overlap("profile://grouped"), false},
+		{"labs", datastore.Rule{Filters: []map[string]string{{"type": "overlap", "with-type": "overlap", "with-source": "profile://labs"}}}, false},
+		{"grouped", overlap("profile://labs"), true},
+		{"new", overlap("profile://grouped"), true},
+	}
+	for _, test := range tests {
+		err := checkProfileReferences(test.profile, datastore.Profile{Rules: []datastore.Rule{test.rule}})
+		if (err == nil) != test.valid {
+			t.Errorf("%s with %v: got %v -- should be valid %v", test.profile, test.rule.Filters, err, test.valid)
+		}
+	}
+}
+
+func TestHistoryFileWithoutSources(t *testing.T) {
+	previousPath := conf.Server.StoragePath
+	t.Cleanup(func() { conf.Server.StoragePath = previousPath })
+	conf.Server.StoragePath = t.TempDir() + "/"
+	if err := os.MkdirAll(conf.Server.StoragePath+"calstore", 0750); err != nil {
+		t.Fatal(err)
+	}
+	profile := datastore.Profile{
+		Sources:       []datastore.Source{{URL: base64Source("UID:past\nDTSTART:20200101T100000Z\nDTEND:20200101T120000Z"), Label: "lectures"}},
+		ImmutablePast: true,
+	}
+	useTestProfile(t, profile)
+
+	cal, err := getProfileCalendar(profile, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cal.Events()) != 1 {
+		t.Fatalf("got %d events -- should be 1", len(cal.Events()))
+	}
+	history, err := os.ReadFile(conf.Server.StoragePath + "calstore/test-past.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(history), "UID:past") || strings.Contains(string(history), "X-ICAL-RELAY-SOURCE") {
+		t.Errorf("history file should contain the event without source tags, got %s", history)
+	}
+}
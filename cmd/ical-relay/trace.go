@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/jm-lemmi/ical-relay/datastore"
+)
+
+// calendarTrace records for every event of a profile, which source it came from and which rules changed it.
+// A nil trace records nothing, so it can be passed through the normal code path.
+type calendarTrace struct {
+	events map[string]*eventTrace
+}
+
+type eventTrace struct {
+	Id       string      `json:"id"`
+	Summary  string      `json:"summary,omitempty"`
+	Source   string      `json:"source"`
+	Rules    []ruleTrace `json:"rules"`
+	Included bool        `json:"included"` // whether the event is part of the returned calendar
+}
+
+type ruleTrace struct {
+	Rule    int    `json:"rule"`               // position of the rule in the profile or rule set
+	RuleSet string `json:"rule-set,omitempty"` // rule set including the rule
+	Source  string `json:"source,omitempty"`   // source, if the rule is part of the rules of a source
+	Name    string `json:"name,omitempty"`
+	Action  string `json:"action"`
+	Result  string `json:"result"` // matched, modified, deleted or created
+}
+
+func newCalendarTrace() *calendarTrace {
+	return &calendarTrace{events: make(map[string]*eventTrace)}
+}
+
+// addSource records the source of all events in the calendar, replacing earlier traces of the same events.
+func (trace *calendarTrace) addSource(source string, calendar *ics.Calendar) {
+	if trace == nil {
+		return
+	}
+	for _, event := range calendar.Events() {
+		entry := &eventTrace{Id: event.Id(), Source: source, Rules: []ruleTrace{}}
+		if event.GetProperty(ics.ComponentPropertySummary) != nil {
+			entry.Summary = event.GetSummary()
+		}
+		trace.events[event.Id()] = entry
+	}
+}
+
+// snapshot serializes all events by their UID, to find out which events a rule changed.
+func (trace *calendarTrace) snapshot(calendar *ics.Calendar) map[string]string {
+	if trace == nil {
+		return nil
+	}
+	events := make(map[string]string)
+	for _, event := range calendar.Events() {
+		// recurrence exceptions share the UID of their series
+		events[event.Id()] += fingerprintProperties(event.Properties)
+		for _, component := range event.Components {
+			if alarm, ok := component.(*ics.VAlarm); ok {
+				events[event.Id()] += "BEGIN:VALARM\n" + fingerprintProperties(alarm.Properties)
+			}
+		}
+	}
+	return events
+}
+
+// fingerprintProperties returns a string, that changes whenever a property, value or parameter changes.
+func fingerprintProperties(properties []ics.IANAProperty) string {
+	var fingerprint strings.Builder
+	for _, prop := range properties {
+		fingerprint.WriteString(prop.IANAToken)
+		keys := make([]string, 0, len(prop.ICalParameters))
+		for key := range prop.ICalParameters {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&fingerprint, ";%s=%s", key, strings.Join(prop.ICalParameters[key], ","))
+		}
+		fmt.Fprintf(&fingerprint, ":%s\n", prop.Value)
+	}
+	return fingerprint.String()
+}
+
+// addRule records the result of a rule for all matched events and all events created by the rule.
+func (trace *calendarTrace) addRule(position int, ruleSet string, source string, rule datastore.Rule, matched []*ics.VEvent, before map[string]string, calendar *ics.Calendar) {
+	if trace == nil {
+		return
+	}
+	after := trace.snapshot(calendar)
+	record := func(id string, result string) {
+		entry, ok := trace.events[id]
+		if !ok {
+			entry = &eventTrace{Id: id, Source: ruleName(position, ruleSet, source), Rules: []ruleTrace{}}
+			trace.events[id] = entry
+		}
+		entry.Rules = append(entry.Rules, ruleTrace{position, ruleSet, source, rule.Name, rule.Action["type"], result})
+	}
+
+	recorded := make(map[string]bool)
+	for _, event := range matched {
+		id := event.Id()
+		if recorded[id] {
+			continue
+		}
+		recorded[id] = true
+		if _, ok := after[id]; !ok {
+			record(id, "deleted")
+		} else if after[id] != before[id] {
+			record(id, "modified")
+		} else {
+			record(id, "matched")
+		}
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			record(id, "created")
+		}
+	}
+}
+
+// report returns the traces of all events sorted by UID, marking the events still included in the calendar.
+func (trace *calendarTrace) report(calendar *ics.Calendar) []eventTrace {
+	included := make(map[string]bool)
+	for _, event := range calendar.Events() {
+		included[event.Id()] = true
+	}
+	report := make([]eventTrace, 0, len(trace.events))
+	for id, entry := range trace.events {
+		entry.Included = included[id]
+		report = append(report, *entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Id < report[j].Id
+	})
+	return report
+}
+
+// annotate adds the trace of every event as X-ICAL-RELAY-TRACE properties to the event.
+func (trace *calendarTrace) annotate(calendar *ics.Calendar) {
+	for _, event := range calendar.Events() {
+		entry, ok := trace.events[event.Id()]
+		if !ok {
+			continue
+		}
+		event.AddProperty("X-ICAL-RELAY-TRACE", "source: "+entry.Source)
+		for _, rule := range entry.Rules {
+			event.AddProperty("X-ICAL-RELAY-TRACE", fmt.Sprintf("%s (%s): %s", ruleName(rule.Rule, rule.RuleSet, rule.Source), rule.Action, rule.Result))
+		}
+	}
+}
+
+// ruleName returns a readable reference to the rule at position, e.g. "rule 2", "rule 2 of rule set cleanup"
+// or "rule 2 of source lectures".
+func ruleName(position int, ruleSet string, source string) string {
+	name := fmt.Sprintf("rule %d", position)
+	if ruleSet != "" {
+		name += " of rule set " + ruleSet
+	}
+	if source != "" {
+		name += " of source " + source
+	}
+	return name
+}
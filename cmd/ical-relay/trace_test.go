@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jm-lemmi/ical-relay/datastore"
+)
+
+func TestCalendarTrace(t *testing.T) {
+	source := base64Source("UID:lecture\nSUMMARY:Lecture", "UID:exam\nSUMMARY:Exam", "UID:party\nSUMMARY:Party")
+	profile := datastore.Profile{
+		Sources: []datastore.Source{{URL: source}},
+		Rules: []datastore.Rule{{
+			Filters: []map[string]string{{"type": "property", "property": "summary", "mode": "equals", "value": "party"}},
+			Action:  map[string]string{"type": "delete"},
+		}, {
+			Name:    "rename",
+			Filters: []map[string]string{{"type": "property", "property": "summary", "mode": "contains", "value": "e"}},
+			Action:  map[string]string{"type": "edit", "new-description": "renamed"},
+		}, {
+			Filters: []map[string]string{{"type": "property", "property": "summary", "mode": "equals", "value": "exam"}},
+			Action:  map[string]string{"type": "edit", "new-description": "renamed"},
+		}},
+	}
+	useTestProfile(t, profile)
+
+	trace := newCalendarTrace()
+	calendar, err := getProfileCalendar(profile, "test", trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"exam":    "true [{1   rename edit modified} {2    edit matched}]",
+		"lecture": "true [{1   rename edit modified}]",
+		"party":   "false [{0    delete deleted}]",
+	}
+	for _, entry := range trace.report(calendar) {
+		if got := fmt.Sprint(entry.Included, " ", entry.Rules); got != expected[entry.Id] {
+			t.Errorf("%s: got %s -- should be %s", entry.Id, got, expected[entry.Id])
+		}
+		if entry.Source != "base64" {
+			t.Errorf("%s: got source %s -- should be base64", entry.Id, entry.Source)
+		}
+	}
+
+	trace.annotate(calendar)
+	var annotations []string
+	for _, prop := range calendar.Events()[0].Properties {
+		if prop.IANAToken == "X-ICAL-RELAY-TRACE" {
+			annotations = append(annotations, prop.Value)
+		}
+	}
+	if fmt.Sprint(annotations) != "[source: base64 rule 1 (edit): modified]" {
+		t.Errorf("got annotations %v -- should be [source: base64 rule 1 (edit): modified]", annotations)
+	}
+}
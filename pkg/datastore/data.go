@@ -1,6 +1,15 @@
 package datastore
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jm-lemmi/ical-relay/modules"
+)
 
 type DataStore interface {
 	GetPublicProfileNames() []string
@@ -8,15 +17,31 @@ type DataStore interface {
 	ProfileExists(name string) bool
 	// Note: Must check if profileExists beforehand
 	GetProfileByName(name string) Profile
-	AddProfile(name string, sources []string, public bool, immutablePast bool) //TODO: make this take a profile type
+	AddProfile(name string, sources []Source, public bool, immutablePast bool, hideCancelled bool, timezone string) //TODO: make this take a profile type
 
 	// editProfile edits a profile, not touching tokens and rules
-	EditProfile(name string, sources []string, public bool, immutablePast bool) //TODO: either make this take a profile type or split it into explicit editing functions
+	EditProfile(name string, sources []Source, public bool, immutablePast bool, hideCancelled bool, timezone string) //TODO: either make this take a profile type or split it into explicit editing functions
+	// AddSource adds a source without options and rules
 	AddSource(profileName string, src string) error
 	// removeSource removes all sources with the given src string
 	RemoveSource(profileName string, src string) error
 	AddRule(profileName string, rule Rule) error
 	RemoveRule(profileName string, rule Rule) //editRule(string profileName, rule Rule)
+	// MoveRule moves the rule to the given position (starting at 0) in the execution order of the profile
+	MoveRule(profileName string, rule Rule, position int) error
+	// RenameRule sets the human readable name and description of the rule
+	RenameRule(profileName string, rule Rule, name string, description string) error
+	// SetRuleEnabled enables or disables the rule. Disabled rules are not executed.
+	SetRuleEnabled(profileName string, rule Rule, enabled bool) error
+
+	GetRuleSetNames() []string
+	RuleSetExists(name string) bool
+	// Note: Must check if RuleSetExists beforehand
+	GetRuleSet(name string) RuleSet
+	// WriteRuleSet creates the rule set or replaces the description and rules of an existing one
+	WriteRuleSet(ruleSet RuleSet) error
+	// DeleteRuleSet deletes the rule set, if no profile includes it
+	DeleteRuleSet(name string) error
 
 	CreateToken(profileName string, note *string) error
 	ModifyTokenNote(profileName string, token string, note *string) error
@@ -42,19 +67,103 @@ type Token struct {
 
 type Profile struct {
 	Name          string   `yaml:"name,omitempty" db:"name"`
-	Sources       []string `yaml:"sources,omitempty"`
+	Sources       []Source `yaml:"sources,omitempty"`
 	Public        bool     `yaml:"public" db:"public"`
 	ImmutablePast bool     `yaml:"immutable-past,omitempty" db:"immutable_past"`
+	HideCancelled bool     `yaml:"hide-cancelled,omitempty" db:"hide_cancelled"` // remove events with STATUS:CANCELLED after the rules
+	Timezone      string   `yaml:"timezone,omitempty" db:"timezone"`             // convert all events to this timezone, if set
 	Tokens        []Token  `yaml:"admin-tokens,omitempty"`
 	Rules         []Rule   `yaml:"rules,omitempty"`
 }
 
+// Source of a profile. The rules of a source are applied to its events only, before all sources are merged.
+// In the data file and the API a source without options can be written as plain URL.
+type Source struct {
+	Id    int    `yaml:"-" json:"-" db:"id"`
+	URL   string `yaml:"url" json:"url" db:"url"`
+	Label string `yaml:"label,omitempty" json:"label,omitempty" db:"label"` // readable name, e.g. for the source filter
+	Color string `yaml:"color,omitempty" json:"color,omitempty" db:"color"` // set as COLOR of all events of the source
+	Rules []Rule `yaml:"rules,omitempty" json:"rules,omitempty"`
+}
+
+// sourceFields prevents recursion when (un)marshalling a Source
+type sourceFields Source
+
+func (source *Source) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*source = Source{URL: value.Value}
+		return nil
+	}
+	return value.Decode((*sourceFields)(source))
+}
+
+func (source Source) MarshalYAML() (interface{}, error) {
+	if source.Label == "" && source.Color == "" && len(source.Rules) == 0 {
+		return source.URL, nil
+	}
+	return sourceFields(source), nil
+}
+
+func (source *Source) UnmarshalJSON(data []byte) error {
+	var url string
+	if json.Unmarshal(data, &url) == nil {
+		*source = Source{URL: url}
+		return nil
+	}
+	return json.Unmarshal(data, (*sourceFields)(source))
+}
+
+// Name returns the label of the source, or its URL if it has no label.
+func (source Source) Name() string {
+	if source.Label != "" {
+		return source.Label
+	}
+	return source.URL
+}
+
+// Rule of a profile. Rules are executed in the order they are listed in the profile.
 type Rule struct {
-	Id       int
-	Filters  []map[string]string `yaml:"filters" json:"filters"`
-	Operator string              `yaml:"operator" json:"operator"`
-	Action   map[string]string   `yaml:"action" json:"action"`
-	Expiry   string              `yaml:"expiry,omitempty" json:"expiry,omitempty"`
+	Id          int
+	Name        string              `yaml:"name,omitempty" json:"name,omitempty"`
+	Description string              `yaml:"description,omitempty" json:"description,omitempty"`
+	Disabled    bool                `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	Filters     []map[string]string `yaml:"filters" json:"filters"`
+	Groups      []FilterGroup       `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Operator    string              `yaml:"operator" json:"operator"`
+	Not         bool                `yaml:"not,omitempty" json:"not,omitempty"`
+	Action      map[string]string   `yaml:"action" json:"action"`
+	// RFC3339 times, the rule is only applied between ActiveFrom and Expiry
+	Expiry     string `yaml:"expiry,omitempty" json:"expiry,omitempty"`
+	ActiveFrom string `yaml:"active-from,omitempty" json:"active-from,omitempty"`
+	// Include executes all rules of the rule set with this name at the position of the rule.
+	// Including rules have no filters and action of their own.
+	Include string `yaml:"include,omitempty" json:"include,omitempty"`
+}
+
+// RuleSet is a named list of rules, that can be included by multiple profiles.
+type RuleSet struct {
+	Name        string `yaml:"name,omitempty" json:"name" db:"name"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty" db:"description"`
+	Rules       []Rule `yaml:"rules" json:"rules"`
+}
+
+// FilterGroup is a nested group of filters and groups, that are combined by the operator ("and"/"or", default "or").
+// If Not is set, the group matches all events that are not matched by its content.
+type FilterGroup struct {
+	Filters  []map[string]string `yaml:"filters,omitempty" json:"filters,omitempty"`
+	Groups   []FilterGroup       `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Operator string              `yaml:"operator,omitempty" json:"operator,omitempty"`
+	Not      bool                `yaml:"not,omitempty" json:"not,omitempty"`
+}
+
+// Expression returns the filters, groups and operator of the rule as the root group of its filter expression.
+func (rule Rule) Expression() FilterGroup {
+	return FilterGroup{
+		Filters:  rule.Filters,
+		Groups:   rule.Groups,
+		Operator: rule.Operator,
+		Not:      rule.Not,
+	}
 }
 
 type Notifier struct {
@@ -70,9 +179,119 @@ type Recipient struct {
 
 // Data Integrity Functions
 
-// checks if a rule is valid.
-// returns true if rule is valid, false if not
-func (rule Rule) CheckRuleIntegrity() bool {
-	// TODO implement!
-	return true
+// CheckRuleIntegrity checks if a rule is valid: all filters and the action have to exist and have valid parameters.
+// Returns nil if the rule is valid, otherwise the reason why it is not.
+func (rule Rule) CheckRuleIntegrity() error {
+	if rule.Include != "" {
+		if len(rule.Filters) > 0 || len(rule.Groups) > 0 || len(rule.Action) > 0 || rule.Operator != "" || rule.Not {
+			return fmt.Errorf("a rule including rule set '%s' can't have filters or an action", rule.Include)
+		}
+	} else {
+		if err := rule.Expression().checkIntegrity(); err != nil {
+			return err
+		}
+		if err := modules.ValidateAction(rule.Action); err != nil {
+			return err
+		}
+	}
+	if rule.Expiry != "" {
+		if _, err := time.Parse(time.RFC3339, rule.Expiry); err != nil {
+			return fmt.Errorf("invalid expiry: %s", err.Error())
+		}
+	}
+	if rule.ActiveFrom != "" {
+		if _, err := time.Parse(time.RFC3339, rule.ActiveFrom); err != nil {
+			return fmt.Errorf("invalid active-from time: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// CheckRuleSetIntegrity checks the name and all rules of the rule set. Rule sets can't include other rule sets.
+func (ruleSet RuleSet) CheckRuleSetIntegrity() error {
+	if ruleSet.Name == "" {
+		return fmt.Errorf("rule set has no name")
+	}
+	for i, rule := range ruleSet.Rules {
+		if rule.Include != "" {
+			return fmt.Errorf("rule %d: rule sets can't include other rule sets", i)
+		}
+		if err := rule.CheckRuleIntegrity(); err != nil {
+			return fmt.Errorf("rule %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+// CheckTimezone checks the timezone option of a profile, which is empty or a timezone for the timezone action.
+func CheckTimezone(timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	if err := modules.ValidateAction(map[string]string{"type": "timezone", "timezone": timezone}); err != nil {
+		return fmt.Errorf("invalid timezone: %s", err.Error())
+	}
+	return nil
+}
+
+// CheckSourceIntegrity checks the URL and all rules of the source.
+func (source Source) CheckSourceIntegrity() error {
+	if source.URL == "" {
+		return fmt.Errorf("source has no url")
+	}
+	for i, rule := range source.Rules {
+		if err := rule.CheckRuleIntegrity(); err != nil {
+			return fmt.Errorf("rule %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+// checkIntegrity recursively checks the operator and all filters of the group.
+func (group FilterGroup) checkIntegrity() error {
+	if group.Operator != "" && group.Operator != "and" && group.Operator != "or" {
+		return fmt.Errorf("unknown operator '%s'", group.Operator)
+	}
+	for _, filter := range group.Filters {
+		if err := modules.ValidateFilter(filter); err != nil {
+			return err
+		}
+	}
+	for _, subgroup := range group.Groups {
+		if err := subgroup.checkIntegrity(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsExpired returns true, if the rule has an expiry before t.
+// Rules with an invalid expiry never expire.
+func (rule Rule) IsExpired(t time.Time) bool {
+	if rule.Expiry == "" {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339, rule.Expiry)
+	if err != nil {
+		log.Warnf("Rule %d has invalid expiry '%s': %s", rule.Id, rule.Expiry, err.Error())
+		return false
+	}
+	return !expiry.After(t)
+}
+
+// IsActive returns true, if the rule is to be applied at t.
+// Rules are active from their active-from time (if any) until they expire.
+func (rule Rule) IsActive(t time.Time) bool {
+	if rule.IsExpired(t) {
+		return false
+	}
+	if rule.ActiveFrom == "" {
+		return true
+	}
+	activeFrom, err := time.Parse(time.RFC3339, rule.ActiveFrom)
+	if err != nil {
+		log.Warnf("Rule %d has invalid active-from time '%s': %s", rule.Id, rule.ActiveFrom, err.Error())
+		return true
+	}
+	return !activeFrom.After(t)
 }
@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -14,7 +15,7 @@ import (
 
 var db sqlx.DB
 
-const CurrentDbVersion = 5
+const CurrentDbVersion = 12
 
 // startup connection function
 func Connect(dbUser string, dbPassword string, dbHost string, dbName string) {
@@ -132,6 +133,81 @@ ALTER TABLE rule ADD CONSTRAINT rule_profile_fkey FOREIGN KEY (profile) REFERENC
 		initTables()
 		setDbVersion(5)
 	}
+	if fromDbVersion < 6 {
+		log.Info("running upgrade to db version 6")
+		// creates the filter_group table
+		initTables()
+		_, err := db.Exec(`ALTER TABLE rule ADD COLUMN IF NOT EXISTS negate bool NOT NULL DEFAULT false;
+ALTER TABLE filter ADD COLUMN IF NOT EXISTS filter_group integer REFERENCES filter_group(id) ON DELETE CASCADE;`)
+		if err != nil {
+			log.Panic("Failed to add filter groups on upgrade to db version 6", err)
+		}
+		setDbVersion(6)
+	}
+	if fromDbVersion < 7 {
+		log.Info("running upgrade to db version 7")
+		_, err := db.Exec("ALTER TABLE rule ADD COLUMN IF NOT EXISTS active_from timestamp with time zone")
+		if err != nil {
+			log.Panic("Failed to add column active_from to rule table on upgrade to db version 7", err)
+		}
+		setDbVersion(7)
+	}
+	if fromDbVersion < 8 {
+		log.Info("running upgrade to db version 8")
+		_, err := db.Exec(`ALTER TABLE rule ADD COLUMN IF NOT EXISTS position integer NOT NULL DEFAULT 0;
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS name text NOT NULL DEFAULT '';
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS disabled bool NOT NULL DEFAULT false;`)
+		if err != nil {
+			log.Panic("Failed to add rule position, name and state on upgrade to db version 8", err)
+		}
+		// keep the previous order, which was the order of creation
+		_, err = db.Exec(`UPDATE rule SET position = ordered.position FROM
+(SELECT id, ROW_NUMBER() OVER (PARTITION BY profile ORDER BY id) - 1 AS position FROM rule) AS ordered
+WHERE rule.id = ordered.id`)
+		if err != nil {
+			log.Panic("Failed to set rule positions on upgrade to db version 8", err)
+		}
+		setDbVersion(8)
+	}
+	if fromDbVersion < 9 {
+		log.Info("running upgrade to db version 9")
+		// creates the rule_set table
+		initTables()
+		_, err := db.Exec(`ALTER TABLE rule ALTER COLUMN profile DROP NOT NULL;
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS rule_set text REFERENCES rule_set(name) ON DELETE CASCADE;
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS include_set text REFERENCES rule_set(name);`)
+		if err != nil {
+			log.Panic("Failed to add rule sets on upgrade to db version 9", err)
+		}
+		setDbVersion(9)
+	}
+	if fromDbVersion < 10 {
+		log.Info("running upgrade to db version 10")
+		_, err := db.Exec(`ALTER TABLE source ADD COLUMN IF NOT EXISTS label text NOT NULL DEFAULT '';
+ALTER TABLE source ADD COLUMN IF NOT EXISTS color text NOT NULL DEFAULT '';
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS source integer REFERENCES source(id) ON DELETE CASCADE;`)
+		if err != nil {
+			log.Panic("Failed to add source options and rules on upgrade to db version 10", err)
+		}
+		setDbVersion(10)
+	}
+	if fromDbVersion < 11 {
+		log.Info("running upgrade to db version 11")
+		_, err := db.Exec(`ALTER TABLE profile ADD COLUMN IF NOT EXISTS hide_cancelled bool NOT NULL DEFAULT false;`)
+		if err != nil {
+			log.Panic("Failed to add column hide_cancelled to profile table on upgrade to db version 11", err)
+		}
+		setDbVersion(11)
+	}
+	if fromDbVersion < 12 {
+		log.Info("running upgrade to db version 12")
+		_, err := db.Exec(`ALTER TABLE profile ADD COLUMN IF NOT EXISTS timezone text NOT NULL DEFAULT '';`)
+		if err != nil {
+			log.Panic("Failed to add column timezone to profile table on upgrade to db version 12", err)
+		}
+		setDbVersion(12)
+	}
 }
 
 func setDbVersion(dbVersion int) {
@@ -147,10 +223,16 @@ func setDbVersion(dbVersion int) {
 // these structs are only used for reading
 type dbRule struct {
 	Id               int        `db:"id"`
+	Name             string     `db:"name"`
+	Description      string     `db:"description"`
+	Disabled         bool       `db:"disabled"`
 	Operator         string     `db:"operator"`
 	ActionType       string     `db:"action_type"`
 	ActionParameters string     `db:"action_parameters"`
 	Expiry           *time.Time `db:"expiry"`
+	Negate           bool       `db:"negate"`
+	ActiveFrom       *time.Time `db:"active_from"`
+	IncludeSet       *string    `db:"include_set"`
 }
 
 type dbFilter struct {
@@ -158,6 +240,12 @@ type dbFilter struct {
 	Parameters string `db:"parameters"`
 }
 
+type dbFilterGroup struct {
+	Id       int    `db:"id"`
+	Operator string `db:"operator"`
+	Negate   bool   `db:"negate"`
+}
+
 func dbProfileExists(profileName string) bool {
 	var profileExists bool
 
@@ -195,27 +283,40 @@ func dbListProfiles() []string {
 
 func dbReadProfile(profileName string) *Profile {
 	profile := new(Profile)
-	err := db.Get(profile, "SELECT name, public, immutable_past FROM profile WHERE name = $1", profileName)
+	err := db.Get(profile, "SELECT name, public, immutable_past, hide_cancelled, timezone FROM profile WHERE name = $1", profileName)
 	if err != nil {
 		log.Fatal(err)
 	}
 	err = db.Select(
 		&profile.Sources,
-		`SELECT url FROM source
-JOIN profile_sources ps ON id = ps.source WHERE ps.profile = $1`,
+		`SELECT id, url, label, color FROM source
+JOIN profile_sources ps ON id = ps.source WHERE ps.profile = $1 ORDER BY id`,
 		profileName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for i, source := range profile.Sources {
+		profile.Sources[i].Rules = dbReadRules("source", source.Id)
+	}
 	err = db.Select(&profile.Tokens, "SELECT token, note FROM admin_tokens WHERE profile = $1", profileName)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	profile.Rules = dbReadRules("profile", profileName)
+	log.Tracef("%#v\n", profile.Rules)
+	return profile
+}
+
+// dbReadRules reads all rules of a profile, a rule set or a source in order of execution.
+// owner is the column referencing the owner of the rules, either "profile", "rule_set" or "source".
+func dbReadRules(owner string, ownerName interface{}) []Rule {
+	var rules []Rule
 	var dbRules []dbRule
-	err = db.Select(
-		&dbRules, "SELECT id, operator, action_type, action_parameters, expiry FROM rule WHERE profile = $1",
-		profileName)
+	err := db.Select(
+		&dbRules, `SELECT id, name, description, disabled, operator, action_type, action_parameters, expiry, negate, active_from, include_set
+FROM rule WHERE `+owner+` = $1 ORDER BY position, id`,
+		ownerName)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -223,12 +324,19 @@ JOIN profile_sources ps ON id = ps.source WHERE ps.profile = $1`,
 	for _, dbRule := range dbRules {
 		rule := new(Rule)
 		rule.Id = dbRule.Id
+		rule.Name = dbRule.Name
+		rule.Description = dbRule.Description
+		rule.Disabled = dbRule.Disabled
 		rule.Operator = dbRule.Operator
+		rule.Not = dbRule.Negate
 		if dbRule.Expiry != nil {
 			rule.Expiry = dbRule.Expiry.Format(time.RFC3339)
 		} else {
 			rule.Expiry = ""
 		}
+		if dbRule.ActiveFrom != nil {
+			rule.ActiveFrom = dbRule.ActiveFrom.Format(time.RFC3339)
+		}
 		actionParameters := map[string]string{}
 		err = json.Unmarshal([]byte(dbRule.ActionParameters), &actionParameters)
 		if err != nil {
@@ -237,32 +345,70 @@ JOIN profile_sources ps ON id = ps.source WHERE ps.profile = $1`,
 		actionParameters["type"] = dbRule.ActionType
 		rule.Action = actionParameters
 
-		var dbFilters []dbFilter
-		err = db.Select(&dbFilters, "SELECT type, parameters FROM filter WHERE id = $1", dbRule.Id)
+		rule.Filters = dbReadRuleFilters(dbRule.Id, nil)
+		rule.Groups = dbReadFilterGroups(dbRule.Id, nil)
+		if dbRule.IncludeSet != nil {
+			rule.Include = *dbRule.IncludeSet
+			rule.Action = nil
+		}
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// dbReadRuleFilters reads the filters of a rule, that belong to the given group (nil for the top level filters).
+func dbReadRuleFilters(ruleId int, groupId *int) []map[string]string {
+	var filters []map[string]string
+	var dbFilters []dbFilter
+	err := db.Select(
+		&dbFilters, "SELECT type, parameters FROM filter WHERE rule = $1 AND filter_group IS NOT DISTINCT FROM $2 ORDER BY id",
+		ruleId, groupId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, dbFilter := range dbFilters {
+		filterParameters := map[string]string{}
+		err = json.Unmarshal([]byte(dbFilter.Parameters), &filterParameters)
 		if err != nil {
 			log.Fatal(err)
 		}
-		for _, dbFilter := range dbFilters {
-			filterParameters := map[string]string{}
-			err = json.Unmarshal([]byte(dbFilter.Parameters), &filterParameters)
-			if err != nil {
-				log.Fatal(err)
-			}
-			filterParameters["type"] = dbFilter.FilterType
-			rule.Filters = append(rule.Filters, filterParameters)
-		}
-		profile.Rules = append(profile.Rules, *rule)
+		filterParameters["type"] = dbFilter.FilterType
+		filters = append(filters, filterParameters)
 	}
-	log.Tracef("%#v\n", profile.Rules)
-	return profile
+	return filters
+}
+
+// dbReadFilterGroups recursively reads the filter groups of a rule, that are nested in the given parent group
+// (nil for the top level groups).
+func dbReadFilterGroups(ruleId int, parentId *int) []FilterGroup {
+	var groups []FilterGroup
+	var dbGroups []dbFilterGroup
+	err := db.Select(
+		&dbGroups, "SELECT id, operator, negate FROM filter_group WHERE rule = $1 AND parent IS NOT DISTINCT FROM $2 ORDER BY id",
+		ruleId, parentId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, dbGroup := range dbGroups {
+		groupId := dbGroup.Id
+		groups = append(groups, FilterGroup{
+			Filters:  dbReadRuleFilters(ruleId, &groupId),
+			Groups:   dbReadFilterGroups(ruleId, &groupId),
+			Operator: dbGroup.Operator,
+			Not:      dbGroup.Negate,
+		})
+	}
+	return groups
 }
 
 // dbWriteProfile writes the profile options and sources to the db,
 // silently overwriting if a profile with the same name exists.
 func dbWriteProfile(profile Profile) {
 	_, err := db.NamedExec(
-		`INSERT INTO profile (name, public, immutable_past) VALUES (:name, :public, :immutable_past)
-ON CONFLICT (name) DO UPDATE SET public = excluded.public, immutable_past = excluded.immutable_past`,
+		`INSERT INTO profile (name, public, immutable_past, hide_cancelled, timezone)
+VALUES (:name, :public, :immutable_past, :hide_cancelled, :timezone)
+ON CONFLICT (name) DO UPDATE SET public = excluded.public, immutable_past = excluded.immutable_past,
+hide_cancelled = excluded.hide_cancelled, timezone = excluded.timezone`,
 		profile)
 
 	dbRemoveAllProfileSources(profile)
@@ -295,13 +441,18 @@ JOIN profile_sources ps ON id = ps.source WHERE profile = $1 AND url = $2)`, pro
 	return profileSourceExists
 }
 
-func dbAddProfileSource(profile Profile, source string) {
+// dbAddProfileSource adds the source with its options and rules to the profile.
+func dbAddProfileSource(profile Profile, source Source) {
 	var sourceId int
-	err := db.Get(&sourceId, `INSERT INTO source (url) VALUES ($1) RETURNING id`, source)
+	err := db.Get(&sourceId, `INSERT INTO source (url, label, color) VALUES ($1, $2, $3) RETURNING id`,
+		source.URL, source.Label, source.Color)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
+	for _, rule := range source.Rules {
+		dbAddRule("source", sourceId, rule)
+	}
 	_, err = db.Exec(
 		`INSERT INTO profile_sources (profile, source) VALUES ($1, $2) ON CONFLICT (profile, source) DO NOTHING`,
 		profile.Name, sourceId)
@@ -386,17 +537,15 @@ func dbProfileRuleExists(profile Profile, rule Rule) bool {
 	}
 
 	var ruleIds []int
-	if rule.Expiry != "" { // stored as true NULL in db
-		err = db.Select(
-			&ruleIds, `SELECT id FROM rule WHERE profile = $1 AND operator = $2
-AND action_type = $3 AND action_parameters = $4 AND expiry = $5`,
-			profile.Name, rule.Operator, actionType, parametersJson, rule.Expiry)
-	} else {
-		err = db.Select(
-			&ruleIds, `SELECT id FROM rule WHERE profile = $1 AND operator = $2
-AND action_type = $3 AND action_parameters = $4 AND expiry IS NULL`,
-			profile.Name, rule.Operator, actionType, parametersJson)
-	}
+	// empty times are stored as true NULL in db
+	expiry := sql.NullString{String: rule.Expiry, Valid: rule.Expiry != ""}
+	activeFrom := sql.NullString{String: rule.ActiveFrom, Valid: rule.ActiveFrom != ""}
+	includeSet := sql.NullString{String: rule.Include, Valid: rule.Include != ""}
+	err = db.Select(
+		&ruleIds, `SELECT id FROM rule WHERE profile = $1 AND operator = $2
+AND action_type = $3 AND action_parameters = $4 AND expiry IS NOT DISTINCT FROM $5 AND negate = $6
+AND active_from IS NOT DISTINCT FROM $7 AND include_set IS NOT DISTINCT FROM $8`,
+		profile.Name, rule.Operator, actionType, parametersJson, expiry, rule.Not, activeFrom, includeSet)
 	if len(ruleIds) == 0 {
 		log.Trace("rule not found with pN:'", profile.Name, "' rOp:'", rule.Operator,
 			"' aT:'", actionType, "' aP:", string(parametersJson), " rE:'", rule.Expiry, "'")
@@ -432,6 +581,10 @@ AND action_type = $3 AND action_parameters = $4 AND expiry IS NULL`,
 				ok = false
 			}
 		}
+		if ok && !reflect.DeepEqual(dbReadFilterGroups(ruleId, nil), rule.Groups) {
+			log.Trace("filter groups do not match rId:", ruleId)
+			ok = false
+		}
 		if ok {
 			return true
 		}
@@ -440,6 +593,16 @@ AND action_type = $3 AND action_parameters = $4 AND expiry IS NULL`,
 }
 
 func dbAddProfileRule(profile Profile, rule Rule) {
+	dbAddRule("profile", profile.Name, rule)
+}
+
+// dbAddRule adds the rule after all other rules of a profile or a rule set.
+// owner is the column referencing the owner of the rule, either "profile" or "rule_set".
+func dbAddRule(owner string, ownerName interface{}, rule Rule) {
+	if rule.Action == nil {
+		// including rules have no action
+		rule.Action = map[string]string{}
+	}
 	actionType := rule.Action["type"]
 	delete(rule.Action, "type") //TODO: possibly deep-copy
 	parametersJson, err := json.Marshal(rule.Action)
@@ -447,22 +610,48 @@ func dbAddProfileRule(profile Profile, rule Rule) {
 		panic(err)
 	}
 
-	var expiry sql.NullString
-	expiry.String = rule.Expiry
+	// empty times are stored as NULL
+	expiry := sql.NullString{String: rule.Expiry, Valid: rule.Expiry != ""}
+	activeFrom := sql.NullString{String: rule.ActiveFrom, Valid: rule.ActiveFrom != ""}
+	includeSet := sql.NullString{String: rule.Include, Valid: rule.Include != ""}
 	var ruleId int
 	err = db.QueryRow(
-		`INSERT INTO rule (profile, operator, action_type, action_parameters, expiry) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
-		profile.Name, rule.Operator, actionType, parametersJson, expiry).Scan(&ruleId)
+		`INSERT INTO rule (`+owner+`, position, name, description, disabled, operator, action_type, action_parameters, expiry, negate,
+active_from, include_set)
+VALUES ($1, (SELECT COALESCE(MAX(position) + 1, 0) FROM rule WHERE `+owner+` = $1), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		ownerName, rule.Name, rule.Description, rule.Disabled, rule.Operator, actionType, parametersJson, expiry, rule.Not,
+		activeFrom, includeSet).Scan(&ruleId)
 	if err != nil {
 		log.Panic(err)
 	}
 
 	for _, filter := range rule.Filters {
-		dbAddRuleFilter(ruleId, filter)
+		dbAddRuleFilter(ruleId, nil, filter)
+	}
+	for _, group := range rule.Groups {
+		dbAddFilterGroup(ruleId, nil, group)
+	}
+}
+
+// dbAddFilterGroup recursively adds a filter group with all its filters and nested groups to the rule.
+func dbAddFilterGroup(ruleId int, parentId *int, group FilterGroup) {
+	var groupId int
+	err := db.QueryRow(
+		`INSERT INTO filter_group (rule, parent, operator, negate) VALUES ($1, $2, $3, $4) RETURNING id`,
+		ruleId, parentId, group.Operator, group.Not).Scan(&groupId)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, filter := range group.Filters {
+		dbAddRuleFilter(ruleId, &groupId, filter)
+	}
+	for _, subgroup := range group.Groups {
+		dbAddFilterGroup(ruleId, &groupId, subgroup)
 	}
 }
 
-func dbAddRuleFilter(ruleId int, filter map[string]string) {
+func dbAddRuleFilter(ruleId int, groupId *int, filter map[string]string) {
 	filterType := filter["type"]
 	delete(filter, "type") //TODO: possibly deep-copy
 	parametersJson, err := json.Marshal(filter)
@@ -470,8 +659,8 @@ func dbAddRuleFilter(ruleId int, filter map[string]string) {
 		panic(err)
 	}
 	_, err = db.Exec(
-		`INSERT INTO filter (rule, type, parameters) VALUES ($1, $2, $3) RETURNING id`,
-		ruleId, filterType, parametersJson)
+		`INSERT INTO filter (rule, filter_group, type, parameters) VALUES ($1, $2, $3, $4) RETURNING id`,
+		ruleId, groupId, filterType, parametersJson)
 	if err != nil {
 		panic(err)
 	}
@@ -487,6 +676,129 @@ func dbRemoveRule(profile Profile, ruleId int) {
 	}
 }
 
+func dbProfileRuleIdExists(profile Profile, ruleId int) bool {
+	var ruleExists bool
+	err := db.Get(&ruleExists, `SELECT EXISTS (SELECT * FROM rule WHERE profile = $1 AND id = $2)`, profile.Name, ruleId)
+	if err != nil {
+		panic(err)
+	}
+	return ruleExists
+}
+
+// dbMoveRule moves the rule to the position in the execution order of the profile, renumbering all rules of the profile.
+func dbMoveRule(profile Profile, ruleId int, position int) {
+	var ruleIds []int
+	err := db.Select(&ruleIds, `SELECT id FROM rule WHERE profile = $1 AND id != $2 ORDER BY position, id`,
+		profile.Name, ruleId)
+	if err != nil {
+		log.Panic(err)
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(ruleIds) {
+		position = len(ruleIds)
+	}
+	ruleIds = append(ruleIds[:position], append([]int{ruleId}, ruleIds[position:]...)...)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Panic(err)
+	}
+	for i, id := range ruleIds {
+		_, err = tx.Exec(`UPDATE rule SET position = $1 WHERE id = $2`, i, id)
+		if err != nil {
+			tx.Rollback()
+			log.Panic(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func dbRenameRule(profile Profile, ruleId int, name string, description string) {
+	_, err := db.Exec(`UPDATE rule SET name = $1, description = $2 WHERE profile = $3 AND id = $4`,
+		name, description, profile.Name, ruleId)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func dbSetRuleDisabled(profile Profile, ruleId int, disabled bool) {
+	_, err := db.Exec(`UPDATE rule SET disabled = $1 WHERE profile = $2 AND id = $3`, disabled, profile.Name, ruleId)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func dbListRuleSets() []string {
+	var ruleSets []string
+
+	err := db.Select(&ruleSets, `SELECT name FROM rule_set ORDER BY name`)
+	if err != nil {
+		panic(err)
+	}
+
+	return ruleSets
+}
+
+func dbRuleSetExists(name string) bool {
+	var ruleSetExists bool
+	err := db.Get(&ruleSetExists, `SELECT EXISTS (SELECT * FROM rule_set WHERE name = $1)`, name)
+	if err != nil {
+		panic(err)
+	}
+	return ruleSetExists
+}
+
+func dbReadRuleSet(name string) *RuleSet {
+	ruleSet := new(RuleSet)
+	err := db.Get(ruleSet, "SELECT name, description FROM rule_set WHERE name = $1", name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ruleSet.Rules = dbReadRules("rule_set", name)
+	return ruleSet
+}
+
+// dbWriteRuleSet writes the rule set to the db, replacing the description and all rules of an existing rule set.
+func dbWriteRuleSet(ruleSet RuleSet) {
+	_, err := db.NamedExec(
+		`INSERT INTO rule_set (name, description) VALUES (:name, :description)
+ON CONFLICT (name) DO UPDATE SET description = excluded.description`,
+		ruleSet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(`DELETE FROM rule WHERE rule_set = $1`, ruleSet.Name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, rule := range ruleSet.Rules {
+		dbAddRule("rule_set", ruleSet.Name, rule)
+	}
+}
+
+// dbListRuleSetIncludes returns the names of all profiles including the rule set.
+func dbListRuleSetIncludes(name string) []string {
+	var profiles []string
+	err := db.Select(&profiles, `SELECT DISTINCT COALESCE(rule.profile, ps.profile) AS profile FROM rule
+LEFT JOIN profile_sources ps ON ps.source = rule.source WHERE include_set = $1 ORDER BY profile`, name)
+	if err != nil {
+		panic(err)
+	}
+	return profiles
+}
+
+func dbDeleteRuleSet(name string) {
+	_, err := db.Exec(`DELETE FROM rule_set WHERE name = $1`, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func dbWriteProfileToken(profile Profile, token string, note *string) {
 	if len(token) != 64 {
 		log.Fatal("Only 64-byte tokens are allowed!")
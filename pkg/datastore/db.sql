@@ -4,14 +4,18 @@ CREATE TABLE IF NOT EXISTS schema_upgrades (
 );
 
 CREATE TABLE IF NOT EXISTS source (
-    id  integer PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
-    url text NOT NULL
+    id    integer PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    url   text NOT NULL,
+    label text NOT NULL DEFAULT '',
+    color text NOT NULL DEFAULT ''
 );
 
 CREATE TABLE IF NOT EXISTS profile (
     name           text NOT NULL PRIMARY KEY,
     public         bool NOT NULL,
-    immutable_past bool NOT NULL
+    immutable_past bool NOT NULL,
+    hide_cancelled bool NOT NULL DEFAULT false,
+    timezone       text NOT NULL DEFAULT ''
 );
 
 CREATE TABLE IF NOT EXISTS profile_sources (
@@ -20,21 +24,46 @@ CREATE TABLE IF NOT EXISTS profile_sources (
     UNIQUE  (profile, source)
 );
 
-/* TODO: add facility for easy reordering */
+CREATE TABLE IF NOT EXISTS rule_set (
+    name        text NOT NULL PRIMARY KEY,
+    description text NOT NULL DEFAULT ''
+);
+
+/* rules are executed ordered by position, then id */
+/* a rule belongs either to a profile, a rule set or a source, rules with include_set execute the rules of that set */
 CREATE TABLE IF NOT EXISTS rule (
     id                integer PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
-    profile           text references profile(name) ON DELETE CASCADE NOT NULL,
+    profile           text references profile(name) ON DELETE CASCADE,
+    rule_set          text references rule_set(name) ON DELETE CASCADE,
+    source            integer references source(id) ON DELETE CASCADE,
+    include_set       text references rule_set(name),
+    position          integer NOT NULL DEFAULT 0,
+    name              text NOT NULL DEFAULT '',
+    description       text NOT NULL DEFAULT '',
+    disabled          bool NOT NULL DEFAULT false,
     operator          text NOT NULL,
     action_type       text NOT NULL,
     action_parameters jsonb NOT NULL,
-    expiry            timestamp with time zone
+    expiry            timestamp with time zone,
+    negate            bool NOT NULL DEFAULT false,
+    active_from       timestamp with time zone
+);
+
+/* nested groups of filters, top level filters and groups of a rule have no parent group */
+CREATE TABLE IF NOT EXISTS filter_group (
+    id       integer PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    rule     integer REFERENCES rule(id) ON DELETE CASCADE NOT NULL,
+    parent   integer REFERENCES filter_group(id) ON DELETE CASCADE,
+    operator text NOT NULL,
+    negate   bool NOT NULL DEFAULT false
 );
 
 CREATE TABLE IF NOT EXISTS filter (
-    id         integer PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
-    rule       integer REFERENCES rule(id) ON DELETE CASCADE NOT NULL,
-    type       text NOT NULL,
-    parameters jsonb NOT NULL
+    id           integer PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    rule         integer REFERENCES rule(id) ON DELETE CASCADE NOT NULL,
+    filter_group integer REFERENCES filter_group(id) ON DELETE CASCADE,
+    type         text NOT NULL,
+    parameters   jsonb NOT NULL
 );
 
 CREATE TABLE IF NOT EXISTS admin_tokens (
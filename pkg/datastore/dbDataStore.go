@@ -27,23 +27,27 @@ func (c DatabaseDataStore) GetProfileByName(name string) Profile {
 	return *dbReadProfile(name)
 }
 
-func (c DatabaseDataStore) AddProfile(name string, sources []string, public bool, immutablePast bool) {
+func (c DatabaseDataStore) AddProfile(name string, sources []Source, public bool, immutablePast bool, hideCancelled bool, timezone string) {
 	dbWriteProfile(Profile{
 		Name:          name,
 		Sources:       sources,
 		Public:        public,
 		ImmutablePast: immutablePast,
+		HideCancelled: hideCancelled,
+		Timezone:      timezone,
 		Tokens:        []Token{},
 		Rules:         []Rule{},
 	})
 }
 
-func (c DatabaseDataStore) EditProfile(name string, sources []string, public bool, immutablePast bool) {
+func (c DatabaseDataStore) EditProfile(name string, sources []Source, public bool, immutablePast bool, hideCancelled bool, timezone string) {
 	tempProfile := Profile{
 		Name:          name,
 		Sources:       sources,
 		Public:        public,
 		ImmutablePast: immutablePast,
+		HideCancelled: hideCancelled,
+		Timezone:      timezone,
 	}
 
 	dbWriteProfile(tempProfile)
@@ -53,7 +57,7 @@ func (c DatabaseDataStore) AddSource(profileName string, src string) error {
 	if !dbProfileExists(profileName) {
 		return fmt.Errorf("profile " + profileName + " does not exist")
 	}
-	dbAddProfileSource(Profile{Name: profileName}, src)
+	dbAddProfileSource(Profile{Name: profileName}, Source{URL: src})
 	return nil
 }
 
@@ -77,6 +81,61 @@ func (c DatabaseDataStore) RemoveRule(profileName string, rule Rule) {
 	dbRemoveRule(Profile{Name: profileName}, rule.Id)
 }
 
+func (c DatabaseDataStore) MoveRule(profileName string, rule Rule, position int) error {
+	if !dbProfileRuleIdExists(Profile{Name: profileName}, rule.Id) {
+		return fmt.Errorf("rule %d does not exist in profile %s", rule.Id, profileName)
+	}
+	dbMoveRule(Profile{Name: profileName}, rule.Id, position)
+	return nil
+}
+
+func (c DatabaseDataStore) RenameRule(profileName string, rule Rule, name string, description string) error {
+	if !dbProfileRuleIdExists(Profile{Name: profileName}, rule.Id) {
+		return fmt.Errorf("rule %d does not exist in profile %s", rule.Id, profileName)
+	}
+	dbRenameRule(Profile{Name: profileName}, rule.Id, name, description)
+	return nil
+}
+
+func (c DatabaseDataStore) SetRuleEnabled(profileName string, rule Rule, enabled bool) error {
+	if !dbProfileRuleIdExists(Profile{Name: profileName}, rule.Id) {
+		return fmt.Errorf("rule %d does not exist in profile %s", rule.Id, profileName)
+	}
+	dbSetRuleDisabled(Profile{Name: profileName}, rule.Id, !enabled)
+	return nil
+}
+
+func (c DatabaseDataStore) GetRuleSetNames() []string {
+	return dbListRuleSets()
+}
+
+func (c DatabaseDataStore) RuleSetExists(name string) bool {
+	return dbRuleSetExists(name)
+}
+
+func (c DatabaseDataStore) GetRuleSet(name string) RuleSet {
+	return *dbReadRuleSet(name)
+}
+
+func (c DatabaseDataStore) WriteRuleSet(ruleSet RuleSet) error {
+	if ruleSet.Name == "" {
+		return fmt.Errorf("rule set has no name")
+	}
+	dbWriteRuleSet(ruleSet)
+	return nil
+}
+
+func (c DatabaseDataStore) DeleteRuleSet(name string) error {
+	if !dbRuleSetExists(name) {
+		return fmt.Errorf("rule set " + name + " does not exist")
+	}
+	if profiles := dbListRuleSetIncludes(name); len(profiles) > 0 {
+		return fmt.Errorf("rule set %s is included by profile %s", name, profiles[0])
+	}
+	dbDeleteRuleSet(name)
+	return nil
+}
+
 func (c DatabaseDataStore) CreateToken(profileName string, note *string) error {
 	token := randstr.Base62(64)
 	if !dbProfileExists(profileName) {
@@ -3,6 +3,7 @@ package datastore
 import (
 	"fmt"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/thanhpk/randstr"
@@ -16,6 +17,7 @@ const CurrentDataFileVersion = 1
 type DataFile struct {
 	Version   int                 `yaml:"version"`
 	Profiles  map[string]Profile  `yaml:"profiles,omitempty"`
+	RuleSets  map[string]RuleSet  `yaml:"rule-sets,omitempty"`
 	Notifiers map[string]Notifier `yaml:"notifiers,omitempty"`
 }
 
@@ -43,6 +45,35 @@ func ParseDataFile(path string) (DataFile, error) {
 		// in the future upgrade here
 	}
 
+	if tmpConfig.RuleSets == nil {
+		tmpConfig.RuleSets = make(map[string]RuleSet)
+	}
+
+	// invalid rules are skipped, so one broken rule doesn't take down all profiles
+	for name, ruleSet := range tmpConfig.RuleSets {
+		ruleSet.Name = name
+		ruleSet.Rules = tmpConfig.validRules(ruleSet.Rules, "rule set "+name, false)
+		tmpConfig.RuleSets[name] = ruleSet
+	}
+	for name, profile := range tmpConfig.Profiles {
+		if err := CheckTimezone(profile.Timezone); err != nil {
+			log.Errorf("Ignoring timezone of profile %s: %s", name, err.Error())
+			profile.Timezone = ""
+		}
+		var sources []Source
+		for i, source := range profile.Sources {
+			if source.URL == "" {
+				log.Errorf("Skipping source %d of profile %s: source has no url", i, name)
+				continue
+			}
+			source.Rules = tmpConfig.validRules(source.Rules, fmt.Sprintf("source %d of profile %s", i, name), true)
+			sources = append(sources, source)
+		}
+		profile.Sources = sources
+		profile.Rules = tmpConfig.validRules(profile.Rules, "profile "+name, true)
+		tmpConfig.Profiles[name] = profile
+	}
+
 	return tmpConfig, nil
 }
 
@@ -60,7 +91,11 @@ func ImportToDB(path string) error {
 		return fmt.Errorf("DB not initialized")
 	}
 
-	// import data into db
+	// import data into db, rule sets first as profiles may include them
+	for name, ruleSet := range data.RuleSets {
+		log.Info("Importing rule set " + name)
+		dbWriteRuleSet(ruleSet)
+	}
 	for name, profile := range data.Profiles {
 		// Write profile name into object
 		profile.Name = name
@@ -68,7 +103,7 @@ func ImportToDB(path string) error {
 		log.Info("Importing profile " + name)
 		dbWriteProfile(profile)
 		for _, source := range profile.Sources {
-			if !dbProfileSourceExists(profile, source) {
+			if !dbProfileSourceExists(profile, source.URL) {
 				dbAddProfileSource(profile, source)
 			}
 		}
@@ -127,21 +162,25 @@ func (c DataFile) GetProfileByName(name string) Profile {
 }
 
 // add a profile without tokens and without rules
-func (c DataFile) AddProfile(name string, sources []string, public bool, immutablepast bool) {
+func (c DataFile) AddProfile(name string, sources []Source, public bool, immutablepast bool, hideCancelled bool, timezone string) {
 	c.Profiles[name] = Profile{
 		Sources:       sources,
 		Public:        public,
 		ImmutablePast: immutablepast,
+		HideCancelled: hideCancelled,
+		Timezone:      timezone,
 		Tokens:        []Token{},
 		Rules:         []Rule{},
 	}
 }
 
-func (c DataFile) EditProfile(name string, sources []string, public bool, immutablepast bool) {
+func (c DataFile) EditProfile(name string, sources []Source, public bool, immutablepast bool, hideCancelled bool, timezone string) {
 	c.Profiles[name] = Profile{
 		Sources:       sources,
 		Public:        public,
 		ImmutablePast: immutablepast,
+		HideCancelled: hideCancelled,
+		Timezone:      timezone,
 		Tokens:        c.Profiles[name].Tokens,
 		Rules:         c.Profiles[name].Rules,
 	}
@@ -152,7 +191,7 @@ func (c DataFile) AddSource(profileName string, src string) error {
 		return fmt.Errorf("profile " + profileName + " does not exist")
 	}
 	p := c.Profiles[profileName]
-	p.Sources = append(c.Profiles[profileName].Sources, src)
+	p.Sources = append(c.Profiles[profileName].Sources, Source{URL: src})
 	c.Profiles[profileName] = p
 	return nil
 }
@@ -163,7 +202,7 @@ func (c DataFile) RemoveSource(profileName string, src string) error {
 	}
 	p := c.Profiles[profileName]
 	for i, cSource := range p.Sources {
-		if cSource == src {
+		if cSource.URL == src {
 			p.Sources = append(p.Sources[:i], p.Sources[i+1:]...)
 		}
 	}
@@ -183,6 +222,10 @@ func (c DataFile) AddRule(profileName string, rule Rule) error {
 }
 
 func (c DataFile) RemoveRule(profileName string, rule Rule) {
+	if !c.ruleExists(profileName, rule.Id) {
+		log.Warnf("rule %d does not exist in profile %s", rule.Id, profileName)
+		return
+	}
 	log.Info("Removing rule at position " + fmt.Sprint(rule.Id+1) + " from profile " + profileName)
 	p := c.Profiles[profileName]
 	p.Rules = append(p.Rules[:rule.Id], p.Rules[rule.Id+1:]...)
@@ -190,6 +233,96 @@ func (c DataFile) RemoveRule(profileName string, rule Rule) {
 	c.populateRuleIds(profileName)
 }
 
+func (c DataFile) MoveRule(profileName string, rule Rule, position int) error {
+	if !c.ruleExists(profileName, rule.Id) {
+		return fmt.Errorf("rule %d does not exist in profile %s", rule.Id, profileName)
+	}
+	p := c.Profiles[profileName]
+	if position < 0 {
+		position = 0
+	}
+	if position > len(p.Rules)-1 {
+		position = len(p.Rules) - 1
+	}
+	log.Info("Moving rule at position " + fmt.Sprint(rule.Id+1) + " to position " + fmt.Sprint(position+1) + " in profile " + profileName)
+	moved := p.Rules[rule.Id]
+	rules := make([]Rule, 0, len(p.Rules))
+	rules = append(rules, p.Rules[:rule.Id]...)
+	rules = append(rules, p.Rules[rule.Id+1:]...)
+	p.Rules = append(rules[:position], append([]Rule{moved}, rules[position:]...)...)
+	c.Profiles[profileName] = p
+	c.populateRuleIds(profileName)
+	return nil
+}
+
+func (c DataFile) RenameRule(profileName string, rule Rule, name string, description string) error {
+	if !c.ruleExists(profileName, rule.Id) {
+		return fmt.Errorf("rule %d does not exist in profile %s", rule.Id, profileName)
+	}
+	c.Profiles[profileName].Rules[rule.Id].Name = name
+	c.Profiles[profileName].Rules[rule.Id].Description = description
+	return nil
+}
+
+func (c DataFile) SetRuleEnabled(profileName string, rule Rule, enabled bool) error {
+	if !c.ruleExists(profileName, rule.Id) {
+		return fmt.Errorf("rule %d does not exist in profile %s", rule.Id, profileName)
+	}
+	c.Profiles[profileName].Rules[rule.Id].Disabled = !enabled
+	return nil
+}
+
+func (c DataFile) GetRuleSetNames() []string {
+	var names []string
+	for name := range c.RuleSets {
+		names = append(names, name)
+	}
+	// sorted like the database returns them
+	sort.Strings(names)
+	return names
+}
+
+func (c DataFile) RuleSetExists(name string) bool {
+	_, ok := c.RuleSets[name]
+	return ok
+}
+
+func (c DataFile) GetRuleSet(name string) RuleSet {
+	ruleSet := c.RuleSets[name]
+	for id := range ruleSet.Rules {
+		ruleSet.Rules[id].Id = id
+	}
+	return ruleSet
+}
+
+func (c DataFile) WriteRuleSet(ruleSet RuleSet) error {
+	if ruleSet.Name == "" {
+		return fmt.Errorf("rule set has no name")
+	}
+	log.Info("Writing rule set " + ruleSet.Name)
+	c.RuleSets[ruleSet.Name] = ruleSet
+	return nil
+}
+
+func (c DataFile) DeleteRuleSet(name string) error {
+	if !c.RuleSetExists(name) {
+		return fmt.Errorf("rule set " + name + " does not exist")
+	}
+	for profileName, profile := range c.Profiles {
+		rules := profile.Rules
+		for _, source := range profile.Sources {
+			rules = append(rules, source.Rules...)
+		}
+		for _, rule := range rules {
+			if rule.Include == name {
+				return fmt.Errorf("rule set %s is included by profile %s", name, profileName)
+			}
+		}
+	}
+	delete(c.RuleSets, name)
+	return nil
+}
+
 func (c DataFile) CreateToken(profileName string, note *string) error {
 	tokenString := randstr.Base62(64)
 	if !c.ProfileExists(profileName) {
@@ -285,6 +418,31 @@ func (c DataFile) AddNotifierHistory(notifierName string, recipient string, hist
 
 // internal helper functions
 
+// validRules returns the rules passing the integrity check, logging and skipping the others.
+func (c DataFile) validRules(rules []Rule, owner string, allowInclude bool) []Rule {
+	var valid []Rule
+	for i, rule := range rules {
+		err := rule.CheckRuleIntegrity()
+		if err == nil && rule.Include != "" {
+			if !allowInclude {
+				err = fmt.Errorf("rule sets can't include other rule sets")
+			} else if !c.RuleSetExists(rule.Include) {
+				err = fmt.Errorf("rule set %s does not exist", rule.Include)
+			}
+		}
+		if err != nil {
+			log.Errorf("Skipping rule %d of %s: %s", i, owner, err.Error())
+			continue
+		}
+		valid = append(valid, rule)
+	}
+	return valid
+}
+
+func (c DataFile) ruleExists(profileName string, ruleId int) bool {
+	return c.ProfileExists(profileName) && ruleId >= 0 && ruleId < len(c.Profiles[profileName].Rules)
+}
+
 func (c DataFile) populateRuleIds(profileName string) {
 	p := c.Profiles[profileName]
 	for id := range p.Rules {
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDataFile returns a data file with the profile "test" with rules named "a", "b" and "c".
+func testDataFile(t *testing.T) DataFile {
+	data := DataFile{Profiles: map[string]Profile{}, RuleSets: map[string]RuleSet{}}
+	data.AddProfile("test", nil, true, false, false, "")
+	for _, name := range []string{"a", "b", "c"} {
+		if err := data.AddRule("test", Rule{Name: name, Filters: []map[string]string{{"type": "all"}}, Action: map[string]string{"type": "delete"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+// ruleNames returns the names and ids of the rules of the profile "test", e.g. "[0:a 1:b]".
+func ruleNames(data DataFile) string {
+	var names []string
+	for _, rule := range data.GetProfileByName("test").Rules {
+		names = append(names, fmt.Sprintf("%d:%s", rule.Id, rule.Name))
+	}
+	return fmt.Sprint(names)
+}
+
+func TestDataFileMoveRule(t *testing.T) {
+	tests := []struct {
+		id       int
+		position int
+		expected string
+	}{
+		{2, 0, "[0:c 1:a 2:b]"},
+		{0, 1, "[0:b 1:a 2:c]"},
+		{0, 10, "[0:b 1:c 2:a]"},
+		{2, -1, "[0:c 1:a 2:b]"},
+		{1, 1, "[0:a 1:b 2:c]"},
+	}
+	for _, test := range tests {
+		data := testDataFile(t)
+		if err := data.MoveRule("test", Rule{Id: test.id}, test.position); err != nil {
+			t.Fatalf("Error moving rule %d to %d: %s", test.id, test.position, err)
+		}
+		if names := ruleNames(data); names != test.expected {
+			t.Errorf("Moving rule %d to %d: got %s -- should be %s", test.id, test.position, names, test.expected)
+		}
+	}
+}
+
+func TestDataFileEditRule(t *testing.T) {
+	data := testDataFile(t)
+	if err := data.RenameRule("test", Rule{Id: 1}, "renamed", "description"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetRuleEnabled("test", Rule{Id: 2}, false); err != nil {
+		t.Fatal(err)
+	}
+	rules := data.GetProfileByName("test").Rules
+	if rules[1].Name != "renamed" || rules[1].Description != "description" {
+		t.Errorf("got name %s and description %s -- should be renamed and description", rules[1].Name, rules[1].Description)
+	}
+	if !rules[2].Disabled || rules[0].Disabled {
+		t.Errorf("got disabled %v, %v -- should be only rule 2", rules[0].Disabled, rules[2].Disabled)
+	}
+	if err := data.SetRuleEnabled("test", Rule{Id: 2}, true); err != nil || data.GetProfileByName("test").Rules[2].Disabled {
+		t.Errorf("rule 2 should be enabled again")
+	}
+
+	data.RemoveRule("test", Rule{Id: 0})
+	if names := ruleNames(data); names != "[0:renamed 1:c]" {
+		t.Errorf("got %s after removing rule 0 -- should be [0:renamed 1:c]", names)
+	}
+}
+
+func TestDataFileRuleOutOfRange(t *testing.T) {
+	data := testDataFile(t)
+	for _, id := range []int{-1, 3} {
+		if err := data.MoveRule("test", Rule{Id: id}, 0); err == nil {
+			t.Errorf("moving rule %d should fail", id)
+		}
+		if err := data.RenameRule("test", Rule{Id: id}, "name", ""); err == nil {
+			t.Errorf("renaming rule %d should fail", id)
+		}
+		if err := data.SetRuleEnabled("test", Rule{Id: id}, false); err == nil {
+			t.Errorf("disabling rule %d should fail", id)
+		}
+		data.RemoveRule("test", Rule{Id: id})
+	}
+	if err := data.MoveRule("missing", Rule{Id: 0}, 1); err == nil {
+		t.Errorf("moving a rule of a missing profile should fail")
+	}
+	data.RemoveRule("missing", Rule{Id: 0})
+	if names := ruleNames(data); names != "[0:a 1:b 2:c]" {
+		t.Errorf("got %s -- should be unchanged [0:a 1:b 2:c]", names)
+	}
+}
+
+func TestParseDataFileSkipsInvalidRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.yml")
+	err := os.WriteFile(path, []byte(`version: 1
+rule-sets:
+  cleanup:
+    rules:
+      - filters: [{type: all}]
+        action: {type: unknown}
+      - name: valid
+        filters: [{type: all}]
+        action: {type: delete}
+profiles:
+  test:
+    timezone: Nowhere/Unknown
+    sources:
+      - url: ""
+      - url: https://example.com/calendar.ics
+        rules:
+          - include: missing
+    rules:
+      - name: a
+        filters: [{type: all}]
+        action: {type: delete}
+      - filters: [{type: unknown}]
+        action: {type: delete}
+      - name: b
+        include: cleanup
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ParseDataFile(path)
+	if err != nil {
+		t.Fatalf("invalid rules should be skipped: %s", err)
+	}
+	if names := ruleNames(data); names != "[0:a 1:b]" {
+		t.Errorf("got rules %s -- should be [0:a 1:b]", names)
+	}
+	if rules := data.GetRuleSet("cleanup").Rules; len(rules) != 1 || rules[0].Name != "valid" {
+		t.Errorf("got rule set rules %v -- should be only valid", rules)
+	}
+	profile := data.GetProfileByName("test")
+	if len(profile.Sources) != 1 || len(profile.Sources[0].Rules) != 0 {
+		t.Errorf("got sources %v -- should be one source without rules", profile.Sources)
+	}
+	if profile.Timezone != "" {
+		t.Errorf("got timezone %s -- should be removed", profile.Timezone)
+	}
+}
+
+func TestDataFileRuleSetNames(t *testing.T) {
+	data := DataFile{RuleSets: map[string]RuleSet{}}
+	for _, name := range []string{"cleanup", "exams", "branding", "zoom"} {
+		data.RuleSets[name] = RuleSet{Name: name}
+	}
+	if names := fmt.Sprint(data.GetRuleSetNames()); names != "[branding cleanup exams zoom]" {
+		t.Errorf("got %s -- should be sorted [branding cleanup exams zoom]", names)
+	}
+}
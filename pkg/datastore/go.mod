@@ -3,6 +3,7 @@ module github.com/jm-lemmi/ical-relay/datastore
 go 1.19
 
 require (
+	github.com/jm-lemmi/ical-relay/modules v0.0.0-00010101000000-000000000000
 	github.com/jmoiron/sqlx v1.4.0
 	github.com/lib/pq v1.10.9
 	github.com/sirupsen/logrus v1.9.3
@@ -10,4 +11,14 @@ require (
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.25.0 // indirect
+require (
+	github.com/arran4/golang-ical v0.2.4 // indirect
+	github.com/jm-lemmi/ical-relay/helpers v0.0.0-00010101000000-000000000000 // indirect
+	golang.org/x/sys v0.25.0 // indirect
+)
+
+replace (
+	github.com/arran4/golang-ical => ../../pkg/golang-ical
+	github.com/jm-lemmi/ical-relay/helpers => ../helpers
+	github.com/jm-lemmi/ical-relay/modules => ../modules
+)
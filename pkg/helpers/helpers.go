@@ -54,6 +54,11 @@ func LoadCalFile(filename string) (*ics.Calendar, error) {
 	return cal, nil
 }
 
+// CopyCalendar returns a deep copy of the calendar, by serializing and parsing it again.
+func CopyCalendar(cal *ics.Calendar) (*ics.Calendar, error) {
+	return ics.ParseCalendar(strings.NewReader(cal.Serialize()))
+}
+
 func DirectoryExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -175,3 +180,33 @@ func GetVTimezoneFromString(tzString string) (ics.VTimezone, error) {
 	}
 	return ics.VTimezone{}, fmt.Errorf("timezone not found: %s", tzString)
 }
+
+// returns a deep copy of the event, including its alarms
+func CopyEvent(event *ics.VEvent) *ics.VEvent {
+	newEvent := &ics.VEvent{}
+	newEvent.Properties = copyProperties(event.Properties)
+	for _, component := range event.Components {
+		switch c := component.(type) {
+		case *ics.VAlarm:
+			alarm := &ics.VAlarm{}
+			alarm.Properties = copyProperties(c.Properties)
+			newEvent.Components = append(newEvent.Components, alarm)
+		default:
+			newEvent.Components = append(newEvent.Components, component)
+		}
+	}
+	return newEvent
+}
+
+func copyProperties(properties []ics.IANAProperty) []ics.IANAProperty {
+	var newProperties []ics.IANAProperty
+	for _, prop := range properties {
+		params := make(map[string][]string)
+		for k, v := range prop.ICalParameters {
+			params[k] = append([]string{}, v...)
+		}
+		prop.ICalParameters = params
+		newProperties = append(newProperties, prop)
+	}
+	return newProperties
+}
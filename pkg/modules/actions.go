@@ -3,7 +3,10 @@ package modules
 import (
 	"fmt"
 	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	ics "github.com/arran4/golang-ical"
@@ -12,17 +15,20 @@ import (
 	"github.com/jm-lemmi/ical-relay/helpers"
 )
 
-// list of all actions
-var Actions = map[string]func(*ics.Calendar, []int, map[string]string) error{
+// built-in actions, registered with their schemas from builtinActionSchemas
+var builtinActions = map[string]func(*ics.Calendar, []int, map[string]string) error{
 	"delete":       ActionDelete,
 	"edit":         ActionEdit,
 	"add-reminder": ActionAddReminder,
 	"strip-info":   ActionStripInfo,
-}
 
-// This wrappter gets a function from the above action map and calls it with the indices and the passed calendar.
-func CallAction(action func(*ics.Calendar, []int, map[string]string) error, cal *ics.Calendar, indices []int, params map[string]string) error {
-	return action(cal, indices, params)
+	"expand-recurrences": ActionExpandRecurrences,
+	"merge-duplicates":   ActionMergeDuplicates,
+	"expose-source":      ActionExposeSource,
+	"replace":            ActionReplace,
+	"template":           ActionTemplate,
+	"property":           ActionProperty,
+	"timezone":           ActionTimezone,
 }
 
 // Deletes events from the calendar.
@@ -111,7 +117,7 @@ func ActionEdit(cal *ics.Calendar, indices []int, params map[string]string) erro
 				log.Debug("Changed location to " + event.GetProperty(ics.ComponentPropertyLocation).Value)
 			}
 			if _, ok := params["new-start"]; ok {
-				start, err := time.Parse(time.RFC3339, params["new-start"])
+				start, err := ParseDate(params["new-start"], time.Now())
 				if err != nil {
 					return fmt.Errorf("invalid start time: %s", err.Error())
 				}
@@ -119,7 +125,7 @@ func ActionEdit(cal *ics.Calendar, indices []int, params map[string]string) erro
 				log.Debug("Changed start to " + params["new-start"])
 			}
 			if _, ok := params["new-end"]; ok {
-				end, err := time.Parse(time.RFC3339, params["new-end"])
+				end, err := ParseDate(params["new-end"], time.Now())
 				if err != nil {
 					return fmt.Errorf("invalid end time: %s", err.Error())
 				}
@@ -151,16 +157,27 @@ func ActionEdit(cal *ics.Calendar, indices []int, params map[string]string) erro
 	return nil
 }
 
+// Adds alarms to events.
+// Params: one of 'before', 'after': comma separated durations before or after the start, e.g. "24h,15m",
+// the iCalendar format like "15M" is accepted as well, 'time': old name of 'before',
+// 'at': an absolute time, RFC3339 or a date expression.
+// 'related': "start" (default) or "end" of the event for 'before' and 'after'.
+// 'alarm-action': "display" (default), "audio" or "email", 'description' of display and email alarms,
+// default the summary of the event, 'summary': subject and 'attendees': comma separated recipients of email alarms.
+// 'remove-existing': "true" removes the alarms of the event first.
 func ActionAddReminder(cal *ics.Calendar, indices []int, params map[string]string) error {
-	// add reminder to events
+	r, err := parseReminder(params)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
 	for _, i := range indices {
 		switch cal.Components[i].(type) {
 		case *ics.VEvent:
 			event := cal.Components[i].(*ics.VEvent)
-			event.AddAlarm()
-			event.Alarms()[0].SetTrigger(("-PT" + params["time"]))
-			event.Alarms()[0].SetAction("DISPLAY")
-			cal.Components[i] = event
+			if err := r.add(event, now); err != nil {
+				return err
+			}
 			log.Debug("Added reminder to event " + event.Id())
 		}
 	}
@@ -228,6 +245,111 @@ func ActionStripInfo(cal *ics.Calendar, indices []int, params map[string]string)
 	return nil
 }
 
+// Expands recurring events into single events, so following rules can edit or delete single occurrences.
+// Params: 'after', 'before': only occurrences with their original start (RECURRENCE-ID) in this window are expanded,
+// so a moved occurrence is expanded with its slot in the series. RFC3339, "now" or a date expression.
+// Default is all occurrences up to one year from now.
+// 'uid': 'derived' (default) gives every instance a stable UID made from the series UID and the instance start,
+// 'recurrence-id' keeps the UID of the series and marks the instance with a RECURRENCE-ID.
+// Occurrences outside the window stay in the series, which is removed once all of its occurrences are expanded.
+func ActionExpandRecurrences(cal *ics.Calendar, indices []int, params map[string]string) error {
+	var after time.Time
+	var before time.Time
+	var err error
+	now := time.Now()
+	if params["after"] != "" {
+		after, err = ParseDate(params["after"], now)
+		if err != nil {
+			return fmt.Errorf("invalid start time: %s", err.Error())
+		}
+	}
+	if params["before"] == "" {
+		before = now.AddDate(1, 0, 0)
+	} else {
+		before, err = ParseDate(params["before"], now)
+		if err != nil {
+			return fmt.Errorf("invalid end time: %s", err.Error())
+		}
+	}
+	uidMode := params["uid"]
+	if uidMode == "" {
+		uidMode = "derived"
+	}
+	if uidMode != "derived" && uidMode != "recurrence-id" {
+		return fmt.Errorf("invalid uid mode: %s", uidMode)
+	}
+
+	expanded := make(map[int][]ics.Component)
+	removeSeries := make(map[int]bool)
+	consumed := make(map[*ics.VEvent]bool)
+	for _, i := range indices {
+		event, ok := cal.Components[i].(*ics.VEvent)
+		if !ok || !IsRecurring(event) {
+			continue
+		}
+		occurrences, err := GetOccurrences(cal, event, after, before)
+		if err != nil {
+			return err
+		}
+		format, err := getTimeFormat(event, ics.ComponentPropertyDtStart)
+		if err != nil {
+			return err
+		}
+		for _, o := range occurrences {
+			uid := ""
+			if uidMode == "derived" {
+				uid = InstanceUid(event.Id(), o)
+			}
+			instance, err := materializeOccurrence(event, o, uid)
+			if err != nil {
+				return err
+			}
+			if o.Override != nil {
+				consumed[o.Override] = true
+			}
+			expanded[i] = append(expanded[i], instance)
+		}
+
+		// keep the series only, if some of its occurrences were not expanded
+		remaining := false
+		err = IterateOccurrences(cal, event, func(o Occurrence) bool {
+			if o.RecurrenceId.Before(after) || !o.RecurrenceId.Before(before) {
+				remaining = true
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if !remaining {
+			removeSeries[i] = true
+		} else if uidMode == "derived" {
+			// exclude the expanded instances from the series, so they are not shown twice
+			for _, o := range occurrences {
+				value, params := format.value(o.RecurrenceId)
+				event.Properties = append(event.Properties, ics.IANAProperty{
+					BaseProperty: ics.BaseProperty{IANAToken: string(ics.ComponentPropertyExdate), ICalParameters: params, Value: value},
+				})
+			}
+		}
+		log.Debug("Expanded " + fmt.Sprint(len(occurrences)) + " occurrences of event " + event.Id())
+	}
+
+	var components []ics.Component
+	for i, component := range cal.Components {
+		if event, ok := component.(*ics.VEvent); ok && consumed[event] {
+			continue
+		}
+		if !removeSeries[i] {
+			components = append(components, component)
+		}
+		components = append(components, expanded[i]...)
+	}
+	cal.Components = components
+	return nil
+}
+
 // Fixes calendars where the timezone is set by TIMEZONE or X-WR-TIMEZONE property once instead of VTIMEZONE
 // adds a correct VTIMEZONE to the calendar.
 func ActionXWRTimezoneToVTimezone(cal *ics.Calendar) error {
@@ -266,3 +388,334 @@ func ActionXWRTimezoneToVTimezone(cal *ics.Calendar) error {
 
 	return nil
 }
+
+// Merges duplicates among the filtered events into the first of them and deletes the other ones.
+// Params: 'keys', 'tolerance', 'normalize' decide which events are duplicates, like for the duplicates filter.
+// 'separator': put between merged descriptions, default a blank line.
+// Categories are combined, differing descriptions are appended and properties missing in the first event
+// are taken from the duplicates.
+func ActionMergeDuplicates(cal *ics.Calendar, indices []int, params map[string]string) error {
+	key, err := parseDuplicateKey(params)
+	if err != nil {
+		return err
+	}
+	separator, ok := params["separator"]
+	if !ok {
+		separator = "\n\n"
+	}
+
+	duplicates := findDuplicates(cal, indices, key)
+	var remove []int
+	for i := range duplicates {
+		remove = append(remove, i)
+	}
+	sort.Ints(remove)
+	for _, i := range remove {
+		event := cal.Components[duplicates[i]].(*ics.VEvent)
+		log.Debug("Merging event " + cal.Components[i].(*ics.VEvent).Id() + " into " + event.Id())
+		mergeEvent(event, cal.Components[i].(*ics.VEvent), separator)
+	}
+	return ActionDelete(cal, remove, params)
+}
+
+// Shows subscribers the source the events came from, which is otherwise removed before returning the calendar.
+// Params: 'label': text to show, e.g. "Exam Office". Default the label of the source or the source itself.
+// 'property': "categories" (default) adds the label as category, any X- property name sets this property to the label.
+func ActionExposeSource(cal *ics.Calendar, indices []int, params map[string]string) error {
+	property := strings.ToUpper(params["property"])
+	if property == "" {
+		property = "CATEGORIES"
+	}
+	if property != "CATEGORIES" && !strings.HasPrefix(property, "X-") {
+		return fmt.Errorf("invalid property '%s', use categories or an X- property", params["property"])
+	}
+	if property == SourceProperty || property == SourceLabelProperty {
+		return fmt.Errorf("property %s is reserved", property)
+	}
+	for _, i := range indices {
+		event := cal.Components[i].(*ics.VEvent)
+		label := params["label"]
+		if label == "" {
+			label = eventSourceLabel(event)
+		}
+		if label == "" {
+			label = eventSource(event)
+		}
+		if label == "" {
+			continue
+		}
+		if property == "CATEGORIES" {
+			event.AddProperty(ics.ComponentPropertyCategories, escapeText(label))
+		} else {
+			event.SetProperty(ics.ComponentProperty(property), escapeText(label))
+		}
+		log.Debug("Exposed source of event " + event.Id() + " as " + label)
+	}
+	return nil
+}
+
+// Replaces matches of a regex in a text property of events.
+// Params: 'regex': the regex, 'replacement': the replacement, which can refer to capture groups as $1 or ${name}.
+// Default is an empty replacement, removing the matches.
+// 'target': "summary" (default), "description", "location", "categories" or any other text or X- property.
+// Values of list properties like categories are replaced one by one, values that become empty are removed.
+// 'count': "all" (default) or "first" match. 'ignore-case': "true" to match the regex case-insensitive.
+func ActionReplace(cal *ics.Calendar, indices []int, params map[string]string) error {
+	regex, err := compileReplaceRegex(params)
+	if err != nil {
+		return err
+	}
+	target := strings.ToUpper(params["target"])
+	if target == "" {
+		target = "SUMMARY"
+	}
+	if !isTextProperty(target) {
+		return fmt.Errorf("invalid target '%s', use a text or X- property", params["target"])
+	}
+	replace := func(value string) string {
+		if params["count"] == "first" {
+			return replaceFirst(regex, value, params["replacement"])
+		}
+		return regex.ReplaceAllString(value, params["replacement"])
+	}
+
+	for _, i := range indices {
+		event := cal.Components[i].(*ics.VEvent)
+		for j := len(event.Properties) - 1; j >= 0; j-- {
+			prop := &event.Properties[j]
+			if strings.ToUpper(prop.IANAToken) != target {
+				continue
+			}
+			if !isListProperty(target) {
+				prop.Value = escapeText(replace(unescapeText(prop.Value)))
+				continue
+			}
+			var values []string
+			for _, value := range splitList(prop.Value) {
+				if value = strings.TrimSpace(replace(unescapeText(value))); value != "" {
+					values = append(values, escapeText(value))
+				}
+			}
+			if len(values) == 0 {
+				event.Properties = helpers.RemoveProperty(event.Properties, j)
+			} else {
+				prop.Value = strings.Join(values, ",")
+			}
+		}
+		log.Debug("Replaced " + regex.String() + " in " + target + " of event " + event.Id())
+	}
+	return nil
+}
+
+// compileReplaceRegex compiles the regex of the replace action, honoring 'ignore-case'.
+func compileReplaceRegex(params map[string]string) (*regexp.Regexp, error) {
+	if params["regex"] == "" {
+		return nil, fmt.Errorf("missing mandatory Parameter 'regex'")
+	}
+	expression := params["regex"]
+	if ignoreCase, _ := strconv.ParseBool(params["ignore-case"]); ignoreCase {
+		expression = "(?i)" + expression
+	}
+	regex, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %s", err.Error())
+	}
+	return regex, nil
+}
+
+// replaceFirst replaces the first match of the regex in s, expanding capture groups in the replacement.
+func replaceFirst(regex *regexp.Regexp, s string, replacement string) string {
+	match := regex.FindStringSubmatchIndex(s)
+	if match == nil {
+		return s
+	}
+	return s[:match[0]] + string(regex.ExpandString(nil, replacement, s, match)) + s[match[1]:]
+}
+
+// Sets a text property of events to the result of a Go text/template, e.g. "{{.Summary}} ({{.Location}})".
+// Params: 'template': the template, executed on the fields of eventTemplateData.
+// 'target': "summary" (default), "description", "location", "categories" (comma separated) or any other text or X- property.
+// The property is removed, if the result is empty.
+// 'regex': regex matched against 'regex-target' (default "summary"), its capture groups are available as
+// {{index .Match 1}} or {{.Groups.name}}. Events not matching the regex are left unchanged.
+// 'timezone': timezone of start and end, e.g. "Europe/Berlin". Default the timezone of the event.
+func ActionTemplate(cal *ics.Calendar, indices []int, params map[string]string) error {
+	parsed, err := parseEventTemplate(params)
+	if err != nil {
+		return err
+	}
+	target := strings.ToUpper(params["target"])
+	if target == "" {
+		target = "SUMMARY"
+	}
+	if !isTextProperty(target) {
+		return fmt.Errorf("invalid target '%s', use a text or X- property", params["target"])
+	}
+
+	for _, i := range indices {
+		event := cal.Components[i].(*ics.VEvent)
+		data, ok := parsed.data(event)
+		if !ok {
+			log.Debug("Regex doesn't match event " + event.Id() + ", skipping template")
+			continue
+		}
+		result, err := parsed.execute(data)
+		if err != nil {
+			return fmt.Errorf("error executing template for event %s: %s", event.Id(), err.Error())
+		}
+		result = strings.TrimSpace(result)
+
+		var value string
+		if isListProperty(target) {
+			var values []string
+			for _, v := range strings.Split(result, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, escapeText(v))
+				}
+			}
+			value = strings.Join(values, ",")
+		} else {
+			value = escapeText(result)
+		}
+		removeProperties(event, ics.ComponentProperty(target))
+		if value != "" {
+			event.AddProperty(ics.ComponentProperty(target), value)
+		}
+		log.Debug("Set " + target + " of event " + event.Id() + " to " + result)
+	}
+	return nil
+}
+
+// Sets, appends or removes any property of events that doesn't define their identity or time, or edits its parameters.
+// Params: 'property': the property, e.g. "categories", "transp" or "X-MICROSOFT-CDO-BUSYSTATUS".
+// 'mode': "set" (default) replaces all values of the property with 'value', "append" adds 'value' as another
+// property, or as another value of lists like categories, "remove" removes the property, or only the values equal to
+// 'value' if given, "set-parameter" and "remove-parameter" edit the property parameter 'parameter', e.g. "LANGUAGE".
+// Text values are escaped, values of lists are comma separated.
+func ActionProperty(cal *ics.Calendar, indices []int, params map[string]string) error {
+	if err := checkPropertyAction(params); err != nil {
+		return err
+	}
+	property := ics.ComponentProperty(strings.ToUpper(params["property"]))
+	value := encodePropertyValue(string(property), params["value"])
+
+	for _, i := range indices {
+		event := cal.Components[i].(*ics.VEvent)
+		switch params["mode"] {
+		case "", "set":
+			removeProperties(event, property)
+			event.AddProperty(property, value)
+		case "append":
+			appended := false
+			if isListProperty(string(property)) {
+				for j := range event.Properties {
+					if event.Properties[j].IANAToken == string(property) {
+						if event.Properties[j].Value != "" {
+							event.Properties[j].Value += ","
+						}
+						event.Properties[j].Value += value
+						appended = true
+						break
+					}
+				}
+			}
+			if !appended {
+				event.AddProperty(property, value)
+			}
+		case "remove":
+			if params["value"] == "" {
+				removeProperties(event, property)
+				break
+			}
+			removePropertyValue(event, property, params["value"])
+		case "set-parameter":
+			for j := range event.Properties {
+				if event.Properties[j].IANAToken == string(property) {
+					if event.Properties[j].ICalParameters == nil {
+						event.Properties[j].ICalParameters = make(map[string][]string)
+					}
+					event.Properties[j].ICalParameters[strings.ToUpper(params["parameter"])] = []string{params["value"]}
+				}
+			}
+		case "remove-parameter":
+			for j := range event.Properties {
+				if event.Properties[j].IANAToken != string(property) {
+					continue
+				}
+				for key := range event.Properties[j].ICalParameters {
+					if strings.EqualFold(key, params["parameter"]) {
+						delete(event.Properties[j].ICalParameters, key)
+					}
+				}
+			}
+		}
+		log.Debug("Edited property " + string(property) + " of event " + event.Id())
+	}
+	return nil
+}
+
+// removePropertyValue removes the properties with the value, ignoring case. Lists lose the matching values only.
+func removePropertyValue(event *ics.VEvent, property ics.ComponentProperty, value string) {
+	matches := func(v string) bool {
+		return strings.EqualFold(strings.TrimSpace(unescapeText(v)), strings.TrimSpace(value))
+	}
+	for j := len(event.Properties) - 1; j >= 0; j-- {
+		prop := &event.Properties[j]
+		if prop.IANAToken != string(property) {
+			continue
+		}
+		if !isListProperty(string(property)) {
+			if matches(prop.Value) {
+				event.Properties = helpers.RemoveProperty(event.Properties, j)
+			}
+			continue
+		}
+		var values []string
+		for _, v := range splitList(prop.Value) {
+			if !matches(v) {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			event.Properties = helpers.RemoveProperty(event.Properties, j)
+		} else {
+			prop.Value = strings.Join(values, ",")
+		}
+	}
+}
+
+// Converts start, end and recurrence times of events to a timezone and adds the VTIMEZONEs used by the calendar.
+// Params: 'timezone': the timezone, e.g. "Europe/Berlin" or "UTC".
+// 'floating': timezone of floating times, that have no timezone, default the target timezone.
+// All-day events are kept. Events with a timezone unknown to the server are left unchanged.
+func ActionTimezone(cal *ics.Calendar, indices []int, params map[string]string) error {
+	location, err := loadTimezone(params["timezone"])
+	if err != nil {
+		return err
+	}
+	floating := location
+	if params["floating"] != "" {
+		if floating, err = loadTimezone(params["floating"]); err != nil {
+			return fmt.Errorf("floating: %s", err.Error())
+		}
+	}
+
+	for _, i := range indices {
+		// convert a copy, so events with invalid times stay unchanged
+		event := helpers.CopyEvent(cal.Components[i].(*ics.VEvent))
+		if err := convertEventTimezone(event, location, floating); err != nil {
+			log.Warn("Not converting timezone of event " + event.Id() + ": " + err.Error())
+			continue
+		}
+		cal.Components[i] = event
+		log.Debug("Converted event " + event.Id() + " to timezone " + location.String())
+	}
+
+	for _, tzid := range addMissingVTimezones(cal) {
+		if tzid == location.String() {
+			return fmt.Errorf("no VTIMEZONE found for timezone %s", tzid)
+		}
+		log.Warn("No VTIMEZONE found for timezone " + tzid)
+	}
+	return nil
+}
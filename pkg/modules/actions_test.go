@@ -0,0 +1,368 @@
+package modules
+
+import (
+	"fmt"
+	"testing"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// eventSummary describes the events of the calendar as "UID DTSTART" for comparisons.
+func eventSummary(cal *ics.Calendar) []string {
+	var events []string
+	for _, event := range cal.Events() {
+		start := ""
+		if prop := event.GetProperty(ics.ComponentPropertyDtStart); prop != nil {
+			start = prop.Value
+		}
+		events = append(events, event.Id()+" "+start)
+	}
+	return events
+}
+
+func TestActionExpandRecurrences(t *testing.T) {
+	window := map[string]string{"after": "2024-05-01T00:00:00Z", "before": "2024-06-01T00:00:00Z"}
+	tests := []struct {
+		name     string
+		events   []string
+		params   map[string]string
+		expected []string
+	}{
+		{"rrule with exdate", []string{`UID:series
+DTSTART:20240506T090000Z
+DTEND:20240506T100000Z
+RRULE:FREQ=DAILY;COUNT=4
+EXDATE:20240507T090000Z`}, window,
+			[]string{"series-20240506T090000Z 20240506T090000Z", "series-20240508T090000Z 20240508T090000Z", "series-20240509T090000Z 20240509T090000Z"}},
+		{"rdate", []string{`UID:series
+DTSTART:20240506T090000Z
+DTEND:20240506T100000Z
+RDATE:20240510T120000Z`}, window,
+			[]string{"series-20240506T090000Z 20240506T090000Z", "series-20240510T120000Z 20240510T120000Z"}},
+		{"overridden instance", []string{`UID:series
+DTSTART:20240506T090000Z
+DTEND:20240506T100000Z
+RRULE:FREQ=DAILY;COUNT=3`, `UID:series
+RECURRENCE-ID:20240507T090000Z
+DTSTART:20240507T140000Z
+DTEND:20240507T150000Z`}, window,
+			[]string{"series-20240506T090000Z 20240506T090000Z", "series-20240507T090000Z 20240507T140000Z", "series-20240508T090000Z 20240508T090000Z"}},
+		{"moved out of the window", []string{`UID:series
+DTSTART:20240506T090000Z
+DTEND:20240506T100000Z
+RRULE:FREQ=DAILY;COUNT=3`, `UID:series
+RECURRENCE-ID:20240507T090000Z
+DTSTART:20240520T090000Z
+DTEND:20240520T100000Z`}, map[string]string{"after": "2024-05-01T00:00:00Z", "before": "2024-05-08T00:00:00Z"},
+			[]string{"series 20240506T090000Z", "series-20240506T090000Z 20240506T090000Z", "series-20240507T090000Z 20240520T090000Z"}},
+		{"recurrence-id", []string{`UID:series
+DTSTART:20240506T090000Z
+DTEND:20240506T100000Z
+RRULE:FREQ=DAILY;COUNT=2`}, map[string]string{"after": "2024-05-01T00:00:00Z", "before": "2024-06-01T00:00:00Z", "uid": "recurrence-id"},
+			[]string{"series 20240506T090000Z", "series 20240507T090000Z"}},
+		{"single event", []string{`UID:single
+DTSTART:20240506T090000Z`}, window, []string{"single 20240506T090000Z"}},
+	}
+	for _, test := range tests {
+		cal := parseTestCalendar(t, test.events...)
+		indices, _ := FilterAll(cal, nil)
+		if err := ActionExpandRecurrences(cal, indices, test.params); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if events := eventSummary(cal); fmt.Sprint(events) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: got %v -- should be %v", test.name, events, test.expected)
+		}
+	}
+
+	// the series is kept for the occurrences outside of the window, without the expanded ones
+	cal := parseTestCalendar(t, `UID:series
+DTSTART:20240506T090000Z
+DTEND:20240506T100000Z
+RRULE:FREQ=DAILY;COUNT=4`)
+	err := ActionExpandRecurrences(cal, []int{0}, map[string]string{"after": "2024-05-01T00:00:00Z", "before": "2024-05-08T00:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := eventSummary(cal); len(events) != 3 || events[0] != "series 20240506T090000Z" {
+		t.Fatalf("got %v -- should be the series and two instances", events)
+	}
+	if starts := occurrenceStarts(t, cal, cal.Events()[0], 10); fmt.Sprint(starts) != "[20240508T090000Z 20240509T090000Z]" {
+		t.Errorf("got remaining occurrences %v -- should be [20240508T090000Z 20240509T090000Z]", starts)
+	}
+}
+
+func TestActionMergeDuplicates(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:first
+SUMMARY:Lecture
+DTSTART:20240506T090000Z
+DTEND:20240506T103000Z
+CATEGORIES:Course A`, `UID:second
+SUMMARY:Lecture
+DTSTART:20240506T090000Z
+DTEND:20240506T103000Z
+CATEGORIES:Course B
+LOCATION:Room 1
+DESCRIPTION:Bring a laptop`)
+
+	err := ActionMergeDuplicates(cal, []int{0, 1}, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := cal.Events()
+	if len(events) != 1 {
+		t.Fatalf("got %d events -- should be 1", len(events))
+	}
+	if categories := events[0].GetProperty(ics.ComponentPropertyCategories); categories == nil || categories.Value != "Course A,Course B" {
+		t.Errorf("got categories %v -- should be Course A,Course B", categories)
+	}
+	if location := events[0].GetLocation(); location != "Room 1" {
+		t.Errorf("got location %s -- should be Room 1", location)
+	}
+	if description := events[0].GetDescription(); description != "Bring a laptop" {
+		t.Errorf("got description %s -- should be Bring a laptop", description)
+	}
+}
+
+func TestActionReplace(t *testing.T) {
+	tests := []struct {
+		params   map[string]string
+		property ics.ComponentProperty
+		expected string
+	}{
+		{map[string]string{"regex": `^\[[^\]]*\] `}, ics.ComponentPropertySummary, "VL Maths vl"},
+		{map[string]string{"regex": `\bvl\b`, "replacement": "Lecture", "ignore-case": "true"}, ics.ComponentPropertySummary, "[R-0.12] Lecture Maths Lecture"},
+		{map[string]string{"regex": `\bvl\b`, "replacement": "Lecture", "ignore-case": "true", "count": "first"}, ics.ComponentPropertySummary, "[R-0.12] Lecture Maths vl"},
+		{map[string]string{"regex": `^\[R-(?P<room>[^\]]*)\].*`, "replacement": "Room ${room}, Building 1"}, ics.ComponentPropertySummary, "Room 0.12\\, Building 1"},
+		{map[string]string{"regex": "^Course (.)$", "replacement": "$1", "target": "categories"}, ics.ComponentPropertyCategories, "A,B"},
+		{map[string]string{"regex": "^Course A$", "target": "categories"}, ics.ComponentPropertyCategories, "Course B"},
+	}
+	for _, test := range tests {
+		cal := parseTestCalendar(t, `UID:lecture
+SUMMARY:[R-0.12] VL Maths vl
+CATEGORIES:Course A,Course B`)
+		if err := ActionReplace(cal, []int{0}, test.params); err != nil {
+			t.Fatalf("Error running action with %v: %s", test.params, err)
+		}
+		if prop := cal.Events()[0].GetProperty(test.property); prop == nil || prop.Value != test.expected {
+			t.Errorf("Replace %s: got %v -- should be %s", test.params["regex"], prop, test.expected)
+		}
+	}
+}
+
+func TestActionTemplate(t *testing.T) {
+	tests := []struct {
+		params   map[string]string
+		property ics.ComponentProperty
+		expected string
+	}{
+		{map[string]string{"template": "{{.Summary}} ({{.Location}})"}, ics.ComponentPropertySummary, "CS101 Lecture (Room 1)"},
+		{map[string]string{"template": "{{.Start.Format \"15:04\"}}", "timezone": "Europe/Berlin", "target": "x-start"}, "X-START", "11:00"},
+		{map[string]string{"template": "{{upper .Groups.course}}", "regex": "^(?P<course>[a-z]+)", "regex-target": "description", "target": "categories"}, ics.ComponentPropertyCategories, "MATHS"},
+		{map[string]string{"template": "{{index .Match 1}}", "regex": "^(Exam) "}, ics.ComponentPropertySummary, "CS101 Lecture"},
+		{map[string]string{"template": "{{join .Categories \", \"}}", "target": "description"}, ics.ComponentPropertyDescription, "A\\, B"},
+	}
+	for _, test := range tests {
+		cal := parseTestCalendar(t, `UID:lecture
+SUMMARY:CS101 Lecture
+LOCATION:Room 1
+DESCRIPTION:maths for beginners
+CATEGORIES:A,B
+DTSTART:20240506T090000Z
+DTEND:20240506T103000Z`)
+		if err := ActionTemplate(cal, []int{0}, test.params); err != nil {
+			t.Fatalf("Error running action with %v: %s", test.params, err)
+		}
+		if prop := cal.Events()[0].GetProperty(test.property); prop == nil || prop.Value != test.expected {
+			t.Errorf("Template %s: got %v -- should be %s", test.params["template"], prop, test.expected)
+		}
+	}
+
+	for _, params := range []map[string]string{
+		{"template": "{{.Room}}"},
+		{"template": "{{.Groups.room}}", "regex": "(?P<course>.*)"},
+		{"template": "{{index .Match 2}}", "regex": "(.*)"},
+	} {
+		params["type"] = "template"
+		if err := ValidateAction(params); err == nil {
+			t.Errorf("template %v should be invalid", params)
+		}
+	}
+}
+
+func TestActionProperty(t *testing.T) {
+	tests := []struct {
+		params   map[string]string
+		property ics.ComponentProperty
+		expected string // "" if the property should be removed
+	}{
+		{map[string]string{"property": "x-microsoft-cdo-busystatus", "value": "FREE"}, "X-MICROSOFT-CDO-BUSYSTATUS", "FREE"},
+		{map[string]string{"property": "transp", "value": "transparent"}, ics.ComponentPropertyTransp, "TRANSPARENT"},
+		{map[string]string{"property": "categories", "mode": "append", "value": "Optional, Lab"}, ics.ComponentPropertyCategories, "A,B,Optional,Lab"},
+		{map[string]string{"property": "categories", "mode": "remove", "value": "a"}, ics.ComponentPropertyCategories, "B"},
+		{map[string]string{"property": "attendee", "mode": "remove"}, ics.ComponentPropertyAttendee, ""},
+		{map[string]string{"property": "url", "value": "https://example.com/a,b"}, ics.ComponentPropertyUrl, "https://example.com/a,b"},
+	}
+	for _, test := range tests {
+		cal := parseTestCalendar(t, `UID:lecture
+SUMMARY:Lecture
+CATEGORIES:A,B
+ATTENDEE:mailto:a@example.com
+ATTENDEE:mailto:b@example.com`)
+		if err := ActionProperty(cal, []int{0}, test.params); err != nil {
+			t.Fatalf("Error running action with %v: %s", test.params, err)
+		}
+		value := ""
+		if prop := cal.Events()[0].GetProperty(test.property); prop != nil {
+			value = prop.Value
+		}
+		if value != test.expected {
+			t.Errorf("Action %v: got %s -- should be %s", test.params, value, test.expected)
+		}
+	}
+
+	cal := parseTestCalendar(t, `UID:lecture
+SUMMARY;LANGUAGE=de:Vorlesung`)
+	if err := ActionProperty(cal, []int{0}, map[string]string{"property": "summary", "mode": "set-parameter", "parameter": "language", "value": "en"}); err != nil {
+		t.Fatal(err)
+	}
+	if language := cal.Events()[0].GetProperty(ics.ComponentPropertySummary).ICalParameters["LANGUAGE"]; fmt.Sprint(language) != "[en]" {
+		t.Errorf("got LANGUAGE %v -- should be [en]", language)
+	}
+
+	for _, params := range []map[string]string{
+		{"property": "dtstart", "value": "20240101"},
+		{"property": "x-ical-relay-source", "value": "https://example.com"},
+		{"property": "status", "value": "canceled"},
+		{"property": "priority", "value": "10"},
+		{"property": "summary", "mode": "append", "value": "Lecture"},
+		{"property": "summary", "mode": "set-parameter", "parameter": "LANG;X=Y", "value": "en"},
+	} {
+		params["type"] = "property"
+		if err := ValidateAction(params); err == nil {
+			t.Errorf("action %v should be invalid", params)
+		}
+	}
+}
+
+func TestActionTimezone(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:floating
+DTSTART:20240506T090000
+DTEND:20240506T103000
+RRULE:FREQ=WEEKLY;UNTIL=20240603T090000
+EXDATE:20240513T090000,20240520T090000`, `UID:zoned
+DTSTART;TZID=America/New_York:20240506T090000
+DTEND;TZID=America/New_York:20240506T100000`, `UID:allday
+DTSTART;VALUE=DATE:20240506`, `UID:unknown
+DTSTART;TZID=Nowhere/Unknown:20240506T090000`)
+
+	err := ActionTimezone(cal, []int{0, 1, 2, 3}, map[string]string{"timezone": "UTC", "floating": "Europe/Berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		start string
+		end   string // "" if the event has no DTEND
+	}{
+		{"20240506T070000Z", "20240506T083000Z"},
+		{"20240506T130000Z", "20240506T140000Z"},
+		{"20240506", ""},
+		{"20240506T090000", ""},
+	}
+	for i, event := range cal.Events() {
+		if start := event.GetProperty(ics.ComponentPropertyDtStart).Value; start != expected[i].start {
+			t.Errorf("%s: got DTSTART %s -- should be %s", event.Id(), start, expected[i].start)
+		}
+		end := ""
+		if prop := event.GetProperty(ics.ComponentPropertyDtEnd); prop != nil {
+			end = prop.Value
+		}
+		if end != expected[i].end {
+			t.Errorf("%s: got DTEND %s -- should be %s", event.Id(), end, expected[i].end)
+		}
+	}
+	floating := cal.Events()[0]
+	if rrule := floating.GetProperty(ics.ComponentPropertyRrule).Value; rrule != "FREQ=WEEKLY;UNTIL=20240603T070000Z" {
+		t.Errorf("got RRULE %s -- should be FREQ=WEEKLY;UNTIL=20240603T070000Z", rrule)
+	}
+	if exdate := floating.GetProperty(ics.ComponentPropertyExdate).Value; exdate != "20240513T070000Z,20240520T070000Z" {
+		t.Errorf("got EXDATE %s -- should be 20240513T070000Z,20240520T070000Z", exdate)
+	}
+	if tzid := cal.Events()[1].GetProperty(ics.ComponentPropertyDtStart).ICalParameters["TZID"]; tzid != nil {
+		t.Errorf("got TZID %v after converting to UTC -- should be removed", tzid)
+	}
+
+	if err := ValidateAction(map[string]string{"type": "timezone", "timezone": "Local"}); err == nil {
+		t.Error("server dependent timezone Local should be invalid")
+	}
+}
+
+func TestActionAddReminder(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:exam
+SUMMARY:Exam
+DTSTART:20240506T090000Z
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER:-PT5M
+END:VALARM`)
+
+	err := ActionAddReminder(cal, []int{0}, map[string]string{"time": "1H"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ActionAddReminder(cal, []int{0}, map[string]string{"before": "24h,1h30m", "related": "end"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ActionAddReminder(cal, []int{0}, map[string]string{"at": "2024-05-01T08:00:00+02:00", "alarm-action": "email", "attendees": "student@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"-PT5M", "-PT1H", "-P1D", "-PT1H30M", "20240501T060000Z"}
+	alarms := cal.Events()[0].Alarms()
+	if len(alarms) != len(expected) {
+		t.Fatalf("got %d alarms -- should be %d", len(alarms), len(expected))
+	}
+	for i, alarm := range alarms {
+		if trigger := alarm.GetProperty(ics.ComponentPropertyTrigger); trigger == nil || trigger.Value != expected[i] {
+			t.Errorf("alarm %d: got trigger %v -- should be %s", i, trigger, expected[i])
+		}
+	}
+	if related := alarms[2].GetProperty(ics.ComponentPropertyTrigger).ICalParameters["RELATED"]; fmt.Sprint(related) != "[END]" {
+		t.Errorf("got RELATED %v -- should be [END]", related)
+	}
+	if attendee := alarms[4].GetProperty(ics.ComponentPropertyAttendee); attendee == nil || attendee.Value != "mailto:student@example.com" {
+		t.Errorf("got attendee %v -- should be mailto:student@example.com", attendee)
+	}
+
+	err = ActionAddReminder(cal, []int{0}, map[string]string{"before": "15m", "remove-existing": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alarms := cal.Events()[0].Alarms(); len(alarms) != 1 {
+		t.Errorf("got %d alarms after removing the existing ones -- should be 1", len(alarms))
+	}
+
+	// the iCalendar format of the old time parameter is accepted everywhere, and time accepts durations as well
+	for _, params := range []map[string]string{{"before": "15M"}, {"before": "PT15M"}, {"time": "15m"}} {
+		params["remove-existing"] = "true"
+		err = ActionAddReminder(cal, []int{0}, params)
+		if err != nil {
+			t.Fatalf("Error adding reminder %v: %s", params, err)
+		}
+		if trigger := cal.Events()[0].Alarms()[0].GetProperty(ics.ComponentPropertyTrigger); trigger.Value != "-PT15M" {
+			t.Errorf("reminder %v: got trigger %s -- should be -PT15M", params, trigger.Value)
+		}
+	}
+
+	for _, params := range []map[string]string{
+		{"type": "add-reminder"},
+		{"type": "add-reminder", "before": "15m", "after": "15m"},
+		{"type": "add-reminder", "before": "-15m"},
+		{"type": "add-reminder", "before": "15m", "alarm-action": "email"},
+	} {
+		if err := ValidateAction(params); err == nil {
+			t.Errorf("action %v should be invalid", params)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// named anchors for date expressions, e.g. the start dates of all semesters
+var dateAnchors = map[string][]time.Time{}
+
+// SetDateAnchors sets the named anchors usable in date expressions, e.g. "start of next semester".
+// Every anchor is a list of dates in RFC3339 or "2006-01-02" format, marking the start of each period.
+func SetDateAnchors(anchors map[string][]string) error {
+	parsed := make(map[string][]time.Time)
+	for name, dates := range anchors {
+		if name == "" || strings.ContainsAny(name, " +-") {
+			return fmt.Errorf("invalid date anchor name '%s'", name)
+		}
+		for _, date := range dates {
+			t, err := time.Parse(time.RFC3339, date)
+			if err != nil {
+				t, err = time.ParseInLocation("2006-01-02", date, time.Local)
+				if err != nil {
+					return fmt.Errorf("invalid date '%s' of date anchor '%s'", date, name)
+				}
+			}
+			parsed[name] = append(parsed[name], t)
+		}
+		sort.Slice(parsed[name], func(i, j int) bool {
+			return parsed[name][i].Before(parsed[name][j])
+		})
+	}
+	dateAnchors = parsed
+	return nil
+}
+
+var (
+	isoDurationRegex = regexp.MustCompile(`^([+-]?)P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+	periodRegex      = regexp.MustCompile(`^(start|end) of (this|next|last) (\S+)$`)
+)
+
+// ParseDate evaluates a date expression relative to now. Supported expressions are:
+//   - "now" or an absolute RFC3339 time, e.g. "2024-01-01T00:00:00Z"
+//   - an ISO 8601 duration relative to now, e.g. "-P30D" or "+P6M"
+//   - "today", or "start of"/"end of" followed by "this", "next" or "last" and "day", "week", "month", "year"
+//     or the name of a date anchor, e.g. "start of next week" or "end of this semester"
+//
+// The last two can be followed by a duration, e.g. "start of this week +P7D".
+func ParseDate(expression string, now time.Time) (time.Time, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "now" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, expression); err == nil {
+		return t, nil
+	}
+	if isoDurationRegex.MatchString(expression) {
+		return addIsoDuration(now, expression)
+	}
+
+	// split off a trailing offset
+	base := expression
+	offset := ""
+	if i := strings.LastIndex(expression, " "); i > 0 && isoDurationRegex.MatchString(expression[i+1:]) {
+		base = strings.TrimSpace(expression[:i])
+		offset = expression[i+1:]
+	}
+
+	var t time.Time
+	if base == "today" {
+		t = startOfPeriod(now, "day", 0)
+	} else {
+		match := periodRegex.FindStringSubmatch(base)
+		if match == nil {
+			return time.Time{}, fmt.Errorf("invalid date expression '%s'", expression)
+		}
+		relative := map[string]int{"last": -1, "this": 0, "next": 1}[match[2]]
+		if match[1] == "end" {
+			// the end of a period is the start of the following one
+			relative++
+		}
+		var err error
+		t, err = startOfAnyPeriod(now, match[3], relative)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	if offset != "" {
+		return addIsoDuration(t, offset)
+	}
+	return t, nil
+}
+
+// startOfAnyPeriod returns the start of the calendar period or date anchor, relative periods away from the one containing now.
+func startOfAnyPeriod(now time.Time, period string, relative int) (time.Time, error) {
+	switch period {
+	case "day", "week", "month", "year":
+		return startOfPeriod(now, period, relative), nil
+	}
+	anchors, ok := dateAnchors[period]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown period or date anchor '%s'", period)
+	}
+	// index of the anchor starting the current period
+	current := -1
+	for i, anchor := range anchors {
+		if !anchor.After(now) {
+			current = i
+		}
+	}
+	i := current + relative
+	if i < 0 || i >= len(anchors) {
+		return time.Time{}, fmt.Errorf("date anchor '%s' has no date for this expression", period)
+	}
+	return anchors[i], nil
+}
+
+// startOfPeriod returns the start of the day, week (starting on monday), month or year, relative periods away from now.
+func startOfPeriod(now time.Time, period string, relative int) time.Time {
+	year, month, day := now.Date()
+	switch period {
+	case "week":
+		weekday := (int(now.Weekday()) + 6) % 7 // monday is 0
+		return time.Date(year, month, day-weekday+7*relative, 0, 0, 0, 0, now.Location())
+	case "month":
+		return time.Date(year, month+time.Month(relative), 1, 0, 0, 0, 0, now.Location())
+	case "year":
+		return time.Date(year+relative, 1, 1, 0, 0, 0, 0, now.Location())
+	default:
+		return time.Date(year, month, day+relative, 0, 0, 0, 0, now.Location())
+	}
+}
+
+// addIsoDuration adds an ISO 8601 duration like "P1Y2M3DT4H" or "-P1W" to t.
+// Years, months, weeks and days are added in calendar time, so "P1D" keeps the time of day across DST changes.
+func addIsoDuration(t time.Time, duration string) (time.Time, error) {
+	match := isoDurationRegex.FindStringSubmatch(duration)
+	if match == nil || strings.TrimLeft(duration, "+-") == "P" || strings.HasSuffix(duration, "T") {
+		return time.Time{}, fmt.Errorf("invalid duration '%s'", duration)
+	}
+	values := make([]int, 7)
+	for i, value := range match[2:] {
+		if value != "" {
+			values[i], _ = strconv.Atoi(value)
+		}
+	}
+	sign := 1
+	if match[1] == "-" {
+		sign = -1
+	}
+	t = t.AddDate(sign*values[0], sign*values[1], sign*(7*values[2]+values[3]))
+	return t.Add(time.Duration(sign) * (time.Duration(values[4])*time.Hour +
+		time.Duration(values[5])*time.Minute + time.Duration(values[6])*time.Second)), nil
+}
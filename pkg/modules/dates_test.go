@@ -0,0 +1,52 @@
+package modules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	err := SetDateAnchors(map[string][]string{
+		"semester": {"2024-10-01T00:00:00Z", "2024-04-01T00:00:00Z", "2025-04-01T00:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetDateAnchors(nil)
+
+	now := time.Date(2024, 11, 14, 15, 30, 0, 0, time.UTC) // a thursday
+	tests := []struct {
+		expression string
+		expected   time.Time
+		valid      bool
+	}{
+		{"now", now, true},
+		{"2024-01-01T10:00:00Z", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), true},
+		{"-P30D", time.Date(2024, 10, 15, 15, 30, 0, 0, time.UTC), true},
+		{"+P6M", time.Date(2025, 5, 14, 15, 30, 0, 0, time.UTC), true},
+		{"P1W", time.Date(2024, 11, 21, 15, 30, 0, 0, time.UTC), true},
+		{"PT1H30M", time.Date(2024, 11, 14, 17, 0, 0, 0, time.UTC), true},
+		{"today", time.Date(2024, 11, 14, 0, 0, 0, 0, time.UTC), true},
+		{"start of this week", time.Date(2024, 11, 11, 0, 0, 0, 0, time.UTC), true},
+		{"end of this week", time.Date(2024, 11, 18, 0, 0, 0, 0, time.UTC), true},
+		{"start of next month", time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), true},
+		{"start of last year", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"start of this week +P28D", time.Date(2024, 12, 9, 0, 0, 0, 0, time.UTC), true},
+		{"start of this semester", time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC), true},
+		{"start of next semester", time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC), true},
+		{"end of next semester", time.Time{}, false},
+		{"start of next holidays", time.Time{}, false},
+		{"P", time.Time{}, false},
+		{"tomorrow", time.Time{}, false},
+	}
+	for _, test := range tests {
+		result, err := ParseDate(test.expression, now)
+		if (err == nil) != test.valid {
+			t.Errorf("'%s': got error %v, should be valid: %t", test.expression, err, test.valid)
+			continue
+		}
+		if test.valid && !result.Equal(test.expected) {
+			t.Errorf("'%s': got %s, expected %s", test.expression, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+var duplicateKeyFields = []string{"uid", "start", "end", "summary", "location", "description"}
+
+// duplicateKey describes when two events are duplicates of each other.
+type duplicateKey struct {
+	fields    []string      // compared fields, see duplicateKeyFields
+	tolerance time.Duration // start and end may differ by this much
+	normalize bool          // compare text ignoring case and whitespace
+}
+
+// parseDuplicateKey reads the parameters "keys" (default "start,end,summary"), "tolerance" and "normalize".
+func parseDuplicateKey(params map[string]string) (duplicateKey, error) {
+	key := duplicateKey{fields: []string{"start", "end", "summary"}}
+	var err error
+	if params["keys"] != "" {
+		key.fields = nil
+		for _, field := range strings.Split(params["keys"], ",") {
+			field = strings.ToLower(strings.TrimSpace(field))
+			valid := false
+			for _, f := range duplicateKeyFields {
+				valid = valid || f == field
+			}
+			if !valid {
+				return key, fmt.Errorf("invalid key '%s', use %s", field, strings.Join(duplicateKeyFields, ", "))
+			}
+			key.fields = append(key.fields, field)
+		}
+	}
+	if params["tolerance"] != "" {
+		if key.tolerance, err = time.ParseDuration(params["tolerance"]); err != nil {
+			return key, fmt.Errorf("invalid tolerance: %s", err.Error())
+		}
+	}
+	if params["normalize"] != "" {
+		if key.normalize, err = strconv.ParseBool(params["normalize"]); err != nil {
+			return key, fmt.Errorf("invalid normalize: %s", err.Error())
+		}
+	}
+	return key, nil
+}
+
+// equal checks whether the events are duplicates. Missing properties are compared as empty values.
+func (key duplicateKey) equal(a *ics.VEvent, b *ics.VEvent) bool {
+	for _, field := range key.fields {
+		switch field {
+		case "uid":
+			if a.Id() != b.Id() {
+				return false
+			}
+		case "start", "end":
+			difference := eventTime(a, field).Sub(eventTime(b, field))
+			if difference > key.tolerance || -difference > key.tolerance {
+				return false
+			}
+		default:
+			if key.text(a, field) != key.text(b, field) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// text returns the value of the text property, normalized if configured.
+func (key duplicateKey) text(event *ics.VEvent, property string) string {
+	var value string
+	if values := getPropertyValues(event, property, ""); len(values) > 0 {
+		value = values[0].Value
+	}
+	if key.normalize {
+		value = strings.ToLower(strings.Join(strings.Fields(value), " "))
+	}
+	return value
+}
+
+// eventTime returns the start or end of the event, or the zero time if it has none.
+// The end is calculated from DURATION, if there is no DTEND.
+func eventTime(event *ics.VEvent, which string) time.Time {
+	start, err := event.GetStartAt()
+	if err != nil {
+		return time.Time{}
+	}
+	if which == "start" {
+		return start
+	}
+	format, _ := getTimeFormat(event, ics.ComponentPropertyDtStart)
+	return start.Add(eventDuration(event, start, format.AllDay))
+}
+
+// findDuplicates compares the events at the indices in order.
+// Returns the index of every duplicate, mapped to the index of the first event it duplicates.
+func findDuplicates(cal *ics.Calendar, indices []int, key duplicateKey) map[int]int {
+	sorted := append([]int{}, indices...)
+	sort.Ints(sorted)
+	duplicates := make(map[int]int)
+	var firsts []int
+	for _, i := range sorted {
+		event, ok := cal.Components[i].(*ics.VEvent)
+		if !ok {
+			continue
+		}
+		duplicate := false
+		for _, first := range firsts {
+			if key.equal(cal.Components[first].(*ics.VEvent), event) {
+				duplicates[i] = first
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			firsts = append(firsts, i)
+		}
+	}
+	return duplicates
+}
+
+// mergeEvent merges the duplicate into the event: categories are combined, differing descriptions are appended
+// with the separator and properties missing in the event are taken from the duplicate.
+func mergeEvent(event *ics.VEvent, duplicate *ics.VEvent, separator string) {
+	// categories
+	categories := []string{}
+	seen := make(map[string]bool)
+	for _, e := range []*ics.VEvent{event, duplicate} {
+		for _, category := range getPropertyValues(e, "CATEGORIES", "") {
+			value := strings.TrimSpace(category.Value)
+			if value != "" && !seen[strings.ToLower(value)] {
+				seen[strings.ToLower(value)] = true
+				categories = append(categories, escapeText(value))
+			}
+		}
+	}
+	if len(categories) > 0 {
+		removeProperties(event, ics.ComponentPropertyCategories)
+		event.AddProperty(ics.ComponentPropertyCategories, strings.Join(categories, ","))
+	}
+
+	// descriptions
+	description := ""
+	if values := getPropertyValues(event, "DESCRIPTION", ""); len(values) > 0 {
+		description = values[0].Value
+	}
+	if values := getPropertyValues(duplicate, "DESCRIPTION", ""); len(values) > 0 {
+		other := strings.TrimSpace(values[0].Value)
+		if other != "" && !strings.Contains(description, other) {
+			if strings.TrimSpace(description) != "" {
+				description += separator
+			}
+			description += other
+			event.SetProperty(ics.ComponentPropertyDescription, escapeText(description))
+		}
+	}
+
+	// missing properties
+	for _, prop := range duplicate.Properties {
+		switch ics.ComponentProperty(strings.ToUpper(prop.IANAToken)) {
+		case ics.ComponentPropertyRrule, ics.ComponentPropertyRdate, ics.ComponentPropertyExdate, ics.ComponentPropertyRecurrenceId:
+			continue
+		}
+		if event.GetProperty(ics.ComponentProperty(strings.ToUpper(prop.IANAToken))) == nil {
+			event.Properties = append(event.Properties, prop)
+		}
+	}
+}
@@ -0,0 +1,796 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	ics "github.com/arran4/golang-ical"
+
+	"github.com/jm-lemmi/ical-relay/helpers"
+)
+
+// Expressions are a small typed language for filtering events, e.g.
+//
+//	duration > 2h && summary =~ "Exam" && weekday(start) in [1, 2]
+//
+// Expressions are type checked when they are compiled, so errors are found when a rule is saved.
+// They can only read the event and have no loops, so evaluating them always terminates and has no side effects.
+
+const (
+	maxExpressionLength = 4096
+	maxExpressionDepth  = 64
+)
+
+// types of expression values, lists are "list of " followed by the type of their elements
+const (
+	exprBool     = "bool"
+	exprNumber   = "number"
+	exprString   = "string"
+	exprDuration = "duration"
+	exprTime     = "time"
+)
+
+func exprListOf(elem string) string {
+	return "list of " + elem
+}
+
+// exprEnv is the environment an expression is evaluated in.
+type exprEnv struct {
+	event *ics.VEvent
+	now   time.Time // the same for all events of a filter run
+}
+
+// exprEval evaluates a compiled (sub)expression to a bool, float64, string, time.Duration, time.Time or []interface{}.
+type exprEval func(env *exprEnv) (interface{}, error)
+
+// exprNode is a compiled and type checked (sub)expression.
+type exprNode struct {
+	typ     string
+	eval    exprEval
+	literal *string // the value of string literals, known at compile time
+}
+
+// Expression is a compiled boolean expression over the fields of an event.
+type Expression struct {
+	root exprNode
+}
+
+// fields of the event available in expressions
+var exprFields = map[string]struct {
+	typ   string
+	value func(event *ics.VEvent) interface{}
+}{
+	"summary":     {exprString, exprText("SUMMARY")},
+	"description": {exprString, exprText("DESCRIPTION")},
+	"location":    {exprString, exprText("LOCATION")},
+	"uid":         {exprString, func(event *ics.VEvent) interface{} { return event.Id() }},
+	"status":      {exprString, exprText("STATUS")},
+	"class":       {exprString, exprText("CLASS")},
+	"source":      {exprString, func(event *ics.VEvent) interface{} { return eventSource(event) }},
+	"start":       {exprTime, func(event *ics.VEvent) interface{} { return eventTime(event, "start") }},
+	"end":         {exprTime, func(event *ics.VEvent) interface{} { return eventTime(event, "end") }},
+	"duration": {exprDuration, func(event *ics.VEvent) interface{} {
+		return eventTime(event, "end").Sub(eventTime(event, "start"))
+	}},
+	"allday": {exprBool, func(event *ics.VEvent) interface{} {
+		format, _ := getTimeFormat(event, ics.ComponentPropertyDtStart)
+		return format.AllDay
+	}},
+	"recurring": {exprBool, func(event *ics.VEvent) interface{} {
+		return event.GetProperty(ics.ComponentPropertyRrule) != nil || event.GetProperty(ics.ComponentPropertyRdate) != nil
+	}},
+	"categories": {exprListOf(exprString), func(event *ics.VEvent) interface{} {
+		categories := []interface{}{}
+		for _, value := range getPropertyValues(event, "CATEGORIES", "") {
+			categories = append(categories, value.Value)
+		}
+		return categories
+	}},
+}
+
+// exprText returns an accessor for the first value of the text property, "" if the event doesn't have it.
+func exprText(property string) func(event *ics.VEvent) interface{} {
+	return func(event *ics.VEvent) interface{} {
+		if values := getPropertyValues(event, property, ""); len(values) > 0 {
+			return values[0].Value
+		}
+		return ""
+	}
+}
+
+// CompileExpression parses and type checks the expression, which has to evaluate to a bool.
+func CompileExpression(source string) (*Expression, error) {
+	if len(source) > maxExpressionLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxExpressionLength)
+	}
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != exprTokenEnd {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", p.peek().text, p.peek().pos)
+	}
+	if root.typ != exprBool {
+		return nil, fmt.Errorf("expression is a %s, not a bool", root.typ)
+	}
+	return &Expression{root: root}, nil
+}
+
+// Matches evaluates the expression for the event.
+func (expression *Expression) Matches(event *ics.VEvent, now time.Time) (bool, error) {
+	value, err := expression.root.eval(&exprEnv{event: event, now: now})
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+// LEXER
+
+type exprTokenKind int
+
+const (
+	exprTokenEnd exprTokenKind = iota
+	exprTokenNumber
+	exprTokenDuration
+	exprTokenString
+	exprTokenIdent
+	exprTokenOperator
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+var (
+	exprDurationRegex = regexp.MustCompile(`^(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+`)
+	exprNumberRegex   = regexp.MustCompile(`^\d+(\.\d+)?`)
+	exprOperators     = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "+", "-", "*", "/", "(", ")", "[", "]", ","}
+)
+
+func lexExpression(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	pos := 0
+	for pos < len(source) {
+		rest := source[pos:]
+		r := rune(rest[0])
+		switch {
+		case unicode.IsSpace(r):
+			pos++
+		case exprDurationRegex.MatchString(rest):
+			text := exprDurationRegex.FindString(rest)
+			tokens = append(tokens, exprToken{exprTokenDuration, text, pos})
+			pos += len(text)
+		case exprNumberRegex.MatchString(rest):
+			text := exprNumberRegex.FindString(rest)
+			tokens = append(tokens, exprToken{exprTokenNumber, text, pos})
+			pos += len(text)
+		case r == '"':
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("unterminated string at position %d", pos)
+			}
+			text, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %s", pos, err.Error())
+			}
+			tokens = append(tokens, exprToken{exprTokenString, text, pos})
+			pos += end + 1
+		case r == '_' || unicode.IsLetter(r):
+			end := 0
+			for end < len(rest) && (rest[end] == '_' || unicode.IsLetter(rune(rest[end])) || unicode.IsDigit(rune(rest[end]))) {
+				end++
+			}
+			tokens = append(tokens, exprToken{exprTokenIdent, rest[:end], pos})
+			pos += end
+		default:
+			found := false
+			for _, operator := range exprOperators {
+				if strings.HasPrefix(rest, operator) {
+					tokens = append(tokens, exprToken{exprTokenOperator, operator, pos})
+					pos += len(operator)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", r, pos)
+			}
+		}
+	}
+	return append(tokens, exprToken{exprTokenEnd, "end of expression", pos}), nil
+}
+
+// PARSER
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != exprTokenEnd {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token, if it is the operator or keyword
+func (p *exprParser) accept(text string) bool {
+	token := p.peek()
+	if (token.kind == exprTokenOperator || token.kind == exprTokenIdent) && token.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected '%s' at position %d, got '%s'", text, p.peek().pos, p.peek().text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseLogical("&&", p.parseComparison)
+}
+
+// parseLogical parses operands joined by the short-circuiting operator "||" or "&&".
+func (p *exprParser) parseLogical(operator string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return left, err
+	}
+	for p.peek().kind == exprTokenOperator && p.peek().text == operator {
+		pos := p.next().pos
+		right, err := operand()
+		if err != nil {
+			return right, err
+		}
+		if left.typ != exprBool || right.typ != exprBool {
+			return left, fmt.Errorf("operator %s at position %d needs bools, got %s and %s", operator, pos, left.typ, right.typ)
+		}
+		l, r := left.eval, right.eval
+		// "||" stops at the first true, "&&" at the first false
+		stop := operator == "||"
+		left = exprNode{typ: exprBool, eval: func(env *exprEnv) (interface{}, error) {
+			value, err := l(env)
+			if err != nil || value.(bool) == stop {
+				return value, err
+			}
+			return r(env)
+		}}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return left, err
+	}
+	token := p.peek()
+	switch {
+	case token.kind == exprTokenOperator && helpers.Contains([]string{"==", "!=", "<", "<=", ">", ">=", "=~", "!~"}, token.text):
+	case token.kind == exprTokenIdent && token.text == "in":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseAdditive()
+	if err != nil {
+		return right, err
+	}
+	node, err := compareNodes(token.text, left, right)
+	if err != nil {
+		return node, fmt.Errorf("operator %s at position %d: %s", token.text, token.pos, err.Error())
+	}
+	return node, nil
+}
+
+func compareNodes(operator string, left exprNode, right exprNode) (exprNode, error) {
+	l, r := left.eval, right.eval
+	switch operator {
+	case "=~", "!~":
+		if left.typ != exprString || right.literal == nil {
+			return left, fmt.Errorf("needs a string and a regex string literal")
+		}
+		regex, err := regexp.Compile(*right.literal)
+		if err != nil {
+			return left, fmt.Errorf("invalid regex: %s", err.Error())
+		}
+		negate := operator == "!~"
+		return exprNode{typ: exprBool, eval: func(env *exprEnv) (interface{}, error) {
+			value, err := l(env)
+			if err != nil {
+				return nil, err
+			}
+			return regex.MatchString(value.(string)) != negate, nil
+		}}, nil
+	case "in":
+		if left.typ == exprString && right.typ == exprString {
+			return binaryNode(exprBool, l, r, func(a, b interface{}) (interface{}, error) {
+				return strings.Contains(b.(string), a.(string)), nil
+			}), nil
+		}
+		if right.typ != exprListOf(left.typ) {
+			return left, fmt.Errorf("can't look for a %s in a %s", left.typ, right.typ)
+		}
+		return binaryNode(exprBool, l, r, func(a, b interface{}) (interface{}, error) {
+			for _, element := range b.([]interface{}) {
+				if compareValues(a, element) == 0 {
+					return true, nil
+				}
+			}
+			return false, nil
+		}), nil
+	}
+
+	if left.typ != right.typ {
+		return left, fmt.Errorf("can't compare %s with %s", left.typ, right.typ)
+	}
+	if strings.HasPrefix(left.typ, "list") || (left.typ == exprBool && operator != "==" && operator != "!=") {
+		return left, fmt.Errorf("can't compare %ss", left.typ)
+	}
+	return binaryNode(exprBool, l, r, func(a, b interface{}) (interface{}, error) {
+		c := compareValues(a, b)
+		switch operator {
+		case "==":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}), nil
+}
+
+// compareValues returns -1, 0 or 1 if a is less than, equal to or greater than b, which have the same type.
+func compareValues(a interface{}, b interface{}) int {
+	less, equal := false, false
+	switch a := a.(type) {
+	case bool:
+		equal = a == b.(bool)
+	case float64:
+		less, equal = a < b.(float64), a == b.(float64)
+	case string:
+		less, equal = a < b.(string), a == b.(string)
+	case time.Duration:
+		less, equal = a < b.(time.Duration), a == b.(time.Duration)
+	case time.Time:
+		less, equal = a.Before(b.(time.Time)), a.Equal(b.(time.Time))
+	}
+	if equal {
+		return 0
+	}
+	if less {
+		return -1
+	}
+	return 1
+}
+
+// binaryNode evaluates both operands and combines them with the function.
+func binaryNode(typ string, l exprEval, r exprEval, combine func(a, b interface{}) (interface{}, error)) exprNode {
+	return exprNode{typ: typ, eval: func(env *exprEnv) (interface{}, error) {
+		a, err := l(env)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r(env)
+		if err != nil {
+			return nil, err
+		}
+		return combine(a, b)
+	}}
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	return p.parseArithmetic([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	return p.parseArithmetic([]string{"*", "/"}, p.parseUnary)
+}
+
+// parseArithmetic parses operands joined by the left associative operators.
+func (p *exprParser) parseArithmetic(operators []string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return left, err
+	}
+	for p.peek().kind == exprTokenOperator && helpers.Contains(operators, p.peek().text) {
+		token := p.next()
+		right, err := operand()
+		if err != nil {
+			return right, err
+		}
+		left, err = arithmeticNode(token.text, left, right)
+		if err != nil {
+			return left, fmt.Errorf("operator %s at position %d: %s", token.text, token.pos, err.Error())
+		}
+	}
+	return left, nil
+}
+
+func arithmeticNode(operator string, left exprNode, right exprNode) (exprNode, error) {
+	l, r := left.eval, right.eval
+	types := left.typ + " " + operator + " " + right.typ
+	switch types {
+	case "number + number", "number - number", "number * number", "number / number":
+		return binaryNode(exprNumber, l, r, func(a, b interface{}) (interface{}, error) {
+			x, y := a.(float64), b.(float64)
+			switch operator {
+			case "+":
+				return x + y, nil
+			case "-":
+				return x - y, nil
+			case "*":
+				return x * y, nil
+			}
+			if y == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return x / y, nil
+		}), nil
+	case "string + string":
+		return binaryNode(exprString, l, r, func(a, b interface{}) (interface{}, error) {
+			return a.(string) + b.(string), nil
+		}), nil
+	case "duration + duration", "duration - duration":
+		return binaryNode(exprDuration, l, r, func(a, b interface{}) (interface{}, error) {
+			if operator == "-" {
+				return a.(time.Duration) - b.(time.Duration), nil
+			}
+			return a.(time.Duration) + b.(time.Duration), nil
+		}), nil
+	case "duration * number", "duration / number":
+		return binaryNode(exprDuration, l, r, func(a, b interface{}) (interface{}, error) {
+			if operator == "*" {
+				return time.Duration(float64(a.(time.Duration)) * b.(float64)), nil
+			}
+			if b.(float64) == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return time.Duration(float64(a.(time.Duration)) / b.(float64)), nil
+		}), nil
+	case "duration / duration":
+		return binaryNode(exprNumber, l, r, func(a, b interface{}) (interface{}, error) {
+			if b.(time.Duration) == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return float64(a.(time.Duration)) / float64(b.(time.Duration)), nil
+		}), nil
+	case "time + duration", "time - duration":
+		return binaryNode(exprTime, l, r, func(a, b interface{}) (interface{}, error) {
+			if operator == "-" {
+				return a.(time.Time).Add(-b.(time.Duration)), nil
+			}
+			return a.(time.Time).Add(b.(time.Duration)), nil
+		}), nil
+	case "time - time":
+		return binaryNode(exprDuration, l, r, func(a, b interface{}) (interface{}, error) {
+			return a.(time.Time).Sub(b.(time.Time)), nil
+		}), nil
+	}
+	return left, fmt.Errorf("can't calculate %s", types)
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	token := p.peek()
+	if token.kind == exprTokenOperator && (token.text == "!" || token.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return operand, err
+		}
+		o := operand.eval
+		switch {
+		case token.text == "!" && operand.typ == exprBool:
+			return exprNode{typ: exprBool, eval: func(env *exprEnv) (interface{}, error) {
+				value, err := o(env)
+				if err != nil {
+					return nil, err
+				}
+				return !value.(bool), nil
+			}}, nil
+		case token.text == "-" && operand.typ == exprNumber:
+			return exprNode{typ: exprNumber, eval: func(env *exprEnv) (interface{}, error) {
+				value, err := o(env)
+				if err != nil {
+					return nil, err
+				}
+				return -value.(float64), nil
+			}}, nil
+		case token.text == "-" && operand.typ == exprDuration:
+			return exprNode{typ: exprDuration, eval: func(env *exprEnv) (interface{}, error) {
+				value, err := o(env)
+				if err != nil {
+					return nil, err
+				}
+				return -value.(time.Duration), nil
+			}}, nil
+		}
+		return operand, fmt.Errorf("operator %s at position %d can't be applied to a %s", token.text, token.pos, operand.typ)
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExpressionDepth {
+		return exprNode{}, fmt.Errorf("expression is nested deeper than %d levels", maxExpressionDepth)
+	}
+
+	token := p.next()
+	switch token.kind {
+	case exprTokenNumber:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return exprNode{}, fmt.Errorf("invalid number '%s' at position %d", token.text, token.pos)
+		}
+		return constantNode(exprNumber, number), nil
+	case exprTokenDuration:
+		duration, err := time.ParseDuration(token.text)
+		if err != nil {
+			return exprNode{}, fmt.Errorf("invalid duration '%s' at position %d", token.text, token.pos)
+		}
+		return constantNode(exprDuration, duration), nil
+	case exprTokenString:
+		node := constantNode(exprString, token.text)
+		text := token.text
+		node.literal = &text
+		return node, nil
+	case exprTokenIdent:
+		switch token.text {
+		case "true", "false":
+			return constantNode(exprBool, token.text == "true"), nil
+		}
+		if p.peek().kind == exprTokenOperator && p.peek().text == "(" {
+			return p.parseCall(token)
+		}
+		field, ok := exprFields[token.text]
+		if !ok {
+			return exprNode{}, fmt.Errorf("unknown field '%s' at position %d", token.text, token.pos)
+		}
+		return exprNode{typ: field.typ, eval: func(env *exprEnv) (interface{}, error) {
+			return field.value(env.event), nil
+		}}, nil
+	case exprTokenOperator:
+		switch token.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return node, err
+			}
+			return node, p.expect(")")
+		case "[":
+			return p.parseList(token)
+		}
+	}
+	return exprNode{}, fmt.Errorf("unexpected '%s' at position %d", token.text, token.pos)
+}
+
+func constantNode(typ string, value interface{}) exprNode {
+	return exprNode{typ: typ, eval: func(env *exprEnv) (interface{}, error) {
+		return value, nil
+	}}
+}
+
+// parseList parses the elements of a list literal, which all have to have the same type.
+func (p *exprParser) parseList(open exprToken) (exprNode, error) {
+	var elements []exprNode
+	for !p.accept("]") {
+		if len(elements) > 0 {
+			if err := p.expect(","); err != nil {
+				return exprNode{}, err
+			}
+		}
+		element, err := p.parseOr()
+		if err != nil {
+			return element, err
+		}
+		if len(elements) > 0 && element.typ != elements[0].typ {
+			return element, fmt.Errorf("list at position %d mixes %s and %s", open.pos, elements[0].typ, element.typ)
+		}
+		elements = append(elements, element)
+	}
+	if len(elements) == 0 {
+		return exprNode{}, fmt.Errorf("empty list at position %d", open.pos)
+	}
+	return exprNode{typ: exprListOf(elements[0].typ), eval: func(env *exprEnv) (interface{}, error) {
+		values := make([]interface{}, len(elements))
+		for i, element := range elements {
+			value, err := element.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}}, nil
+}
+
+// parseCall parses the arguments of a function call and checks their types.
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	p.next() // (
+	var args []exprNode
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return exprNode{}, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return arg, err
+		}
+		args = append(args, arg)
+	}
+	node, err := callNode(name.text, args)
+	if err != nil {
+		return node, fmt.Errorf("%s() at position %d: %s", name.text, name.pos, err.Error())
+	}
+	return node, nil
+}
+
+// timeParts are the functions returning a part of a time, optionally in the timezone given as second argument.
+var timeParts = map[string]func(t time.Time) int{
+	"weekday": func(t time.Time) int { return (int(t.Weekday())+6)%7 + 1 }, // monday is 1, sunday is 7
+	"hour":    func(t time.Time) int { return t.Hour() },
+	"minute":  func(t time.Time) int { return t.Minute() },
+	"day":     func(t time.Time) int { return t.Day() },
+	"month":   func(t time.Time) int { return int(t.Month()) },
+	"year":    func(t time.Time) int { return t.Year() },
+}
+
+func callNode(name string, args []exprNode) (exprNode, error) {
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = arg.typ
+	}
+	signature := strings.Join(types, ", ")
+
+	if part, ok := timeParts[name]; ok {
+		location := time.Local
+		switch {
+		case signature == exprTime:
+		case signature == exprTime+", "+exprString && args[1].literal != nil:
+			var err error
+			location, err = time.LoadLocation(*args[1].literal)
+			if err != nil {
+				return exprNode{}, fmt.Errorf("unknown timezone '%s'", *args[1].literal)
+			}
+		default:
+			return exprNode{}, fmt.Errorf("needs a time and optionally a timezone string literal, got (%s)", signature)
+		}
+		t := args[0].eval
+		timezone := len(args) > 1
+		return exprNode{typ: exprNumber, eval: func(env *exprEnv) (interface{}, error) {
+			value, err := t(env)
+			if err != nil {
+				return nil, err
+			}
+			if timezone {
+				return float64(part(value.(time.Time).In(location))), nil
+			}
+			return float64(part(value.(time.Time))), nil
+		}}, nil
+	}
+
+	switch name + "(" + signature + ")" {
+	case "lower(string)", "upper(string)", "trim(string)":
+		s := args[0].eval
+		convert := map[string]func(string) string{"lower": strings.ToLower, "upper": strings.ToUpper, "trim": strings.TrimSpace}[name]
+		return exprNode{typ: exprString, eval: func(env *exprEnv) (interface{}, error) {
+			value, err := s(env)
+			if err != nil {
+				return nil, err
+			}
+			return convert(value.(string)), nil
+		}}, nil
+	case "len(string)":
+		s := args[0].eval
+		return exprNode{typ: exprNumber, eval: func(env *exprEnv) (interface{}, error) {
+			value, err := s(env)
+			if err != nil {
+				return nil, err
+			}
+			return float64(len([]rune(value.(string)))), nil
+		}}, nil
+	case "contains(string, string)":
+		return binaryNode(exprBool, args[0].eval, args[1].eval, func(a, b interface{}) (interface{}, error) {
+			return strings.Contains(a.(string), b.(string)), nil
+		}), nil
+	case "now()":
+		return exprNode{typ: exprTime, eval: func(env *exprEnv) (interface{}, error) {
+			return env.now, nil
+		}}, nil
+	case "minutes(duration)", "hours(duration)", "days(duration)":
+		d := args[0].eval
+		unit := map[string]time.Duration{"minutes": time.Minute, "hours": time.Hour, "days": 24 * time.Hour}[name]
+		return exprNode{typ: exprNumber, eval: func(env *exprEnv) (interface{}, error) {
+			value, err := d(env)
+			if err != nil {
+				return nil, err
+			}
+			return float64(value.(time.Duration)) / float64(unit), nil
+		}}, nil
+	case "date(string)", "prop(string)", "has(string)":
+		if args[0].literal == nil {
+			return exprNode{}, fmt.Errorf("needs a string literal")
+		}
+		literal := *args[0].literal
+		switch name {
+		case "date":
+			if _, err := ParseDate(literal, time.Now()); err != nil {
+				return exprNode{}, err
+			}
+			return exprNode{typ: exprTime, eval: func(env *exprEnv) (interface{}, error) {
+				return ParseDate(literal, env.now)
+			}}, nil
+		case "prop":
+			return exprNode{typ: exprString, eval: func(env *exprEnv) (interface{}, error) {
+				return exprText(literal)(env.event), nil
+			}}, nil
+		default:
+			return exprNode{typ: exprBool, eval: func(env *exprEnv) (interface{}, error) {
+				return len(getPropertyValues(env.event, literal, "")) > 0, nil
+			}}, nil
+		}
+	}
+	if _, ok := exprFunctions[name]; !ok {
+		return exprNode{}, fmt.Errorf("unknown function")
+	}
+	return exprNode{}, fmt.Errorf("can't be called with (%s), use %s", signature, exprFunctions[name])
+}
+
+// signatures of all functions besides the time parts, for error messages
+var exprFunctions = map[string]string{
+	"lower":    "lower(string)",
+	"upper":    "upper(string)",
+	"trim":     "trim(string)",
+	"len":      "len(string)",
+	"contains": "contains(string, string)",
+	"now":      "now()",
+	"minutes":  "minutes(duration)",
+	"hours":    "hours(duration)",
+	"days":     "days(duration)",
+	"date":     "date(\"date expression\")",
+	"prop":     "prop(\"PROPERTY\")",
+	"has":      "has(\"PROPERTY\")",
+}
@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpression(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:exam
+SUMMARY:Exam Mathematics
+DTSTART:20240506T090000Z
+DTEND:20240506T120000Z
+CATEGORIES:Exams,Mathematics
+X-ROOM:A 101`)
+	event := cal.Events()[0]
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		{`duration > 2h && summary =~ "Exam" && weekday(start) in [1, 2]`, true},
+		{`duration >= 3h && duration < 3h1m`, true},
+		{`hours(duration) == 3 && hour(start) == 9`, true},
+		{`"Exams" in categories && !("Lectures" in categories)`, true},
+		{`"math" in lower(summary)`, true},
+		{`location == "" && prop("X-ROOM") == "A 101" && has("x-room")`, true},
+		{`start > now() && start < date("start of next month")`, true},
+		{`end - start == 3h && start + 3h == end`, true},
+		{`summary !~ "^Exam" || len(summary) < 5`, false},
+		{`weekday(start, "Pacific/Auckland") == 1 && hour(start, "Pacific/Auckland") == 21`, true},
+		{`recurring || allday`, false},
+	}
+	for _, test := range tests {
+		expression, err := CompileExpression(test.expression)
+		if err != nil {
+			t.Errorf("'%s': %s", test.expression, err)
+			continue
+		}
+		result, err := expression.Matches(event, now)
+		if err != nil {
+			t.Errorf("'%s': %s", test.expression, err)
+		} else if result != test.expected {
+			t.Errorf("'%s': got %t -- should be %t", test.expression, result, test.expected)
+		}
+	}
+
+	invalid := []string{
+		`summary`,
+		`summary > 2`,
+		`duration > 2`,
+		`summary =~ "("`,
+		`summary =~ location`,
+		`unknown == 1`,
+		`weekday(start) in [1, "2"]`,
+		`weekday(summary) == 1`,
+		`date("tomorrow") > start`,
+		`(true`,
+		`"unterminated`,
+	}
+	for _, expression := range invalid {
+		if _, err := CompileExpression(expression); err == nil {
+			t.Errorf("'%s' should be invalid", expression)
+		}
+	}
+
+	expression, err := CompileExpression(`1 / (weekday(start) - 1) > 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expression.Matches(event, now); err == nil {
+		t.Error("division by zero should fail")
+	}
+}
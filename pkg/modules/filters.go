@@ -1,37 +1,41 @@
 package modules
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	ics "github.com/arran4/golang-ical"
 	log "github.com/sirupsen/logrus"
-
-	"github.com/jm-lemmi/ical-relay/helpers"
 )
 
-// list of all filters
-var Filters = map[string]func(*ics.Calendar, map[string]string) ([]int, error){
+// built-in filters, registered with their schemas from builtinFilterSchemas
+var builtinFilters = map[string]func(*ics.Calendar, map[string]string) ([]int, error){
 	"regex":      FilterRegex,
 	"id":         FilterId,
 	"timeframe":  FilterTimeframe,
 	"duplicates": FilterDuplicates,
 	"all":        FilterAll,
 	"duration":   FilterDuration,
-}
-
-// This wrappter gets a function from the above filters map and calls it with the parameters and the passed calendar.
-// parameters can be any dictionary. The function will then choose how to handle the parameters.
-// Returns an array of indices of the events that are filtered out.
-func CallFilter(filter func(*ics.Calendar, map[string]string) ([]int, error), cal *ics.Calendar, params map[string]string) ([]int, error) {
-	return filter(cal, params)
+	"property":   FilterProperty,
+	"weekday":    FilterWeekday,
+	"source":     FilterSource,
+	"expr":       FilterExpr,
+	"status":     FilterStatus,
+	"class":      FilterClass,
+	"transp":     FilterTransp,
+	"overlap":    FilterOverlap,
 }
 
 // Filters by regex.
 // Params: 'regex'
 // 'target' is the property to search in. Default is 'summary'
+// Any other property name can be used as target, multi-valued properties match if any value matches.
 // Returns the number of added entries. negative, if it removed entries.
 func FilterRegex(cal *ics.Calendar, params map[string]string) ([]int, error) {
 	var indices []int
@@ -41,7 +45,10 @@ func FilterRegex(cal *ics.Calendar, params map[string]string) ([]int, error) {
 	if params["target"] == "" {
 		params["target"] = "summary"
 	}
-	regex, _ := regexp.Compile(params["regex"])
+	regex, err := regexp.Compile(params["regex"])
+	if err != nil {
+		return indices, fmt.Errorf("invalid regex: %s", err.Error())
+	}
 
 	for i, component := range cal.Components { // iterate over events
 		switch cal.Components[i].(type) {
@@ -68,6 +75,19 @@ func FilterRegex(cal *ics.Calendar, params map[string]string) ([]int, error) {
 				} else {
 					continue
 				}
+			default:
+				matched := false
+				for _, value := range getPropertyValues(event, params["target"], "") {
+					if regex.MatchString(value.Value) {
+						matched = true
+						break
+					}
+				}
+				if matched {
+					indices = append(indices, i)
+					log.Debug("Filtering event with id " + event.Id() + "\n")
+				}
+				continue
 			}
 
 			if regex.MatchString(target) {
@@ -99,7 +119,7 @@ func FilterId(cal *ics.Calendar, params map[string]string) ([]int, error) {
 			event := component.(*ics.VEvent)
 			if event.Id() == params["id"] {
 				indices = append(indices, i)
-				log.Debug("Filter event with id " + params["id"] + " and index " + string(i) + "\n")
+				log.Debug("Filter event with id " + params["id"] + " and index " + fmt.Sprint(i) + "\n")
 			}
 		default:
 			// print type of component
@@ -111,9 +131,10 @@ func FilterId(cal *ics.Calendar, params map[string]string) ([]int, error) {
 
 // Filter by timeframe.
 // Parameters: either "after" or "before" mandatory
-// Format is RFC3339: "2006-01-02T15:04:05Z"
-// or "now" for current time
-// TODO: implement RRULE compatibility from v1.3.1
+// Format is RFC3339: "2006-01-02T15:04:05Z", "now" for current time
+// or a date expression like "-P30D" or "start of next week", see ParseDate.
+// Recurring events are filtered, if any of their occurrences starts inside the timeframe.
+// Occurrences overridden by another component (RECURRENCE-ID) are judged by that component instead.
 func FilterTimeframe(cal *ics.Calendar, params map[string]string) ([]int, error) {
 	var indices []int
 
@@ -124,13 +145,12 @@ func FilterTimeframe(cal *ics.Calendar, params map[string]string) ([]int, error)
 	if params["after"] == "" && params["before"] == "" {
 		return indices, fmt.Errorf("missing both Parameters 'after' or 'before'. One has to be present")
 	}
+	now := time.Now()
 	if params["after"] == "" {
 		log.Debug("No after time given. Using time 0.\n")
 		after = time.Time{}
-	} else if params["after"] == "now" {
-		after = time.Now()
 	} else {
-		after, err = time.Parse(time.RFC3339, params["after"])
+		after, err = ParseDate(params["after"], now)
 		if err != nil {
 			return indices, fmt.Errorf("invalid start time: %s", err.Error())
 		}
@@ -138,10 +158,8 @@ func FilterTimeframe(cal *ics.Calendar, params map[string]string) ([]int, error)
 	if params["before"] == "" {
 		log.Debug("No end time given. Using max time\n")
 		before = time.Unix(1<<63-1-int64((1969*365+1969/4-1969/100+1969/400)*24*60*60), 999999999)
-	} else if params["before"] == "now" {
-		before = time.Now()
 	} else {
-		before, err = time.Parse(time.RFC3339, params["before"])
+		before, err = ParseDate(params["before"], now)
 		if err != nil {
 			return indices, fmt.Errorf("invalid end time: %s", err.Error())
 		}
@@ -153,11 +171,28 @@ func FilterTimeframe(cal *ics.Calendar, params map[string]string) ([]int, error)
 		switch component.(type) {
 		case *ics.VEvent:
 			event := component.(*ics.VEvent)
-			if event.GetProperty(ics.ComponentPropertyRrule) != nil {
-				// event is a repeating event
-				// TODO: get all repeating dates (as its own function) and filter them
-				// TODO: add to rruleIndices
-				// TODO: break out of switch
+			if IsRecurring(event) {
+				// event is a repeating event, look for the first occurrence inside the timeframe
+				matched := false
+				err := IterateOccurrences(cal, event, func(o Occurrence) bool {
+					if !o.RecurrenceId.Before(before) && !o.Start.Before(before) {
+						return false
+					}
+					if o.Override == nil && o.Start.After(after) && before.After(o.Start) {
+						matched = true
+						return false
+					}
+					return true
+				})
+				if err != nil {
+					log.Warn("Could not expand recurring event, using its start instead: " + err.Error())
+				} else {
+					if matched {
+						indices = append(indices, i)
+						log.Debug("Filtered recurring event with id " + event.Id() + "\n")
+					}
+					continue
+				}
 			}
 			date, _ := event.GetStartAt()
 			if date.After(after) && before.After(date) {
@@ -174,35 +209,32 @@ func FilterTimeframe(cal *ics.Calendar, params map[string]string) ([]int, error)
 
 // Looks for duplicate events and returns the indices of duplicate events.
 // Only the second and following events are returned, the first is not.
+// Parameters: "keys" comma separated list of uid, start, end, summary, location and description,
+// the properties that have to be equal. Default "start,end,summary".
+// "tolerance" duration, start and end may differ by this much. Default 0.
+// "normalize" "true" compares text ignoring case and whitespace. Default "false".
 func FilterDuplicates(cal *ics.Calendar, params map[string]string) ([]int, error) {
 	var indices []int
-	var uniques []string
-	for i, component := range cal.Components { // iterate over events
-		switch component.(type) {
-		case *ics.VEvent:
-			event := component.(*ics.VEvent)
-			start, _ := event.GetStartAt()
-			end, _ := event.GetEndAt()
-			identifier := start.String() + end.String() + event.GetProperty(ics.ComponentPropertySummary).Value
-			if helpers.StringInSlice(identifier, uniques) {
-				indices = append(indices, i)
-				log.Debug("Filter event with id " + event.Id() + "\n")
-			} else {
-				uniques = append(uniques, identifier)
-			}
-		default:
-			// print type of component
-			log.Debug("Unknown component type ignored: " + reflect.TypeOf(cal.Components[i]).String() + "\n")
-		}
+	key, err := parseDuplicateKey(params)
+	if err != nil {
+		return indices, err
+	}
+	all, _ := FilterAll(cal, params)
+	for i := range findDuplicates(cal, all, key) {
+		indices = append(indices, i)
+		log.Debug("Filter event with id " + cal.Components[i].(*ics.VEvent).Id() + "\n")
 	}
+	sort.Ints(indices)
 	return indices, nil
 }
 
 // This function filters all events, so returns a list of all indices
 func FilterAll(cal *ics.Calendar, params map[string]string) ([]int, error) {
 	var indices []int
-	for i := range cal.Events() {
-		indices = append(indices, i)
+	for i, component := range cal.Components {
+		if _, ok := component.(*ics.VEvent); ok {
+			indices = append(indices, i)
+		}
 	}
 	return indices, nil
 }
@@ -255,3 +287,606 @@ func FilterDuration(cal *ics.Calendar, params map[string]string) ([]int, error)
 	log.Trace("Duration Filter indices: " + fmt.Sprint(indices) + "\n")
 	return indices, nil
 }
+
+// Filters by any property of the event, including X- properties and property parameters.
+// Parameters: "property" (mandatory) name of the property, e.g. "categories", "attendee" or "x-microsoft-cdo-busystatus"
+// "parameter" compares the values of this property parameter instead of the property value, e.g. "partstat"
+// "mode" exists (default), equals, contains, regex, less, greater.
+// less and greater compare numbers, or dates in RFC3339 or iCalendar format.
+// "value" the value to compare with. Mandatory for all modes but exists.
+// "case-sensitive" true/false (default: false) for equals and contains.
+// "match" any (default) or all. Multi-valued properties (e.g. multiple ATTENDEEs or comma separated CATEGORIES)
+// match if any or all of their values match.
+func FilterProperty(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	var indices []int
+
+	if params["property"] == "" {
+		return indices, fmt.Errorf("missing mandatory Parameter 'property'")
+	}
+	mode := params["mode"]
+	if mode == "" {
+		mode = "exists"
+	}
+	match := params["match"]
+	if match == "" {
+		match = "any"
+	}
+	if match != "any" && match != "all" {
+		return indices, fmt.Errorf("invalid match: %s", match)
+	}
+	caseSensitive := false
+	if params["case-sensitive"] != "" {
+		var err error
+		if caseSensitive, err = strconv.ParseBool(params["case-sensitive"]); err != nil {
+			return indices, fmt.Errorf("invalid case-sensitive: %s", err.Error())
+		}
+	}
+
+	var compare func(propertyValue) bool
+	switch mode {
+	case "exists":
+		compare = func(propertyValue) bool { return true }
+	case "equals", "contains":
+		if params["value"] == "" {
+			return indices, fmt.Errorf("missing mandatory Parameter 'value'")
+		}
+		expected := params["value"]
+		if !caseSensitive {
+			expected = strings.ToLower(expected)
+		}
+		contains := mode == "contains"
+		compare = func(v propertyValue) bool {
+			value := v.Value
+			if !caseSensitive {
+				value = strings.ToLower(value)
+			}
+			if contains {
+				return strings.Contains(value, expected)
+			}
+			return value == expected
+		}
+	case "regex":
+		if params["value"] == "" {
+			return indices, fmt.Errorf("missing mandatory Parameter 'value'")
+		}
+		regex, err := regexp.Compile(params["value"])
+		if err != nil {
+			return indices, fmt.Errorf("invalid regex: %s", err.Error())
+		}
+		compare = func(v propertyValue) bool { return regex.MatchString(v.Value) }
+	case "less", "greater":
+		if params["value"] == "" {
+			return indices, fmt.Errorf("missing mandatory Parameter 'value'")
+		}
+		var err error
+		compare, err = orderComparison(params["value"], mode == "less")
+		if err != nil {
+			return indices, err
+		}
+	default:
+		return indices, fmt.Errorf("invalid mode: %s", mode)
+	}
+
+	for i, component := range cal.Components { // iterate over events
+		switch component.(type) {
+		case *ics.VEvent:
+			event := component.(*ics.VEvent)
+			values := getPropertyValues(event, params["property"], params["parameter"])
+			if len(values) == 0 {
+				continue
+			}
+			matched := match == "all"
+			for _, value := range values {
+				if compare(value) != matched {
+					matched = !matched
+					break
+				}
+			}
+			if matched {
+				indices = append(indices, i)
+				log.Debug("Filtered event with id " + event.Id() + "\n")
+			}
+		default:
+			// print type of component
+			log.Debug("Unknown component type ignored: " + reflect.TypeOf(cal.Components[i]).String() + "\n")
+		}
+	}
+	log.Trace("Property Filter indices: " + fmt.Sprint(indices) + "\n")
+	return indices, nil
+}
+
+// orderComparison returns a function checking whether a property value is less (or greater) than the given value.
+// Values are compared numerically, if both are numbers, everything else is compared as date or time. This way a DATE
+// like "20240115" is compared with both numbers and date times.
+func orderComparison(value string, less bool) (func(propertyValue) bool, error) {
+	number, numberErr := strconv.ParseFloat(value, 64)
+	reference, dateErr := ParseDate(value, time.Now())
+	if dateErr != nil {
+		reference, _, dateErr = parseICalTime(value, time.UTC)
+	}
+	if numberErr != nil && dateErr != nil {
+		return nil, fmt.Errorf("invalid value '%s': neither a number nor a date", value)
+	}
+
+	return func(v propertyValue) bool {
+		if numberErr == nil {
+			if n, err := strconv.ParseFloat(strings.TrimSpace(v.Value), 64); err == nil {
+				if less {
+					return n < number
+				}
+				return n > number
+			}
+		}
+		if dateErr != nil {
+			log.Debug("Property value '" + v.Value + "' is not a number\n")
+			return false
+		}
+		loc := time.Local
+		if v.Tzid != "" {
+			var err error
+			if loc, err = time.LoadLocation(v.Tzid); err != nil {
+				log.Debug("Unknown timezone '" + v.Tzid + "'\n")
+				return false
+			}
+		}
+		t, _, err := parseICalTime(v.Value, loc)
+		if err != nil {
+			log.Debug("Property value '" + v.Value + "' is not a date\n")
+			return false
+		}
+		if less {
+			return t.Before(reference)
+		}
+		return t.After(reference)
+	}, nil
+}
+
+// Filters events by the weekday and time of day they take place.
+// Parameters: "weekdays" comma separated list of weekdays and ranges, e.g. "mo-fr" or "sa,su". Default all days.
+// "from", "to": time of day as "15:04", default the whole day. If "to" is not after "from", the range spans midnight
+// and belongs to the weekday it starts on.
+// "timezone": the weekdays and times are evaluated in this timezone, e.g. "Europe/Berlin". Default is the server timezone.
+// "match": "start" (default) the event starts in the range, "overlap" any part of the event is in the range,
+// "inside" the whole event is in the range.
+// All-day events last their whole days in the timezone. Repeating events are filtered, if any of their occurrences
+// up to one year after now or their start matches. Overridden occurrences (RECURRENCE-ID) are judged by their own component.
+func FilterWeekday(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	var indices []int
+
+	selection, err := parseWeekdaySelection(params)
+	if err != nil {
+		return indices, err
+	}
+	match := params["match"]
+	if match == "" {
+		match = "start"
+	}
+	if match != "start" && match != "overlap" && match != "inside" {
+		return indices, fmt.Errorf("invalid match: %s", match)
+	}
+
+	now := time.Now()
+	for i, component := range cal.Components { // iterate over events
+		switch component.(type) {
+		case *ics.VEvent:
+			event := component.(*ics.VEvent)
+			// repeating events are checked up to one year after now, or after their start if that is later
+			horizon := now
+			if first, err := event.GetStartAt(); err == nil && first.After(horizon) {
+				horizon = first
+			}
+			horizon = horizon.AddDate(1, 0, 0)
+			matched := false
+			err := IterateOccurrences(cal, event, func(o Occurrence) bool {
+				if o.RecurrenceId.After(horizon) {
+					return false
+				}
+				if o.Override != nil {
+					return true
+				}
+				start, end := o.Start, o.End
+				if o.AllDay {
+					// all-day events last from midnight to midnight in the timezone of the filter
+					days := int((end.Sub(start) + 12*time.Hour) / (24 * time.Hour))
+					start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, selection.location)
+					end = start.AddDate(0, 0, days)
+				}
+				matched = selection.matches(start.In(selection.location), end.In(selection.location), match)
+				return !matched
+			})
+			if err != nil {
+				log.Debug(err.Error() + "\n")
+				continue
+			}
+			if matched {
+				indices = append(indices, i)
+				log.Debug("Filtered event with id " + event.Id() + "\n")
+			}
+		default:
+			// print type of component
+			log.Debug("Unknown component type ignored: " + reflect.TypeOf(cal.Components[i]).String() + "\n")
+		}
+	}
+	log.Trace("Weekday Filter indices: " + fmt.Sprint(indices) + "\n")
+	return indices, nil
+}
+
+// weekdaySelection is a set of weekdays with a time range on each of these days.
+type weekdaySelection struct {
+	days     map[time.Weekday]bool
+	from     time.Duration // time of day
+	to       time.Duration // time of day, spanning midnight if not after from
+	location *time.Location
+}
+
+func parseWeekdaySelection(params map[string]string) (weekdaySelection, error) {
+	selection := weekdaySelection{days: make(map[time.Weekday]bool), to: 24 * time.Hour, location: time.Local}
+	var err error
+
+	if params["weekdays"] == "" {
+		for _, day := range weekdays {
+			selection.days[day] = true
+		}
+	}
+	for _, item := range strings.Split(params["weekdays"], ",") {
+		item = strings.ToUpper(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+		firstDay, ok := weekdays[strings.TrimSpace(first)]
+		lastDay, ok2 := weekdays[strings.TrimSpace(last)]
+		if !ok || !ok2 {
+			return selection, fmt.Errorf("invalid weekday '%s', use mo, tu, we, th, fr, sa, su", item)
+		}
+		// ranges can wrap around the end of the week, e.g. fr-mo
+		for day := firstDay; ; day = (day + 1) % 7 {
+			selection.days[day] = true
+			if day == lastDay {
+				break
+			}
+		}
+	}
+
+	if params["from"] != "" {
+		if selection.from, err = parseTimeOfDay(params["from"]); err != nil {
+			return selection, err
+		}
+	}
+	if params["to"] != "" {
+		if selection.to, err = parseTimeOfDay(params["to"]); err != nil {
+			return selection, err
+		}
+	}
+	if params["timezone"] != "" {
+		if selection.location, err = time.LoadLocation(params["timezone"]); err != nil {
+			return selection, fmt.Errorf("invalid timezone: %s", err.Error())
+		}
+	}
+	return selection, nil
+}
+
+// parseTimeOfDay parses "15:04" as duration since midnight. "24:00" is allowed as end of the day.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day '%s', use the format 15:04", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// intervals returns the time ranges of the selection in chronological order, that may overlap with from to to.
+// Adjacent ranges are merged, so an event lasting over multiple selected days is inside a single range.
+func (selection weekdaySelection) intervals(from time.Time, to time.Time) [][2]time.Time {
+	var intervals [][2]time.Time
+	// start one day earlier for ranges spanning midnight
+	day := time.Date(from.Year(), from.Month(), from.Day()-1, 0, 0, 0, 0, selection.location)
+	for !day.After(to) {
+		if selection.days[day.Weekday()] {
+			start := dayTime(day, selection.from)
+			end := dayTime(day, selection.to)
+			if !end.After(start) {
+				end = dayTime(day.AddDate(0, 0, 1), selection.to)
+			}
+			if len(intervals) > 0 && !start.After(intervals[len(intervals)-1][1]) {
+				intervals[len(intervals)-1][1] = end
+			} else {
+				intervals = append(intervals, [2]time.Time{start, end})
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return intervals
+}
+
+// dayTime returns the wall clock time of day on the given day, so DST changes don't shift it.
+func dayTime(day time.Time, timeOfDay time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, int(timeOfDay/time.Minute), 0, 0, day.Location())
+}
+
+// matches checks the event from start to end against the selection, with the match mode start, overlap or inside.
+func (selection weekdaySelection) matches(start time.Time, end time.Time, match string) bool {
+	if end.Before(start) {
+		end = start
+	}
+	for _, interval := range selection.intervals(start, end) {
+		switch {
+		case match == "inside" || (match == "overlap" && !end.After(start)):
+			if !start.Before(interval[0]) && !end.After(interval[1]) && start.Before(interval[1]) {
+				return true
+			}
+		case match == "overlap":
+			if interval[0].Before(end) && start.Before(interval[1]) {
+				return true
+			}
+		default:
+			if !start.Before(interval[0]) && start.Before(interval[1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LoadSource loads the calendar of a source URL like "profile://name", used by filters comparing with other calendars.
+// It is set by the application, as the modules can't resolve profiles themselves.
+var LoadSource func(source string) (*ics.Calendar, error)
+
+// FilterSources returns the sources loaded by the filter with LoadSource, including those of its "with-" filter.
+func FilterSources(params map[string]string) []string {
+	var sources []string
+	if params["type"] == "overlap" {
+		if params["source"] != "" {
+			sources = append(sources, params["source"])
+		}
+		sources = append(sources, FilterSources(overlapSubfilter(params))...)
+	}
+	return sources
+}
+
+// Filters events overlapping other events.
+// Parameters: "source" optional, compare with the events of this calendar, e.g. "profile://labs". Default the same calendar.
+// "with-type" and further parameters prefixed with "with-" form a filter selecting the events to compare with,
+// e.g. "with-type": "regex", "with-regex": "Lab". Default all events.
+// "min-overlap" optional duration, events have to overlap at least this long. Default any overlap.
+// Repeating events are compared occurrence by occurrence and filtered if any occurrence overlaps.
+func FilterOverlap(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	var indices []int
+
+	var minOverlap time.Duration
+	var err error
+	if params["min-overlap"] != "" {
+		minOverlap, err = time.ParseDuration(params["min-overlap"])
+		if err != nil {
+			return indices, fmt.Errorf("invalid min-overlap: %s", err.Error())
+		}
+	}
+
+	other := cal
+	sameCalendar := true
+	if params["source"] != "" {
+		if LoadSource == nil {
+			return indices, fmt.Errorf("loading sources is not supported")
+		}
+		other, err = LoadSource(params["source"])
+		if err != nil {
+			return indices, fmt.Errorf("could not load source %s: %s", params["source"], err.Error())
+		}
+		sameCalendar = false
+	}
+
+	// select the events to compare with
+	var otherIndices []int
+	subfilter := overlapSubfilter(params)
+	if subfilter["type"] == "" {
+		otherIndices, err = FilterAll(other, map[string]string{})
+	} else {
+		otherIndices, err = RunFilter(context.Background(), other, subfilter)
+	}
+	if err != nil {
+		return indices, err
+	}
+
+	// repeating events are expanded up to one year from now, or the end of the last single event
+	horizon := time.Now().AddDate(1, 0, 0)
+	for _, event := range append(cal.Events(), other.Events()...) {
+		if end, err := event.GetEndAt(); err == nil && !IsRecurring(event) && end.After(horizon) {
+			horizon = end
+		}
+	}
+
+	var otherIntervals []overlapInterval
+	for _, i := range otherIndices {
+		intervals, err := occurrenceIntervals(other, i, horizon)
+		if err != nil {
+			log.Warn("Ignoring event in overlap filter: " + err.Error())
+			continue
+		}
+		otherIntervals = append(otherIntervals, intervals...)
+	}
+
+	for i, component := range cal.Components { // iterate over events
+		switch component.(type) {
+		case *ics.VEvent:
+			event := component.(*ics.VEvent)
+			intervals, err := occurrenceIntervals(cal, i, horizon)
+			if err != nil {
+				log.Warn("Ignoring event in overlap filter: " + err.Error())
+				continue
+			}
+			if overlapsAny(intervals, otherIntervals, sameCalendar, minOverlap) {
+				indices = append(indices, i)
+				log.Debug("Filtered event with id " + event.Id() + "\n")
+			}
+		default:
+			// print type of component
+			log.Debug("Unknown component type ignored: " + reflect.TypeOf(cal.Components[i]).String() + "\n")
+		}
+	}
+	log.Trace("Overlap Filter indices: " + fmt.Sprint(indices) + "\n")
+	return indices, nil
+}
+
+// overlapSubfilter returns the parameters prefixed with "with-", without the prefix.
+func overlapSubfilter(params map[string]string) map[string]string {
+	subfilter := make(map[string]string)
+	for name, value := range params {
+		if strings.HasPrefix(name, "with-") {
+			subfilter[strings.TrimPrefix(name, "with-")] = value
+		}
+	}
+	return subfilter
+}
+
+// overlapInterval is the time of an occurrence of the component at index.
+type overlapInterval struct {
+	index int
+	start time.Time
+	end   time.Time
+}
+
+// occurrenceIntervals returns the times of all occurrences of the event at index, that are not overridden by another component.
+func occurrenceIntervals(cal *ics.Calendar, index int, horizon time.Time) ([]overlapInterval, error) {
+	var intervals []overlapInterval
+	event := cal.Components[index].(*ics.VEvent)
+	err := IterateOccurrences(cal, event, func(o Occurrence) bool {
+		if o.RecurrenceId.After(horizon) {
+			return false
+		}
+		// overriding components are compared on their own
+		if o.Override == nil {
+			intervals = append(intervals, overlapInterval{index, o.Start, o.End})
+		}
+		return true
+	})
+	return intervals, err
+}
+
+// overlaps checks whether the intervals intersect. Events without duration overlap the events they take place in.
+func (a overlapInterval) overlaps(b overlapInterval) bool {
+	if a.start.Equal(a.end) {
+		return !a.start.Before(b.start) && a.start.Before(b.end)
+	}
+	if b.start.Equal(b.end) {
+		return !b.start.Before(a.start) && b.start.Before(a.end)
+	}
+	return a.start.Before(b.end) && b.start.Before(a.end)
+}
+
+// overlapsAny checks whether any of the intervals overlaps any of the other intervals by at least minOverlap.
+// In the same calendar, occurrences of the same component are not compared with each other.
+func overlapsAny(intervals []overlapInterval, others []overlapInterval, sameCalendar bool, minOverlap time.Duration) bool {
+	for _, a := range intervals {
+		for _, b := range others {
+			if sameCalendar && a.index == b.index {
+				continue
+			}
+			if !a.overlaps(b) {
+				continue
+			}
+			start, end := a.start, a.end
+			if b.start.After(start) {
+				start = b.start
+			}
+			if b.end.Before(end) {
+				end = b.end
+			}
+			if end.Sub(start) >= minOverlap {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Filters events by the source they came from.
+// Params: 'source' the source as listed in the profile, e.g. "https://example.com/exams.ics", or "base64" for added entries,
+// or the label of the source.
+// 'regex' instead matches a regex against the source.
+// Events created by rules have no source and are never filtered.
+func FilterSource(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	var indices []int
+	if params["source"] == "" && params["regex"] == "" {
+		return indices, fmt.Errorf("missing mandatory Parameter 'source' or 'regex'")
+	}
+	var regex *regexp.Regexp
+	if params["regex"] != "" {
+		var err error
+		regex, err = regexp.Compile(params["regex"])
+		if err != nil {
+			return indices, fmt.Errorf("invalid regex: %s", err.Error())
+		}
+	}
+
+	for i, component := range cal.Components {
+		event, ok := component.(*ics.VEvent)
+		if !ok {
+			continue
+		}
+		source := eventSource(event)
+		if source == "" {
+			continue
+		}
+		label := eventSourceLabel(event)
+		if regex == nil && (source == SourceName(params["source"]) || (label != "" && label == params["source"])) ||
+			regex != nil && (regex.MatchString(source) || (label != "" && regex.MatchString(label))) {
+			indices = append(indices, i)
+			log.Debug("Filter event with id " + event.Id() + " from source " + source)
+		}
+	}
+	return indices, nil
+}
+
+// Filters events, for which the expression is true, e.g. 'duration > 2h && summary =~ "Exam"'.
+// Params: 'expression', see CompileExpression and the documentation for fields and functions.
+func FilterExpr(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	var indices []int
+	expression, err := CompileExpression(params["expression"])
+	if err != nil {
+		return indices, fmt.Errorf("invalid expression: %s", err.Error())
+	}
+	now := time.Now()
+	for i, component := range cal.Components {
+		event, ok := component.(*ics.VEvent)
+		if !ok {
+			continue
+		}
+		matched, err := expression.Matches(event, now)
+		if err != nil {
+			return nil, fmt.Errorf("error evaluating expression for event %s: %s", event.Id(), err.Error())
+		}
+		if matched {
+			indices = append(indices, i)
+			log.Debug("Filter event with id " + event.Id())
+		}
+	}
+	return indices, nil
+}
+
+// Filters events by their STATUS.
+// Params: 'status' comma separated list of tentative, confirmed, cancelled or none for events without status.
+func FilterStatus(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	return filterValues(cal, params, "status", statusValues, eventStatus)
+}
+
+// Filters events by their CLASS. Events without class are public.
+// Params: 'class' comma separated list of public, private or confidential.
+func FilterClass(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	return filterValues(cal, params, "class", classValues, eventClass)
+}
+
+// Filters events by their TRANSP or the Microsoft busy status (X-MICROSOFT-CDO-BUSYSTATUS).
+// Either property is derived from the other, if an event only has one of them.
+// Params: 'transp' comma separated list of opaque or transparent,
+// or 'busy-status' comma separated list of free, tentative, busy, oof or workingelsewhere.
+func FilterTransp(cal *ics.Calendar, params map[string]string) ([]int, error) {
+	if params["busy-status"] != "" {
+		return filterValues(cal, params, "busy-status", busyStatusValues, eventBusyStatus)
+	}
+	return filterValues(cal, params, "transp", transpValues, eventTransp)
+}
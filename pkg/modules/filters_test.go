@@ -0,0 +1,235 @@
+package modules
+
+import (
+	"fmt"
+	"testing"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+func TestFilterProperty(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:first
+DTSTART:20240101T100000Z
+CATEGORIES:Work,Meeting
+ATTENDEE;PARTSTAT=ACCEPTED:mailto:a@example.com
+ATTENDEE;PARTSTAT=DECLINED:mailto:b@example.com
+X-MICROSOFT-CDO-BUSYSTATUS:OOF
+PRIORITY:1`, `UID:second
+DTSTART:20240201T100000Z
+CATEGORIES:Private
+ATTENDEE;PARTSTAT=ACCEPTED:mailto:a@example.com
+PRIORITY:5`)
+
+	tests := []struct {
+		params   map[string]string
+		expected []int
+	}{
+		{map[string]string{"property": "x-microsoft-cdo-busystatus"}, []int{0}},
+		{map[string]string{"property": "categories", "mode": "equals", "value": "meeting"}, []int{0}},
+		{map[string]string{"property": "categories", "mode": "equals", "value": "meeting", "case-sensitive": "true"}, nil},
+		{map[string]string{"property": "attendee", "parameter": "partstat", "mode": "equals", "value": "DECLINED"}, []int{0}},
+		{map[string]string{"property": "attendee", "parameter": "partstat", "mode": "equals", "value": "ACCEPTED", "match": "all"}, []int{1}},
+		{map[string]string{"property": "attendee", "mode": "regex", "value": "^mailto:b@"}, []int{0}},
+		{map[string]string{"property": "priority", "mode": "greater", "value": "2"}, []int{1}},
+		{map[string]string{"property": "dtstart", "mode": "less", "value": "2024-01-15T00:00:00Z"}, []int{0}},
+		{map[string]string{"property": "dtstart", "mode": "less", "value": "20240115"}, []int{0}},
+		{map[string]string{"property": "dtstart", "mode": "greater", "value": "20240115"}, []int{1}},
+	}
+	for _, test := range tests {
+		indices, err := FilterProperty(cal, test.params)
+		if err != nil {
+			t.Fatalf("Error filtering with %v: %s", test.params, err)
+		}
+		if fmt.Sprint(indices) != fmt.Sprint(test.expected) {
+			t.Errorf("Filter %v: got %v -- should be %v", test.params, indices, test.expected)
+		}
+	}
+
+	_, err := FilterProperty(cal, map[string]string{"property": "categories", "mode": "equals", "value": "work", "case-sensitive": "yes"})
+	if err == nil {
+		t.Errorf("invalid case-sensitive should fail")
+	}
+
+	params := map[string]string{"property": "categories"}
+	FilterProperty(cal, params)
+	if len(params) != 1 {
+		t.Errorf("got params %v -- the defaults shouldn't be written into the rule", params)
+	}
+}
+
+func TestFilterWeekday(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:monday-morning
+DTSTART;TZID=Europe/Berlin:20240506T090000
+DTEND;TZID=Europe/Berlin:20240506T100000`, `UID:saturday
+DTSTART:20240511T120000Z
+DTEND:20240511T130000Z`, `UID:friday-night
+DTSTART;TZID=Europe/Berlin:20240510T230000
+DTEND;TZID=Europe/Berlin:20240511T010000`, `UID:sunday-all-day
+DTSTART;VALUE=DATE:20240512
+DTEND;VALUE=DATE:20240513`, `UID:week-all-day
+DTSTART;VALUE=DATE:20240506
+DTEND;VALUE=DATE:20240509`, `UID:series
+DTSTART;TZID=Europe/Berlin:20240506T090000
+DTEND;TZID=Europe/Berlin:20240506T100000
+RRULE:FREQ=WEEKLY;BYDAY=MO,SA;COUNT=4`)
+
+	tests := []struct {
+		params   map[string]string
+		expected []int
+	}{
+		{map[string]string{"weekdays": "sa,su", "timezone": "Europe/Berlin"}, []int{1, 3, 5}},
+		{map[string]string{"weekdays": "su", "timezone": "Europe/Berlin"}, []int{3}},
+		{map[string]string{"weekdays": "sa-su", "timezone": "Europe/Berlin", "match": "overlap"}, []int{1, 2, 3, 5}},
+		{map[string]string{"weekdays": "mo-fr", "timezone": "Europe/Berlin", "match": "inside"}, []int{0, 4, 5}},
+		{map[string]string{"from": "08:00", "to": "18:00", "timezone": "Europe/Berlin", "match": "inside"}, []int{0, 1, 5}},
+		{map[string]string{"weekdays": "fr", "from": "22:00", "to": "02:00", "timezone": "Europe/Berlin", "match": "inside"}, []int{2}},
+		{map[string]string{"weekdays": "sa", "from": "12:00", "to": "15:00", "timezone": "UTC"}, []int{1}},
+	}
+	for _, test := range tests {
+		indices, err := FilterWeekday(cal, test.params)
+		if err != nil {
+			t.Fatalf("Error filtering with %v: %s", test.params, err)
+		}
+		if fmt.Sprint(indices) != fmt.Sprint(test.expected) {
+			t.Errorf("Filter %v: got %v -- should be %v", test.params, indices, test.expected)
+		}
+	}
+}
+
+func TestFilterOverlap(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:lecture
+SUMMARY:Optional Lecture
+DTSTART:20240506T090000Z
+DTEND:20240506T103000Z`, `UID:lab
+SUMMARY:Lab
+DTSTART:20240506T100000Z
+DTEND:20240506T120000Z`, `UID:weekly-lab
+SUMMARY:Lab
+DTSTART:20240507T140000Z
+DTEND:20240507T160000Z
+RRULE:FREQ=WEEKLY;COUNT=4`, `UID:late-lecture
+SUMMARY:Optional Lecture
+DTSTART:20240521T150000Z
+DTEND:20240521T170000Z`)
+
+	tests := []struct {
+		params   map[string]string
+		expected []int
+	}{
+		{map[string]string{}, []int{0, 1, 2, 3}},
+		{map[string]string{"with-type": "regex", "with-regex": "Lab"}, []int{0, 3}},
+		{map[string]string{"with-type": "regex", "with-regex": "Lab", "min-overlap": "1h"}, []int{3}},
+	}
+	for _, test := range tests {
+		indices, err := FilterOverlap(cal, test.params)
+		if err != nil {
+			t.Fatalf("Error filtering with %v: %s", test.params, err)
+		}
+		if fmt.Sprint(indices) != fmt.Sprint(test.expected) {
+			t.Errorf("Filter %v: got %v -- should be %v", test.params, indices, test.expected)
+		}
+	}
+}
+
+func TestFilterDuplicates(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:first
+SUMMARY:Lecture
+DTSTART:20240506T090000Z
+DTEND:20240506T103000Z`, `UID:copy
+SUMMARY:  lecture
+DTSTART:20240506T090500Z
+DTEND:20240506T103000Z`, `UID:no-summary
+DTSTART:20240506T090000Z
+DTEND:20240506T103000Z`, `UID:exact
+SUMMARY:Lecture
+DTSTART:20240506T090000Z
+DTEND:20240506T103000Z`)
+
+	tests := []struct {
+		params   map[string]string
+		expected []int
+	}{
+		{map[string]string{}, []int{3}},
+		{map[string]string{"tolerance": "10m", "normalize": "true"}, []int{1, 3}},
+		{map[string]string{"keys": "start,end"}, []int{2, 3}},
+	}
+	for _, test := range tests {
+		indices, err := FilterDuplicates(cal, test.params)
+		if err != nil {
+			t.Fatalf("Error filtering with %v: %s", test.params, err)
+		}
+		if fmt.Sprint(indices) != fmt.Sprint(test.expected) {
+			t.Errorf("Filter %v: got %v -- should be %v", test.params, indices, test.expected)
+		}
+	}
+}
+
+func TestFilterSource(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:exam
+SUMMARY:Exam
+X-ICAL-RELAY-SOURCE:https://exams.example.com/exams.ics`, `UID:lecture
+SUMMARY:Lecture
+X-ICAL-RELAY-SOURCE:https://example.com/lectures.ics`, `UID:created
+SUMMARY:Created by a rule`)
+
+	tests := []struct {
+		params   map[string]string
+		expected []int
+	}{
+		{map[string]string{"source": "https://exams.example.com/exams.ics"}, []int{0}},
+		{map[string]string{"regex": "example\\.com"}, []int{0, 1}},
+		{map[string]string{"regex": ".*"}, []int{0, 1}},
+	}
+	for _, test := range tests {
+		indices, err := FilterSource(cal, test.params)
+		if err != nil {
+			t.Fatalf("Error filtering with %v: %s", test.params, err)
+		}
+		if fmt.Sprint(indices) != fmt.Sprint(test.expected) {
+			t.Errorf("Filter %v: got %v -- should be %v", test.params, indices, test.expected)
+		}
+	}
+
+	StripSources(cal)
+	if indices, _ := FilterSource(cal, map[string]string{"regex": ".*"}); len(indices) != 0 {
+		t.Errorf("got %v after stripping the sources -- should be empty", indices)
+	}
+}
+
+func TestFilterStatusClassTransp(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:cancelled
+STATUS:CANCELLED
+CLASS:PRIVATE
+TRANSP:TRANSPARENT`, `UID:confirmed
+STATUS:confirmed
+CLASS:X-UNKNOWN
+X-MICROSOFT-CDO-BUSYSTATUS:OOF`, `UID:plain`, `UID:outlook-free
+X-MICROSOFT-CDO-BUSYSTATUS:FREE`)
+
+	tests := []struct {
+		filter   func(*ics.Calendar, map[string]string) ([]int, error)
+		params   map[string]string
+		expected []int
+	}{
+		{FilterStatus, map[string]string{"status": "cancelled"}, []int{0}},
+		{FilterStatus, map[string]string{"status": "Confirmed, none"}, []int{1, 2, 3}},
+		{FilterClass, map[string]string{"class": "private"}, []int{0, 1}},
+		{FilterClass, map[string]string{"class": "public"}, []int{2, 3}},
+		{FilterTransp, map[string]string{"transp": "transparent"}, []int{0, 3}},
+		{FilterTransp, map[string]string{"busy-status": "free"}, []int{0, 3}},
+		{FilterTransp, map[string]string{"busy-status": "busy,oof"}, []int{1, 2}},
+	}
+	for _, test := range tests {
+		indices, err := test.filter(cal, test.params)
+		if err != nil {
+			t.Fatalf("Error filtering with %v: %s", test.params, err)
+		}
+		if fmt.Sprint(indices) != fmt.Sprint(test.expected) {
+			t.Errorf("Filter %v: got %v -- should be %v", test.params, indices, test.expected)
+		}
+	}
+
+	if _, err := FilterStatus(cal, map[string]string{"status": "canceled"}); err == nil {
+		t.Error("unknown status should be an error")
+	}
+}
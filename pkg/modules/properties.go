@@ -0,0 +1,255 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+
+	"github.com/jm-lemmi/ical-relay/helpers"
+)
+
+// properties, whose value is a comma separated list of text values
+var listProperties = []string{"CATEGORIES", "RESOURCES"}
+
+// properties of events with a text value, that can be edited freely, in addition to X- properties
+var textProperties = []string{"SUMMARY", "DESCRIPTION", "LOCATION", "COMMENT", "CONTACT", "CATEGORIES", "RESOURCES"}
+
+// propertyValue is a single value of a (possibly multi-valued) property.
+type propertyValue struct {
+	Value string
+	Tzid  string // TZID parameter of the property, if any
+}
+
+// getPropertyValues returns the values of all properties with the given name (case-insensitive).
+// Comma separated lists like CATEGORIES are split up and text values are unescaped.
+// If parameter is given, the values of this property parameter are returned instead.
+func getPropertyValues(event *ics.VEvent, property string, parameter string) []propertyValue {
+	property = strings.ToUpper(property)
+	parameter = strings.ToUpper(parameter)
+	var values []propertyValue
+	for _, prop := range event.Properties {
+		if strings.ToUpper(prop.IANAToken) != property {
+			continue
+		}
+		var tzid string
+		if tz, ok := prop.ICalParameters["TZID"]; ok && len(tz) > 0 {
+			tzid = tz[0]
+		}
+		if parameter != "" {
+			for key, paramValues := range prop.ICalParameters {
+				if strings.ToUpper(key) == parameter {
+					for _, v := range paramValues {
+						values = append(values, propertyValue{Value: v, Tzid: tzid})
+					}
+				}
+			}
+			continue
+		}
+		if isListProperty(property) {
+			for _, v := range splitList(prop.Value) {
+				values = append(values, propertyValue{Value: unescapeText(v), Tzid: tzid})
+			}
+		} else {
+			values = append(values, propertyValue{Value: unescapeText(prop.Value), Tzid: tzid})
+		}
+	}
+	return values
+}
+
+func isListProperty(property string) bool {
+	for _, p := range listProperties {
+		if p == strings.ToUpper(property) {
+			return true
+		}
+	}
+	return false
+}
+
+// properties of events, that can be set and removed by the property action, in addition to X- properties.
+// Properties defining the identity and time of events are left out, as changing them breaks other modules.
+var editableProperties = append([]string{
+	"CLASS", "TRANSP", "STATUS", "PRIORITY", "URL", "COLOR", "GEO", "ATTACH", "ATTENDEE", "ORGANIZER",
+}, textProperties...)
+
+// checkEditableProperty checks that the property action can edit the property.
+func checkEditableProperty(property string) error {
+	property = strings.ToUpper(property)
+	if property == SourceProperty || property == SourceLabelProperty {
+		return fmt.Errorf("property %s is reserved", property)
+	}
+	if strings.HasPrefix(property, "X-") && len(property) > 2 {
+		return nil
+	}
+	for _, p := range editableProperties {
+		if p == property {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid property '%s', use an X- property or one of %s", property, strings.Join(editableProperties, ", "))
+}
+
+// checkPropertyValue checks the value of properties with a fixed set of values.
+func checkPropertyValue(property string, value string) error {
+	var valid []string
+	switch strings.ToUpper(property) {
+	case "STATUS":
+		valid = []string{"tentative", "confirmed", "cancelled"}
+	case "CLASS":
+		valid = classValues
+	case "TRANSP":
+		valid = transpValues
+	case "PRIORITY":
+		if priority, err := strconv.Atoi(value); err != nil || priority < 0 || priority > 9 {
+			return fmt.Errorf("invalid priority '%s', use 0 to 9", value)
+		}
+		return nil
+	default:
+		return nil
+	}
+	_, err := parseValueList(strings.ToLower(property), value, valid)
+	if err == nil && strings.Contains(value, ",") {
+		err = fmt.Errorf("%s takes a single value", strings.ToLower(property))
+	}
+	return err
+}
+
+// properties, that may occur only once in an event
+var singleProperties = []string{"CLASS", "TRANSP", "STATUS", "PRIORITY", "URL", "COLOR", "GEO", "ORGANIZER", "SUMMARY", "DESCRIPTION", "LOCATION"}
+
+var iCalendarName = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// checkPropertyAction checks the parameters of the property action.
+func checkPropertyAction(params map[string]string) error {
+	property := strings.ToUpper(params["property"])
+	if property == "" {
+		return fmt.Errorf("missing mandatory Parameter 'property'")
+	}
+	if err := checkEditableProperty(property); err != nil {
+		return err
+	}
+	mode := params["mode"]
+	if mode == "" {
+		mode = "set"
+	}
+	switch mode {
+	case "set", "append":
+		if params["value"] == "" {
+			return fmt.Errorf("mode %s requires the parameter 'value'", mode)
+		}
+		if mode == "append" && helpers.Contains(singleProperties, property) {
+			return fmt.Errorf("%s may occur only once, use mode set", property)
+		}
+		return checkPropertyValue(property, params["value"])
+	case "remove":
+		return nil
+	case "set-parameter", "remove-parameter":
+		if !iCalendarName.MatchString(params["parameter"]) {
+			return fmt.Errorf("mode %s requires a valid parameter name in 'parameter'", mode)
+		}
+		if mode == "set-parameter" && params["value"] == "" {
+			return fmt.Errorf("mode %s requires the parameter 'value'", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid mode '%s', use set, append, remove, set-parameter or remove-parameter", mode)
+	}
+}
+
+// encodePropertyValue encodes the value for the property: text values are escaped,
+// list values are split at commas and values of properties with a fixed set of values are uppercased.
+func encodePropertyValue(property string, value string) string {
+	property = strings.ToUpper(property)
+	switch {
+	case isListProperty(property):
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, escapeText(v))
+			}
+		}
+		return strings.Join(values, ",")
+	case isTextProperty(property):
+		return escapeText(value)
+	case property == "STATUS" || property == "CLASS" || property == "TRANSP":
+		return strings.ToUpper(strings.TrimSpace(value))
+	default:
+		return value
+	}
+}
+
+// isTextProperty checks whether the property has a text value, that can be edited by rules.
+// X- properties are text properties, except the internal source properties.
+func isTextProperty(property string) bool {
+	property = strings.ToUpper(property)
+	if property == SourceProperty || property == SourceLabelProperty {
+		return false
+	}
+	if strings.HasPrefix(property, "X-") {
+		return true
+	}
+	for _, p := range textProperties {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a raw property value at all commas, that are not escaped.
+func splitList(raw string) []string {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, c := range raw {
+		switch {
+		case escaped:
+			current.WriteRune('\\')
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ',':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if escaped {
+		current.WriteRune('\\')
+	}
+	return append(parts, current.String())
+}
+
+// unescapeText reverts the TEXT escaping of RFC 5545 section 3.3.11.
+func unescapeText(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range s {
+		if escaped {
+			switch c {
+			case 'n', 'N':
+				b.WriteRune('\n')
+			default:
+				b.WriteRune(c)
+			}
+			escaped = false
+		} else if c == '\\' {
+			escaped = true
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// escapeText applies the TEXT escaping of RFC 5545 section 3.3.11.
+func escapeText(s string) string {
+	return strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n").Replace(s)
+}
@@ -0,0 +1,1123 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jm-lemmi/ical-relay/helpers"
+)
+
+// Safety net for rules that never produce an occurrence (e.g. the 30th of February)
+// or that are effectively infinite. Iteration stops after this many periods.
+const maxRecurrencePeriods = 100000
+
+const (
+	icalDateFormat         = "20060102"
+	icalTimestampFormat    = "20060102T150405"
+	icalTimestampFormatUtc = "20060102T150405Z"
+)
+
+// RecurrenceRule is a parsed RRULE (or EXRULE) as defined in RFC 5545 section 3.3.10.
+type RecurrenceRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      string // raw value, resolved against the location of DTSTART
+	BySecond   []int
+	ByMinute   []int
+	ByHour     []int
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByYearDay  []int
+	ByWeekNo   []int
+	ByMonth    []int
+	BySetPos   []int
+	Wkst       time.Weekday
+}
+
+// WeekdayNum is a BYDAY entry like "MO", "2TU" or "-1FR". N is 0 if no ordinal was given.
+type WeekdayNum struct {
+	N   int
+	Day time.Weekday
+}
+
+// Occurrence is a single instance of a (possibly recurring) event.
+type Occurrence struct {
+	Start        time.Time
+	End          time.Time
+	RecurrenceId time.Time   // start of the instance as generated by the recurrence set
+	AllDay       bool        // DTSTART is a DATE value
+	Override     *ics.VEvent // component overriding this instance via RECURRENCE-ID, if any
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+var frequencies = []string{"SECONDLY", "MINUTELY", "HOURLY", "DAILY", "WEEKLY", "MONTHLY", "YEARLY"}
+
+// ParseRecurrenceRule parses the value of an RRULE or EXRULE property.
+func ParseRecurrenceRule(value string) (*RecurrenceRule, error) {
+	rule := &RecurrenceRule{Interval: 1, Wkst: time.Monday}
+	for _, part := range strings.Split(strings.TrimSpace(value), ";") {
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule part '%s'", part)
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(val)
+			if !helpers.StringInSlice(rule.Freq, frequencies) {
+				return nil, fmt.Errorf("invalid FREQ '%s'", val)
+			}
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(val)
+			if err == nil && rule.Interval < 1 {
+				err = fmt.Errorf("INTERVAL must be positive")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(val)
+			if err == nil && rule.Count < 1 {
+				err = fmt.Errorf("COUNT must be positive")
+			}
+		case "UNTIL":
+			rule.Until = val
+		case "BYSECOND":
+			rule.BySecond, err = parseIntList(val, 0, 60, false)
+		case "BYMINUTE":
+			rule.ByMinute, err = parseIntList(val, 0, 59, false)
+		case "BYHOUR":
+			rule.ByHour, err = parseIntList(val, 0, 23, false)
+		case "BYDAY":
+			rule.ByDay, err = parseWeekdayList(val)
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseIntList(val, 1, 31, true)
+		case "BYYEARDAY":
+			rule.ByYearDay, err = parseIntList(val, 1, 366, true)
+		case "BYWEEKNO":
+			rule.ByWeekNo, err = parseIntList(val, 1, 53, true)
+		case "BYMONTH":
+			rule.ByMonth, err = parseIntList(val, 1, 12, false)
+		case "BYSETPOS":
+			rule.BySetPos, err = parseIntList(val, 1, 366, true)
+		case "WKST":
+			day, ok := weekdays[strings.ToUpper(val)]
+			if !ok {
+				err = fmt.Errorf("invalid weekday '%s'", val)
+			}
+			rule.Wkst = day
+		default:
+			// unknown parts (e.g. RSCALE or X-names) are ignored
+			log.Debug("Ignoring unknown rule part " + key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in rule '%s': %s", key, value, err.Error())
+		}
+	}
+	if rule.Freq == "" {
+		return nil, fmt.Errorf("missing FREQ in rule '%s'", value)
+	}
+	if rule.Count != 0 && rule.Until != "" {
+		return nil, fmt.Errorf("COUNT and UNTIL are mutually exclusive in rule '%s'", value)
+	}
+	return rule, nil
+}
+
+// String serializes the rule back into its RRULE value form.
+func (rule *RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + rule.Freq}
+	if rule.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rule.Interval))
+	}
+	if rule.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rule.Count))
+	}
+	if rule.Until != "" {
+		parts = append(parts, "UNTIL="+rule.Until)
+	}
+	appendInts := func(name string, values []int) {
+		if len(values) == 0 {
+			return
+		}
+		strs := make([]string, len(values))
+		for i, v := range values {
+			strs[i] = strconv.Itoa(v)
+		}
+		parts = append(parts, name+"="+strings.Join(strs, ","))
+	}
+	appendInts("BYSECOND", rule.BySecond)
+	appendInts("BYMINUTE", rule.ByMinute)
+	appendInts("BYHOUR", rule.ByHour)
+	if len(rule.ByDay) > 0 {
+		strs := make([]string, len(rule.ByDay))
+		for i, wd := range rule.ByDay {
+			strs[i] = wd.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(strs, ","))
+	}
+	appendInts("BYMONTHDAY", rule.ByMonthDay)
+	appendInts("BYYEARDAY", rule.ByYearDay)
+	appendInts("BYWEEKNO", rule.ByWeekNo)
+	appendInts("BYMONTH", rule.ByMonth)
+	appendInts("BYSETPOS", rule.BySetPos)
+	if rule.Wkst != time.Monday {
+		parts = append(parts, "WKST="+weekdayName(rule.Wkst))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (wd WeekdayNum) String() string {
+	if wd.N == 0 {
+		return weekdayName(wd.Day)
+	}
+	return strconv.Itoa(wd.N) + weekdayName(wd.Day)
+}
+
+func weekdayName(day time.Weekday) string {
+	for name, d := range weekdays {
+		if d == day {
+			return name
+		}
+	}
+	return ""
+}
+
+func parseIntList(value string, min int, max int, allowNegative bool) ([]int, error) {
+	var list []int
+	for _, s := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(strings.TrimPrefix(s, "+"))
+		if err != nil {
+			return nil, err
+		}
+		abs := i
+		if allowNegative && i < 0 {
+			abs = -i
+		}
+		if abs < min || abs > max {
+			return nil, fmt.Errorf("value %d out of range", i)
+		}
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+func parseWeekdayList(value string) ([]WeekdayNum, error) {
+	var list []WeekdayNum
+	for _, s := range strings.Split(strings.ToUpper(value), ",") {
+		if len(s) < 2 {
+			return nil, fmt.Errorf("invalid weekday '%s'", s)
+		}
+		day, ok := weekdays[s[len(s)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday '%s'", s)
+		}
+		wd := WeekdayNum{Day: day}
+		if len(s) > 2 {
+			n, err := strconv.Atoi(strings.TrimPrefix(s[:len(s)-2], "+"))
+			if err != nil || n == 0 || n > 53 || n < -53 {
+				return nil, fmt.Errorf("invalid weekday ordinal '%s'", s)
+			}
+			wd.N = n
+		}
+		list = append(list, wd)
+	}
+	return list, nil
+}
+
+// ruleIterator generates the occurrences of a single rule in chronological order.
+// DTSTART is always the first occurrence, as required by RFC 5545.
+type ruleIterator struct {
+	rule    RecurrenceRule
+	dtstart time.Time
+	until   time.Time
+	period  int
+	buffer  []time.Time
+	emitted int
+	done    bool
+}
+
+func newRuleIterator(rule *RecurrenceRule, dtstart time.Time) (*ruleIterator, error) {
+	it := &ruleIterator{rule: *rule, dtstart: dtstart}
+	if rule.Until != "" {
+		until, _, err := parseICalTime(rule.Until, dtstart.Location())
+		if err != nil {
+			return nil, fmt.Errorf("invalid UNTIL: %s", err.Error())
+		}
+		if len(rule.Until) == len(icalDateFormat) {
+			// a date as UNTIL includes the whole day
+			until = until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		it.until = until
+	}
+
+	// fill in the implicit values from DTSTART (RFC 5545 3.3.10, table of BYxxx expansions)
+	r := &it.rule
+	if len(r.ByWeekNo) == 0 && len(r.ByYearDay) == 0 && len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+		switch r.Freq {
+		case "YEARLY":
+			if len(r.ByMonth) == 0 {
+				r.ByMonth = []int{int(dtstart.Month())}
+			}
+			r.ByMonthDay = []int{dtstart.Day()}
+		case "MONTHLY":
+			r.ByMonthDay = []int{dtstart.Day()}
+		case "WEEKLY":
+			r.ByDay = []WeekdayNum{{Day: dtstart.Weekday()}}
+		}
+	}
+	if freqIndex(r.Freq) > freqIndex("HOURLY") && len(r.ByHour) == 0 {
+		r.ByHour = []int{dtstart.Hour()}
+	}
+	if freqIndex(r.Freq) > freqIndex("MINUTELY") && len(r.ByMinute) == 0 {
+		r.ByMinute = []int{dtstart.Minute()}
+	}
+	if freqIndex(r.Freq) > freqIndex("SECONDLY") && len(r.BySecond) == 0 {
+		r.BySecond = []int{dtstart.Second()}
+	}
+	return it, nil
+}
+
+func freqIndex(freq string) int {
+	for i, f := range frequencies {
+		if f == freq {
+			return i
+		}
+	}
+	return -1
+}
+
+func (it *ruleIterator) next() (time.Time, bool) {
+	if it.done {
+		return time.Time{}, false
+	}
+	if it.emitted == 0 {
+		it.emitted++
+		if !it.until.IsZero() && it.dtstart.After(it.until) {
+			it.done = true
+			return time.Time{}, false
+		}
+		return it.dtstart, true
+	}
+	if it.rule.Count > 0 && it.emitted >= it.rule.Count {
+		it.done = true
+		return time.Time{}, false
+	}
+	for len(it.buffer) == 0 {
+		if it.period >= maxRecurrencePeriods {
+			log.Warnf("Recurrence rule '%s' exceeded %d periods, stopping expansion", it.rule.String(), maxRecurrencePeriods)
+			it.done = true
+			return time.Time{}, false
+		}
+		for _, candidate := range it.expandPeriod(it.period) {
+			if candidate.After(it.dtstart) {
+				it.buffer = append(it.buffer, candidate)
+			}
+		}
+		it.period++
+	}
+	next := it.buffer[0]
+	it.buffer = it.buffer[1:]
+	if !it.until.IsZero() && next.After(it.until) {
+		it.done = true
+		return time.Time{}, false
+	}
+	it.emitted++
+	return next, true
+}
+
+// expandPeriod returns all candidates of the n-th period (year, month, week, ...) of the rule, sorted.
+func (it *ruleIterator) expandPeriod(n int) []time.Time {
+	r := &it.rule
+	start := it.dtstart
+	loc := start.Location()
+	startDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	step := n * r.Interval
+
+	var days []time.Time
+	hours, minutes, seconds := r.ByHour, r.ByMinute, r.BySecond
+	switch r.Freq {
+	case "YEARLY":
+		year := start.Year() + step
+		if len(r.ByWeekNo) > 0 {
+			first := weekYearStart(year, r.Wkst)
+			days = dayRange(first, weekYearStart(year+1, r.Wkst))
+		} else {
+			days = dayRange(time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC))
+		}
+	case "MONTHLY":
+		first := time.Date(start.Year(), start.Month()+time.Month(step), 1, 0, 0, 0, 0, time.UTC)
+		days = dayRange(first, first.AddDate(0, 1, 0))
+	case "WEEKLY":
+		offset := (int(startDay.Weekday()) - int(r.Wkst) + 7) % 7
+		first := startDay.AddDate(0, 0, step*7-offset)
+		days = dayRange(first, first.AddDate(0, 0, 7))
+	case "DAILY":
+		days = []time.Time{startDay.AddDate(0, 0, step)}
+	case "HOURLY", "MINUTELY", "SECONDLY":
+		var unit time.Duration
+		var base time.Time
+		switch r.Freq {
+		case "HOURLY":
+			unit = time.Hour
+			base = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), 0, 0, 0, loc)
+		case "MINUTELY":
+			unit = time.Minute
+			base = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), 0, 0, loc)
+		default:
+			unit = time.Second
+			base = start.Truncate(time.Second)
+		}
+		t := base.Add(time.Duration(step) * unit)
+		days = []time.Time{time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)}
+		if !intsContain(r.ByHour, t.Hour(), true) {
+			return nil
+		}
+		hours = []int{t.Hour()}
+		if r.Freq != "HOURLY" {
+			if !intsContain(r.ByMinute, t.Minute(), true) {
+				return nil
+			}
+			minutes = []int{t.Minute()}
+		}
+		if r.Freq == "SECONDLY" {
+			if !intsContain(r.BySecond, t.Second(), true) {
+				return nil
+			}
+			seconds = []int{t.Second()}
+		}
+	}
+
+	var candidates []time.Time
+	for _, day := range days {
+		if !it.dayMatches(day) {
+			continue
+		}
+		for _, h := range hours {
+			for _, m := range minutes {
+				for _, s := range seconds {
+					candidates = append(candidates, time.Date(day.Year(), day.Month(), day.Day(), h, m, s, 0, loc))
+				}
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+	if len(r.BySetPos) > 0 && len(candidates) > 0 {
+		var selected []time.Time
+		for i, c := range candidates {
+			if intsContain(r.BySetPos, i+1, false) || intsContain(r.BySetPos, i-len(candidates), false) {
+				selected = append(selected, c)
+			}
+		}
+		candidates = selected
+	}
+	return candidates
+}
+
+// dayMatches checks a day (in UTC, only the date is relevant) against the day-level BYxxx parts.
+func (it *ruleIterator) dayMatches(day time.Time) bool {
+	r := &it.rule
+	if len(r.ByMonth) > 0 && !intsContain(r.ByMonth, int(day.Month()), false) {
+		return false
+	}
+	if len(r.ByWeekNo) > 0 {
+		week, weeks := weekNumber(day, r.Wkst)
+		if !intsContain(r.ByWeekNo, week, false) && !intsContain(r.ByWeekNo, week-weeks-1, false) {
+			return false
+		}
+	}
+	daysInYear := time.Date(day.Year(), 12, 31, 0, 0, 0, 0, time.UTC).YearDay()
+	if len(r.ByYearDay) > 0 {
+		yday := day.YearDay()
+		if !intsContain(r.ByYearDay, yday, false) && !intsContain(r.ByYearDay, yday-daysInYear-1, false) {
+			return false
+		}
+	}
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if len(r.ByMonthDay) > 0 {
+		if !intsContain(r.ByMonthDay, day.Day(), false) && !intsContain(r.ByMonthDay, day.Day()-daysInMonth-1, false) {
+			return false
+		}
+	}
+	if len(r.ByDay) > 0 {
+		matched := false
+		for _, wd := range r.ByDay {
+			if wd.Day != day.Weekday() {
+				continue
+			}
+			if wd.N == 0 || (r.Freq != "MONTHLY" && r.Freq != "YEARLY") {
+				matched = true
+				break
+			}
+			// ordinals are relative to the month for MONTHLY and YEARLY with BYMONTH, otherwise to the year
+			pos, length := day.Day(), daysInMonth
+			if r.Freq == "YEARLY" && len(r.ByMonth) == 0 {
+				pos, length = day.YearDay(), daysInYear
+			}
+			if (wd.N > 0 && (pos-1)/7+1 == wd.N) || (wd.N < 0 && (length-pos)/7+1 == -wd.N) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// weekYearStart returns the first day of week 1 of the given year, i.e. the start of the first week
+// containing at least four days of the year.
+func weekYearStart(year int, wkst time.Weekday) time.Time {
+	jan1 := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	offset := (int(jan1.Weekday()) - int(wkst) + 7) % 7
+	if offset <= 3 {
+		return jan1.AddDate(0, 0, -offset)
+	}
+	return jan1.AddDate(0, 0, 7-offset)
+}
+
+// weekNumber returns the week number of the day and the number of weeks of its week-numbering year.
+func weekNumber(day time.Time, wkst time.Weekday) (int, int) {
+	year := day.Year()
+	start := weekYearStart(year, wkst)
+	if day.Before(start) {
+		year--
+		start = weekYearStart(year, wkst)
+	} else if next := weekYearStart(year+1, wkst); !day.Before(next) {
+		year++
+		start = next
+	}
+	weeks := int(weekYearStart(year+1, wkst).Sub(start).Hours()) / (24 * 7)
+	return int(day.Sub(start).Hours())/(24*7) + 1, weeks
+}
+
+func dayRange(from time.Time, to time.Time) []time.Time {
+	var days []time.Time
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// intsContain checks if i is in list. If emptyMatches is set, an empty list matches everything.
+func intsContain(list []int, i int, emptyMatches bool) bool {
+	if len(list) == 0 {
+		return emptyMatches
+	}
+	for _, v := range list {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Time handling
+
+// parseICalTime parses a DATE or DATE-TIME value. Floating times are interpreted in loc.
+// Returns true as second value, if the value is a DATE.
+func parseICalTime(value string, loc *time.Location) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case len(value) == len(icalDateFormat):
+		t, err := time.ParseInLocation(icalDateFormat, value, loc)
+		return t, true, err
+	case strings.HasSuffix(value, "Z"):
+		t, err := time.ParseInLocation(icalTimestampFormatUtc, value, time.UTC)
+		return t, false, err
+	default:
+		t, err := time.ParseInLocation(icalTimestampFormat, value, loc)
+		return t, false, err
+	}
+}
+
+// timeFormat describes how a date or time property of an event is written,
+// so that derived values keep the same representation.
+type timeFormat struct {
+	AllDay   bool
+	Tzid     string
+	Floating bool
+	Location *time.Location
+}
+
+// getTimeFormat reads the representation of the given date or time property.
+func getTimeFormat(event *ics.VEvent, property ics.ComponentProperty) (timeFormat, error) {
+	format := timeFormat{Location: time.Local}
+	prop := event.GetProperty(property)
+	if prop == nil {
+		return format, fmt.Errorf("missing property %s", property)
+	}
+	if tzid, ok := prop.ICalParameters["TZID"]; ok && len(tzid) > 0 {
+		loc, err := time.LoadLocation(tzid[0])
+		if err != nil {
+			return format, fmt.Errorf("unknown timezone '%s': %s", tzid[0], err.Error())
+		}
+		format.Tzid = tzid[0]
+		format.Location = loc
+	}
+	if value, ok := prop.ICalParameters["VALUE"]; (ok && len(value) > 0 && value[0] == "DATE") || len(prop.Value) == len(icalDateFormat) {
+		format.AllDay = true
+	} else if !strings.HasSuffix(prop.Value, "Z") && format.Tzid == "" {
+		format.Floating = true
+	}
+	if strings.HasSuffix(prop.Value, "Z") {
+		format.Location = time.UTC
+	}
+	return format, nil
+}
+
+// value formats t according to the format.
+func (format timeFormat) value(t time.Time) (string, map[string][]string) {
+	params := map[string][]string{}
+	switch {
+	case format.AllDay:
+		params["VALUE"] = []string{"DATE"}
+		return t.In(format.Location).Format(icalDateFormat), params
+	case format.Tzid != "":
+		params["TZID"] = []string{format.Tzid}
+		return t.In(format.Location).Format(icalTimestampFormat), params
+	case format.Floating:
+		return t.In(format.Location).Format(icalTimestampFormat), params
+	default:
+		return t.UTC().Format(icalTimestampFormatUtc), params
+	}
+}
+
+// setTimeProperty replaces the property with the time t, written in the given format.
+func setTimeProperty(event *ics.VEvent, property ics.ComponentProperty, t time.Time, format timeFormat) {
+	value, params := format.value(t)
+	newProp := ics.IANAProperty{
+		BaseProperty: ics.BaseProperty{IANAToken: string(property), ICalParameters: params, Value: value},
+	}
+	for i := range event.Properties {
+		if event.Properties[i].IANAToken == string(property) {
+			event.Properties[i] = newProp
+			return
+		}
+	}
+	event.Properties = append(event.Properties, newProp)
+}
+
+// removeProperties removes all properties with the given name from the event.
+func removeProperties(event *ics.VEvent, property ics.ComponentProperty) {
+	for i := len(event.Properties) - 1; i >= 0; i-- {
+		if event.Properties[i].IANAToken == string(property) {
+			event.Properties = helpers.RemoveProperty(event.Properties, i)
+		}
+	}
+}
+
+// getProperties returns all properties with the given name.
+func getProperties(event *ics.VEvent, property ics.ComponentProperty) []ics.IANAProperty {
+	var props []ics.IANAProperty
+	for _, prop := range event.Properties {
+		if prop.IANAToken == string(property) {
+			props = append(props, prop)
+		}
+	}
+	return props
+}
+
+// parseTimeList parses a (possibly comma separated) RDATE, EXDATE or RECURRENCE-ID property.
+// PERIOD values are reduced to their start.
+func parseTimeList(prop ics.IANAProperty, loc *time.Location) ([]time.Time, error) {
+	if tzid, ok := prop.ICalParameters["TZID"]; ok && len(tzid) > 0 {
+		var err error
+		loc, err = time.LoadLocation(tzid[0])
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone '%s': %s", tzid[0], err.Error())
+		}
+	}
+	var times []time.Time
+	for _, value := range strings.Split(prop.Value, ",") {
+		value, _, _ = strings.Cut(value, "/")
+		t, _, err := parseICalTime(value, loc)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, t)
+	}
+	return times, nil
+}
+
+// parseICalDuration parses a DURATION value like "PT1H30M", "P1D" or "-P2W".
+func parseICalDuration(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	sign := time.Duration(1)
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+	if !strings.HasPrefix(s, "P") || len(s) < 2 {
+		return 0, fmt.Errorf("invalid duration '%s'", value)
+	}
+	s = s[1:]
+	var d time.Duration
+	inTime := false
+	number := ""
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			number += string(c)
+		case c == 'T':
+			inTime = true
+		default:
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration '%s'", value)
+			}
+			number = ""
+			switch {
+			case c == 'W' && !inTime:
+				d += time.Duration(n) * 7 * 24 * time.Hour
+			case c == 'D' && !inTime:
+				d += time.Duration(n) * 24 * time.Hour
+			case c == 'H' && inTime:
+				d += time.Duration(n) * time.Hour
+			case c == 'M' && inTime:
+				d += time.Duration(n) * time.Minute
+			case c == 'S' && inTime:
+				d += time.Duration(n) * time.Second
+			default:
+				return 0, fmt.Errorf("invalid duration '%s'", value)
+			}
+		}
+	}
+	if number != "" {
+		return 0, fmt.Errorf("invalid duration '%s'", value)
+	}
+	return sign * d, nil
+}
+
+// Recurrence sets
+
+// IsRecurring returns true, if the event is the master of a recurring series, i.e. has a RRULE or RDATE.
+func IsRecurring(event *ics.VEvent) bool {
+	return event.GetProperty(ics.ComponentPropertyRecurrenceId) == nil &&
+		(event.GetProperty(ics.ComponentPropertyRrule) != nil || event.GetProperty(ics.ComponentPropertyRdate) != nil)
+}
+
+// eventDuration returns the duration of the event from DTEND or DURATION.
+// Events without either last zero time, all-day events one day.
+func eventDuration(event *ics.VEvent, start time.Time, allDay bool) time.Duration {
+	if prop := event.GetProperty(ics.ComponentPropertyDtEnd); prop != nil {
+		if end, err := event.GetEndAt(); err == nil {
+			return end.Sub(start)
+		}
+	}
+	if prop := event.GetProperty(ics.ComponentPropertyDuration); prop != nil {
+		if d, err := parseICalDuration(prop.Value); err == nil {
+			return d
+		}
+	}
+	if allDay {
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// getOverrides returns all components of the calendar overriding instances of the given series,
+// keyed by the unix time of their RECURRENCE-ID.
+func getOverrides(cal *ics.Calendar, master *ics.VEvent, loc *time.Location) map[int64]*ics.VEvent {
+	overrides := make(map[int64]*ics.VEvent)
+	if cal == nil {
+		return overrides
+	}
+	for _, event := range cal.Events() {
+		prop := event.GetProperty(ics.ComponentPropertyRecurrenceId)
+		if prop == nil || event.Id() != master.Id() {
+			continue
+		}
+		times, err := parseTimeList(*prop, loc)
+		if err != nil || len(times) == 0 {
+			log.Debug("Ignoring invalid RECURRENCE-ID of event " + event.Id())
+			continue
+		}
+		overrides[times[0].Unix()] = event
+	}
+	return overrides
+}
+
+// IterateOccurrences calls fn for every occurrence of the event in chronological order of their recurrence ids,
+// until fn returns false or the recurrence set is exhausted.
+// Instances overridden by another component of the calendar (via RECURRENCE-ID) carry the overriding event.
+// Non-recurring events have exactly one occurrence.
+func IterateOccurrences(cal *ics.Calendar, event *ics.VEvent, fn func(Occurrence) bool) error {
+	start, err := event.GetStartAt()
+	if err != nil {
+		return fmt.Errorf("event %s has no valid start: %s", event.Id(), err.Error())
+	}
+	format, err := getTimeFormat(event, ics.ComponentPropertyDtStart)
+	if err != nil {
+		return fmt.Errorf("event %s: %s", event.Id(), err.Error())
+	}
+	duration := eventDuration(event, start, format.AllDay)
+
+	if !IsRecurring(event) {
+		fn(Occurrence{Start: start, End: start.Add(duration), RecurrenceId: start, AllDay: format.AllDay})
+		return nil
+	}
+
+	var rules []*ruleIterator
+	for _, prop := range getProperties(event, ics.ComponentPropertyRrule) {
+		rule, err := ParseRecurrenceRule(prop.Value)
+		if err != nil {
+			return fmt.Errorf("event %s: %s", event.Id(), err.Error())
+		}
+		it, err := newRuleIterator(rule, start)
+		if err != nil {
+			return fmt.Errorf("event %s: %s", event.Id(), err.Error())
+		}
+		rules = append(rules, it)
+	}
+	var exrules []*ruleIterator
+	for _, prop := range getProperties(event, ics.ComponentPropertyExrule) {
+		rule, err := ParseRecurrenceRule(prop.Value)
+		if err != nil {
+			return fmt.Errorf("event %s: %s", event.Id(), err.Error())
+		}
+		it, err := newRuleIterator(rule, start)
+		if err != nil {
+			return fmt.Errorf("event %s: %s", event.Id(), err.Error())
+		}
+		exrules = append(exrules, it)
+	}
+	var rdates []time.Time
+	if len(rules) == 0 {
+		// without a RRULE, DTSTART still is the first instance
+		rdates = append(rdates, start)
+	}
+	for _, prop := range getProperties(event, ics.ComponentPropertyRdate) {
+		times, err := parseTimeList(prop, format.Location)
+		if err != nil {
+			return fmt.Errorf("event %s has an invalid RDATE: %s", event.Id(), err.Error())
+		}
+		rdates = append(rdates, times...)
+	}
+	sort.Slice(rdates, func(i, j int) bool { return rdates[i].Before(rdates[j]) })
+	exdates := make(map[int64]bool)
+	for _, prop := range getProperties(event, ics.ComponentPropertyExdate) {
+		times, err := parseTimeList(prop, format.Location)
+		if err != nil {
+			return fmt.Errorf("event %s has an invalid EXDATE: %s", event.Id(), err.Error())
+		}
+		for _, t := range times {
+			exdates[t.Unix()] = true
+		}
+	}
+	overrides := getOverrides(cal, event, format.Location)
+
+	// merge all rules and rdates, always taking the earliest pending value
+	heads := make([]*time.Time, len(rules))
+	advance := func(i int) {
+		if t, ok := rules[i].next(); ok {
+			heads[i] = &t
+		} else {
+			heads[i] = nil
+		}
+	}
+	for i := range rules {
+		advance(i)
+	}
+	exHeads := make([]*time.Time, len(exrules))
+	for i, it := range exrules {
+		if t, ok := it.next(); ok {
+			exHeads[i] = &t
+		}
+	}
+	var last time.Time
+	for {
+		var next *time.Time
+		nextRule := -1
+		for i, head := range heads {
+			if head != nil && (next == nil || head.Before(*next)) {
+				next = head
+				nextRule = i
+			}
+		}
+		if len(rdates) > 0 && (next == nil || !rdates[0].After(*next)) {
+			t := rdates[0]
+			next = &t
+			nextRule = -1
+			rdates = rdates[1:]
+		}
+		if next == nil {
+			return nil
+		}
+		current := *next
+		if nextRule >= 0 {
+			advance(nextRule)
+		}
+		if !last.IsZero() && current.Equal(last) {
+			continue
+		}
+		last = current
+
+		if exdates[current.Unix()] {
+			continue
+		}
+		excluded := false
+		for i, it := range exrules {
+			for exHeads[i] != nil && exHeads[i].Before(current) {
+				if t, ok := it.next(); ok {
+					exHeads[i] = &t
+				} else {
+					exHeads[i] = nil
+				}
+			}
+			if exHeads[i] != nil && exHeads[i].Equal(current) {
+				excluded = true
+			}
+		}
+		if excluded {
+			continue
+		}
+
+		occurrence := Occurrence{Start: current, End: current.Add(duration), RecurrenceId: current, AllDay: format.AllDay}
+		if override, ok := overrides[current.Unix()]; ok {
+			occurrence.Override = override
+			if overrideStart, err := override.GetStartAt(); err == nil {
+				occurrence.Start = overrideStart
+				occurrence.End = overrideStart.Add(eventDuration(override, overrideStart, occurrence.AllDay))
+			}
+		}
+		if !fn(occurrence) {
+			return nil
+		}
+	}
+}
+
+// GetOccurrences returns all occurrences of the event with a recurrence id in [from, to).
+func GetOccurrences(cal *ics.Calendar, event *ics.VEvent, from time.Time, to time.Time) ([]Occurrence, error) {
+	var occurrences []Occurrence
+	err := IterateOccurrences(cal, event, func(o Occurrence) bool {
+		if !o.RecurrenceId.Before(to) {
+			return false
+		}
+		if !o.RecurrenceId.Before(from) {
+			occurrences = append(occurrences, o)
+		}
+		return true
+	})
+	return occurrences, err
+}
+
+// InstanceUid returns the stable UID used for a single instance materialised from a recurring series.
+func InstanceUid(uid string, o Occurrence) string {
+	if o.AllDay {
+		return uid + "-" + o.RecurrenceId.Format(icalDateFormat)
+	}
+	return uid + "-" + o.RecurrenceId.UTC().Format(icalTimestampFormatUtc)
+}
+
+// materializeOccurrence creates a standalone copy of the occurrence of the recurring master.
+// Overridden instances are copied from their overriding component.
+// If uid is empty, the instance keeps the UID of the series and gets a RECURRENCE-ID instead.
+func materializeOccurrence(master *ics.VEvent, o Occurrence, uid string) (*ics.VEvent, error) {
+	startFormat, err := getTimeFormat(master, ics.ComponentPropertyDtStart)
+	if err != nil {
+		return nil, err
+	}
+	var instance *ics.VEvent
+	if o.Override != nil {
+		instance = helpers.CopyEvent(o.Override)
+	} else {
+		instance = helpers.CopyEvent(master)
+		setTimeProperty(instance, ics.ComponentPropertyDtStart, o.Start, startFormat)
+		if master.GetProperty(ics.ComponentPropertyDtEnd) != nil {
+			endFormat, err := getTimeFormat(master, ics.ComponentPropertyDtEnd)
+			if err != nil {
+				return nil, err
+			}
+			setTimeProperty(instance, ics.ComponentPropertyDtEnd, o.End, endFormat)
+		}
+	}
+	removeProperties(instance, ics.ComponentPropertyRrule)
+	removeProperties(instance, ics.ComponentPropertyRdate)
+	removeProperties(instance, ics.ComponentPropertyExdate)
+	removeProperties(instance, ics.ComponentPropertyExrule)
+	removeProperties(instance, ics.ComponentPropertyRecurrenceId)
+	if uid != "" {
+		instance.SetProperty(ics.ComponentPropertyUniqueId, uid)
+	} else {
+		setTimeProperty(instance, ics.ComponentPropertyRecurrenceId, o.RecurrenceId, startFormat)
+	}
+	return instance, nil
+}
+
+// SplitRecurringEvents splits every recurring series of the calendar at the given time.
+// Occurrences before 'at' are materialised into single events with stable derived UIDs (see InstanceUid),
+// the series itself is moved to start with its first occurrence at or after 'at'.
+// Afterwards every recurring event lies completely before or completely after 'at'.
+// Series with multiple RRULEs or an EXRULE are left untouched.
+func SplitRecurringEvents(cal *ics.Calendar, at time.Time) error {
+	var components []ics.Component
+	consumed := make(map[*ics.VEvent]bool)
+
+	for _, component := range cal.Components {
+		event, ok := component.(*ics.VEvent)
+		if !ok || !IsRecurring(event) {
+			components = append(components, component)
+			continue
+		}
+		if len(getProperties(event, ics.ComponentPropertyRrule)) > 1 || event.GetProperty(ics.ComponentPropertyExrule) != nil {
+			log.Debug("Not splitting event " + event.Id() + " with multiple RRULEs or EXRULE")
+			components = append(components, component)
+			continue
+		}
+
+		var past []Occurrence
+		hasFuture := false
+		err := IterateOccurrences(cal, event, func(o Occurrence) bool {
+			if o.RecurrenceId.Before(at) {
+				past = append(past, o)
+				return true
+			}
+			hasFuture = true
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		if len(past) == 0 {
+			components = append(components, component)
+			continue
+		}
+		log.Debugf("Splitting event %s, materialising %d past occurrences", event.Id(), len(past))
+
+		for _, o := range past {
+			instance, err := materializeOccurrence(event, o, InstanceUid(event.Id(), o))
+			if err != nil {
+				return err
+			}
+			if o.Override != nil {
+				consumed[o.Override] = true
+			}
+			components = append(components, instance)
+		}
+		if hasFuture {
+			err = truncateSeries(event, at)
+			if err != nil {
+				return err
+			}
+			components = append(components, event)
+		}
+	}
+
+	// remove the overrides that were materialised together with their instance
+	cal.Components = nil
+	for _, component := range components {
+		if event, ok := component.(*ics.VEvent); ok && consumed[event] {
+			continue
+		}
+		cal.Components = append(cal.Components, component)
+	}
+	return nil
+}
+
+// truncateSeries moves the start of a series to its first occurrence at or after 'at',
+// adjusting COUNT, RDATE and EXDATE accordingly.
+func truncateSeries(event *ics.VEvent, at time.Time) error {
+	start, err := event.GetStartAt()
+	if err != nil {
+		return err
+	}
+	format, err := getTimeFormat(event, ics.ComponentPropertyDtStart)
+	if err != nil {
+		return err
+	}
+	duration := eventDuration(event, start, format.AllDay)
+
+	// find the new anchor from the rule itself, so the rule keeps generating the same instances
+	var newStart time.Time
+	if prop := event.GetProperty(ics.ComponentPropertyRrule); prop != nil {
+		rule, err := ParseRecurrenceRule(prop.Value)
+		if err != nil {
+			return err
+		}
+		it, err := newRuleIterator(rule, start)
+		if err != nil {
+			return err
+		}
+		passed := 0
+		for {
+			t, ok := it.next()
+			if !ok {
+				break
+			}
+			if !t.Before(at) {
+				newStart = t
+				break
+			}
+			passed++
+		}
+		if newStart.IsZero() {
+			removeProperties(event, ics.ComponentPropertyRrule)
+		} else if rule.Count > 0 {
+			rule.Count -= passed
+			event.SetProperty(ics.ComponentPropertyRrule, rule.String())
+		}
+	}
+
+	// drop all rdates and exdates before the split
+	var remaining []time.Time
+	for _, property := range []ics.ComponentProperty{ics.ComponentPropertyRdate, ics.ComponentPropertyExdate} {
+		props := getProperties(event, property)
+		removeProperties(event, property)
+		for _, prop := range props {
+			var values []string
+			times, err := parseTimeList(prop, format.Location)
+			if err != nil {
+				return err
+			}
+			for i, value := range strings.Split(prop.Value, ",") {
+				if !times[i].Before(at) {
+					values = append(values, value)
+					if property == ics.ComponentPropertyRdate {
+						remaining = append(remaining, times[i])
+					}
+				}
+			}
+			if len(values) > 0 {
+				prop.Value = strings.Join(values, ",")
+				event.Properties = append(event.Properties, prop)
+			}
+		}
+	}
+	if newStart.IsZero() {
+		sort.Slice(remaining, func(i, j int) bool { return remaining[i].Before(remaining[j]) })
+		if len(remaining) == 0 {
+			return fmt.Errorf("event %s has no occurrences after %s", event.Id(), at.Format(time.RFC3339))
+		}
+		newStart = remaining[0]
+	}
+
+	setTimeProperty(event, ics.ComponentPropertyDtStart, newStart, format)
+	if event.GetProperty(ics.ComponentPropertyDtEnd) != nil {
+		endFormat, err := getTimeFormat(event, ics.ComponentPropertyDtEnd)
+		if err != nil {
+			return err
+		}
+		setTimeProperty(event, ics.ComponentPropertyDtEnd, newStart.Add(duration), endFormat)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package modules
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// parseTestCalendar wraps the given VEVENT lines into a calendar and parses it
+func parseTestCalendar(t *testing.T, events ...string) *ics.Calendar {
+	content := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:test\r\n"
+	for _, event := range events {
+		content += "BEGIN:VEVENT\r\n" + strings.ReplaceAll(strings.TrimSpace(event), "\n", "\r\n") + "\r\nEND:VEVENT\r\n"
+	}
+	content += "END:VCALENDAR\r\n"
+	cal, err := ics.ParseCalendar(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Error parsing test calendar: %s", err)
+	}
+	return cal
+}
+
+func occurrenceStarts(t *testing.T, cal *ics.Calendar, event *ics.VEvent, limit int) []string {
+	var starts []string
+	err := IterateOccurrences(cal, event, func(o Occurrence) bool {
+		starts = append(starts, o.Start.UTC().Format(icalTimestampFormatUtc))
+		return len(starts) < limit
+	})
+	if err != nil {
+		t.Fatalf("Error iterating occurrences: %s", err)
+	}
+	return starts
+}
+
+func TestRecurrenceRules(t *testing.T) {
+	tests := []struct {
+		dtstart  string
+		rrule    string
+		expected []string
+	}{
+		{"20240101T100000Z", "FREQ=WEEKLY;COUNT=3", []string{"20240101T100000Z", "20240108T100000Z", "20240115T100000Z"}},
+		{"20240101T100000Z", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;UNTIL=20240118T000000Z", []string{"20240101T100000Z", "20240103T100000Z", "20240115T100000Z", "20240117T100000Z"}},
+		{"20240126T090000Z", "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3", []string{"20240126T090000Z", "20240223T090000Z", "20240329T090000Z"}},
+		{"20240131T090000Z", "FREQ=MONTHLY;COUNT=3", []string{"20240131T090000Z", "20240331T090000Z", "20240531T090000Z"}},
+		{"20240101T090000Z", "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1;COUNT=2", []string{"20240101T090000Z", "20240131T090000Z"}},
+		{"20240229T120000Z", "FREQ=YEARLY;COUNT=2", []string{"20240229T120000Z", "20280229T120000Z"}},
+		{"20240101T000000Z", "FREQ=YEARLY;BYWEEKNO=1;BYDAY=MO;COUNT=3", []string{"20240101T000000Z", "20241230T000000Z", "20251229T000000Z"}},
+		{"20240101T080000Z", "FREQ=DAILY;BYHOUR=8,12;COUNT=3", []string{"20240101T080000Z", "20240101T120000Z", "20240102T080000Z"}},
+	}
+	for _, test := range tests {
+		cal := parseTestCalendar(t, "UID:test\nDTSTART:"+test.dtstart+"\nRRULE:"+test.rrule)
+		starts := occurrenceStarts(t, cal, cal.Events()[0], 10)
+		if strings.Join(starts, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Rule %s: got %v -- should be %v", test.rrule, starts, test.expected)
+		}
+	}
+}
+
+func TestRecurrenceExceptions(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:series
+DTSTART:20240101T100000Z
+DTEND:20240101T110000Z
+RRULE:FREQ=DAILY;COUNT=4
+EXDATE:20240102T100000Z
+RDATE:20240110T100000Z`, `UID:series
+RECURRENCE-ID:20240103T100000Z
+DTSTART:20240103T150000Z
+DTEND:20240103T160000Z`)
+
+	starts := occurrenceStarts(t, cal, cal.Events()[0], 10)
+	expected := []string{"20240101T100000Z", "20240103T150000Z", "20240104T100000Z", "20240110T100000Z"}
+	if strings.Join(starts, ",") != strings.Join(expected, ",") {
+		t.Errorf("Got %v -- should be %v", starts, expected)
+	}
+}
+
+func TestSplitRecurringEvents(t *testing.T) {
+	cal := parseTestCalendar(t, `UID:series
+DTSTART:20240101T100000Z
+DTEND:20240101T110000Z
+RRULE:FREQ=DAILY;COUNT=4`, `UID:series
+RECURRENCE-ID:20240102T100000Z
+DTSTART:20240102T150000Z
+DTEND:20240102T160000Z
+SUMMARY:moved`)
+
+	err := SplitRecurringEvents(cal, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Error splitting: %s", err)
+	}
+
+	events := cal.Events()
+	if len(events) != 3 {
+		t.Fatalf("Expected 2 instances and the remaining series, got %d events", len(events))
+	}
+	if events[0].Id() != "series-20240101T100000Z" || events[1].Id() != "series-20240102T100000Z" {
+		t.Errorf("Unexpected instance ids %s, %s", events[0].Id(), events[1].Id())
+	}
+	if events[1].GetProperty(ics.ComponentPropertySummary).Value != "moved" || events[1].GetProperty(ics.ComponentPropertyRecurrenceId) != nil {
+		t.Errorf("Overridden instance was not materialised from its override")
+	}
+	series := events[2]
+	if series.GetProperty(ics.ComponentPropertyDtStart).Value != "20240103T100000Z" || series.GetProperty(ics.ComponentPropertyRrule).Value != "FREQ=DAILY;COUNT=2" {
+		t.Errorf("Series not truncated correctly: DTSTART %s, RRULE %s", series.GetProperty(ics.ComponentPropertyDtStart).Value, series.GetProperty(ics.ComponentPropertyRrule).Value)
+	}
+
+	// past and future now lie on different sides of the split
+	indices, err := FilterTimeframe(cal, map[string]string{"before": "2024-01-03T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("Error filtering: %s", err)
+	}
+	if len(indices) != 2 || indices[0] != 0 || indices[1] != 1 {
+		t.Errorf("Expected the two instances to be filtered, got %v", indices)
+	}
+}
@@ -0,0 +1,203 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Filter selects events of a calendar. Rules refer to filters by their name, e.g. "type: regex".
+// Filters can keep state, but Apply may be called concurrently for different calendars.
+type Filter interface {
+	Name() string
+	// Schema describes the parameters of the filter, they are validated against it before the rule is saved.
+	Schema() ModuleSchema
+	// Apply returns the indices of the events in cal.Components, that match the filter.
+	Apply(ctx context.Context, cal *ics.Calendar, params map[string]string) ([]int, error)
+}
+
+// Action edits the events selected by the filters of a rule. Rules refer to actions by their name, e.g. "type: delete".
+// Actions can keep state, but Apply may be called concurrently for different calendars.
+type Action interface {
+	Name() string
+	// Schema describes the parameters of the action, they are validated against it before the rule is saved.
+	Schema() ModuleSchema
+	// Apply edits the events at the indices of cal.Components.
+	Apply(ctx context.Context, cal *ics.Calendar, indices []int, params map[string]string) error
+}
+
+var (
+	registryLock sync.RWMutex
+	filters      = make(map[string]Filter)
+	actions      = make(map[string]Action)
+)
+
+// RegisterFilter makes the filter available to rules. It is meant to be called from init functions of packages
+// embedding the modules and panics, if the filter is nil or a filter with the same name is already registered.
+func RegisterFilter(filter Filter) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if filter == nil {
+		panic("modules: RegisterFilter filter is nil")
+	}
+	if _, exists := filters[filter.Name()]; exists {
+		panic(fmt.Sprintf("modules: RegisterFilter called twice for filter %s", filter.Name()))
+	}
+	filters[filter.Name()] = filter
+}
+
+// RegisterAction makes the action available to rules. It is meant to be called from init functions of packages
+// embedding the modules and panics, if the action is nil or an action with the same name is already registered.
+func RegisterAction(action Action) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if action == nil {
+		panic("modules: RegisterAction action is nil")
+	}
+	if _, exists := actions[action.Name()]; exists {
+		panic(fmt.Sprintf("modules: RegisterAction called twice for action %s", action.Name()))
+	}
+	actions[action.Name()] = action
+}
+
+// GetFilter returns the registered filter with the name.
+func GetFilter(name string) (Filter, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	filter, ok := filters[name]
+	return filter, ok
+}
+
+// GetAction returns the registered action with the name.
+func GetAction(name string) (Action, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	action, ok := actions[name]
+	return action, ok
+}
+
+// RunFilter applies the filter named by the "type" parameter.
+func RunFilter(ctx context.Context, cal *ics.Calendar, params map[string]string) ([]int, error) {
+	filter, ok := GetFilter(params["type"])
+	if !ok {
+		return nil, fmt.Errorf("filter type '%s' doesn't exist", params["type"])
+	}
+	return filter.Apply(ctx, cal, params)
+}
+
+// RunAction applies the action named by the "type" parameter to the events at the indices.
+func RunAction(ctx context.Context, cal *ics.Calendar, indices []int, params map[string]string) error {
+	action, ok := GetAction(params["type"])
+	if !ok {
+		return fmt.Errorf("action type '%s' doesn't exist", params["type"])
+	}
+	return action.Apply(ctx, cal, indices, params)
+}
+
+// NewFilterFunc returns a stateless filter calling the function, which gets the parameters of the filter.
+func NewFilterFunc(name string, schema ModuleSchema, apply func(cal *ics.Calendar, params map[string]string) ([]int, error)) Filter {
+	return filterFunc{name, schema, apply}
+}
+
+// NewActionFunc returns a stateless action calling the function, which gets the indices and parameters of the action.
+func NewActionFunc(name string, schema ModuleSchema, apply func(cal *ics.Calendar, indices []int, params map[string]string) error) Action {
+	return actionFunc{name, schema, apply}
+}
+
+type filterFunc struct {
+	name   string
+	schema ModuleSchema
+	apply  func(cal *ics.Calendar, params map[string]string) ([]int, error)
+}
+
+func (filter filterFunc) Name() string         { return filter.name }
+func (filter filterFunc) Schema() ModuleSchema { return filter.schema }
+func (filter filterFunc) Apply(ctx context.Context, cal *ics.Calendar, params map[string]string) ([]int, error) {
+	return filter.apply(cal, params)
+}
+
+type actionFunc struct {
+	name   string
+	schema ModuleSchema
+	apply  func(cal *ics.Calendar, indices []int, params map[string]string) error
+}
+
+func (action actionFunc) Name() string         { return action.name }
+func (action actionFunc) Schema() ModuleSchema { return action.schema }
+func (action actionFunc) Apply(ctx context.Context, cal *ics.Calendar, indices []int, params map[string]string) error {
+	return action.apply(cal, indices, params)
+}
+
+// Filters holds the built-in filters by name.
+//
+// Deprecated: Filters doesn't contain registered filters, use GetFilter or RunFilter. It will be removed in 2.0.0-beta.11.
+var Filters = builtinFilters
+
+// Actions holds the built-in actions by name.
+//
+// Deprecated: Actions doesn't contain registered actions, use GetAction or RunAction. It will be removed in 2.0.0-beta.11.
+var Actions = builtinActions
+
+// CallFilter calls the filter function with the calendar and parameters.
+//
+// Deprecated: use RunFilter, which also runs registered filters. It will be removed in 2.0.0-beta.11.
+func CallFilter(filter func(*ics.Calendar, map[string]string) ([]int, error), cal *ics.Calendar, params map[string]string) ([]int, error) {
+	return filter(cal, params)
+}
+
+// CallAction calls the action function with the indices, calendar and parameters.
+//
+// Deprecated: use RunAction, which also runs registered actions. It will be removed in 2.0.0-beta.11.
+func CallAction(action func(*ics.Calendar, []int, map[string]string) error, cal *ics.Calendar, indices []int, params map[string]string) error {
+	return action(cal, indices, params)
+}
+
+// built-in filters and actions
+func init() {
+	for name, filter := range builtinFilters {
+		RegisterFilter(NewFilterFunc(name, builtinFilterSchemas[name], filter))
+	}
+	for name, action := range builtinActions {
+		RegisterAction(NewActionFunc(name, builtinActionSchemas[name], action))
+	}
+}
+
+// GetFilterSchemas returns the schemas of all registered filters sorted by name, with the name field populated.
+func GetFilterSchemas() []ModuleSchema {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	schemas := make([]ModuleSchema, 0, len(filters))
+	for name, filter := range filters {
+		schemas = append(schemas, namedSchema(name, filter.Schema()))
+	}
+	return sortSchemas(schemas)
+}
+
+// GetActionSchemas returns the schemas of all registered actions sorted by name, with the name field populated.
+func GetActionSchemas() []ModuleSchema {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	schemas := make([]ModuleSchema, 0, len(actions))
+	for name, action := range actions {
+		schemas = append(schemas, namedSchema(name, action.Schema()))
+	}
+	return sortSchemas(schemas)
+}
+
+func namedSchema(name string, schema ModuleSchema) ModuleSchema {
+	schema.Name = name
+	if schema.Parameters == nil {
+		schema.Parameters = []Parameter{}
+	}
+	return schema
+}
+
+func sortSchemas(schemas []ModuleSchema) []ModuleSchema {
+	sort.Slice(schemas, func(i, j int) bool {
+		return schemas[i].Name < schemas[j].Name
+	})
+	return schemas
+}
@@ -0,0 +1,77 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// countingFilter is a stateful filter matching the first event and counting how often it was applied
+type countingFilter struct {
+	calls *int
+}
+
+func (filter countingFilter) Name() string { return "test-counting" }
+func (filter countingFilter) Schema() ModuleSchema {
+	return ModuleSchema{Parameters: []Parameter{{Name: "limit", Type: ParameterInt, Required: true}}}
+}
+func (filter countingFilter) Apply(ctx context.Context, cal *ics.Calendar, params map[string]string) ([]int, error) {
+	*filter.calls++
+	return []int{0}, nil
+}
+
+func TestRegisterFilter(t *testing.T) {
+	calls := 0
+	RegisterFilter(countingFilter{&calls})
+
+	if err := ValidateFilter(map[string]string{"type": "test-counting"}); err == nil {
+		t.Error("missing mandatory parameter should be invalid")
+	}
+	params := map[string]string{"type": "test-counting", "limit": "1"}
+	if err := ValidateFilter(params); err != nil {
+		t.Fatal(err)
+	}
+	// the filter can be combined with built-in filters
+	overlap := map[string]string{"type": "overlap", "with-type": "test-counting", "with-limit": "1"}
+	if err := ValidateFilter(overlap); err != nil {
+		t.Fatal(err)
+	}
+
+	cal := parseTestCalendar(t, `UID:first
+DTSTART:20240101T100000Z`)
+	indices, err := RunFilter(context.Background(), cal, params)
+	if err != nil || fmt.Sprint(indices) != "[0]" || calls != 1 {
+		t.Errorf("got %v, %v after %d calls -- should be [0] after 1 call", indices, err, calls)
+	}
+
+	found := false
+	for _, schema := range GetFilterSchemas() {
+		found = found || schema.Name == "test-counting"
+	}
+	if !found {
+		t.Error("registered filter is missing in the schemas")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a filter twice should panic")
+		}
+	}()
+	RegisterFilter(countingFilter{&calls})
+}
+
+func TestDeprecatedCall(t *testing.T) {
+	cal := parseTestCalendar(t, "UID:first", "UID:second")
+	indices, err := CallFilter(Filters["all"], cal, map[string]string{"type": "all"})
+	if err != nil || fmt.Sprint(indices) != "[0 1]" {
+		t.Errorf("got %v, %v -- should be [0 1]", indices, err)
+	}
+	if err := CallAction(Actions["delete"], cal, []int{0}, map[string]string{"type": "delete"}); err != nil {
+		t.Fatal(err)
+	}
+	if events := cal.Events(); len(events) != 1 || events[0].Id() != "second" {
+		t.Errorf("got %d events -- should be only the second", len(events))
+	}
+}
@@ -0,0 +1,208 @@
+package modules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// reminder describes the alarms added by the add-reminder action.
+type reminder struct {
+	offsets     []time.Duration // relative triggers, negative before the event
+	related     string          // "START" or "END" for relative triggers
+	at          string          // absolute trigger as time expression, instead of offsets
+	action      string          // "DISPLAY", "AUDIO" or "EMAIL"
+	description string          // default the summary of the event
+	summary     string          // subject of email alarms, default the summary of the event
+	attendees   []string        // recipients of email alarms
+	replace     bool            // remove the existing alarms first
+}
+
+// parseReminder reads the parameters of the add-reminder action.
+func parseReminder(params map[string]string) (reminder, error) {
+	r := reminder{related: "START", action: "DISPLAY", description: params["description"], summary: params["summary"]}
+	given := 0
+	for _, param := range []string{"time", "before", "after", "at"} {
+		if params[param] != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return r, fmt.Errorf("exactly one of the parameters 'time', 'before', 'after' or 'at' is required")
+	}
+
+	switch {
+	case params["at"] != "":
+		if _, err := ParseDate(params["at"], time.Now()); err != nil {
+			return r, fmt.Errorf("invalid at: %s", err.Error())
+		}
+		if params["related"] != "" {
+			return r, fmt.Errorf("related can only be used with 'before' or 'after'")
+		}
+		r.at = params["at"]
+	default:
+		// time is the old name of before
+		param, sign := "before", time.Duration(-1)
+		if params["time"] != "" {
+			param = "time"
+		}
+		if params["after"] != "" {
+			param, sign = "after", 1
+		}
+		for _, value := range strings.Split(params[param], ",") {
+			offset, err := parseReminderDuration(strings.TrimSpace(value))
+			if err != nil || offset < 0 {
+				return r, fmt.Errorf("invalid %s '%s', use positive durations like 15m or 24h", param, value)
+			}
+			r.offsets = append(r.offsets, sign*offset)
+		}
+	}
+
+	switch params["related"] {
+	case "", "start":
+	case "end":
+		r.related = "END"
+	default:
+		return r, fmt.Errorf("invalid related '%s', use start or end", params["related"])
+	}
+
+	switch params["alarm-action"] {
+	case "", "display":
+	case "audio":
+		r.action = "AUDIO"
+	case "email":
+		r.action = "EMAIL"
+		for _, attendee := range strings.Split(params["attendees"], ",") {
+			attendee = strings.TrimPrefix(strings.TrimSpace(attendee), "mailto:")
+			if !strings.Contains(attendee, "@") {
+				return r, fmt.Errorf("email alarms need the parameter 'attendees' with email addresses")
+			}
+			r.attendees = append(r.attendees, "mailto:"+attendee)
+		}
+	default:
+		return r, fmt.Errorf("invalid alarm-action '%s', use display, audio or email", params["alarm-action"])
+	}
+
+	if params["remove-existing"] != "" {
+		var err error
+		if r.replace, err = strconv.ParseBool(params["remove-existing"]); err != nil {
+			return r, fmt.Errorf("invalid remove-existing: %s", err.Error())
+		}
+	}
+	return r, nil
+}
+
+// parseReminderDuration parses a duration like "15m" or "1h30m".
+// The iCalendar format of the old time parameter is accepted as well, e.g. "15M", "1H30M" or "P1D".
+func parseReminderDuration(value string) (time.Duration, error) {
+	if offset, err := time.ParseDuration(value); err == nil {
+		return offset, nil
+	}
+	value = strings.ToUpper(value)
+	if !strings.HasPrefix(value, "P") {
+		value = "PT" + value
+	}
+	return parseICalDuration(value)
+}
+
+// add adds the alarms of the reminder to the event.
+func (r reminder) add(event *ics.VEvent, now time.Time) error {
+	if r.replace {
+		var components []ics.Component
+		for _, component := range event.Components {
+			if _, ok := component.(*ics.VAlarm); !ok {
+				components = append(components, component)
+			}
+		}
+		event.Components = components
+	}
+
+	summary := ""
+	if prop := event.GetProperty(ics.ComponentPropertySummary); prop != nil {
+		summary = unescapeText(prop.Value)
+	}
+	description := r.description
+	if description == "" {
+		description = summary
+	}
+
+	var triggers []ics.IANAProperty
+	if r.at != "" {
+		at, err := ParseDate(r.at, now)
+		if err != nil {
+			return fmt.Errorf("invalid at: %s", err.Error())
+		}
+		triggers = append(triggers, alarmProperty(ics.ComponentPropertyTrigger, at.UTC().Format(icalTimestampFormatUtc),
+			map[string][]string{"VALUE": {"DATE-TIME"}}))
+	}
+	for _, offset := range r.offsets {
+		params := map[string][]string{}
+		if r.related == "END" {
+			params["RELATED"] = []string{"END"}
+		}
+		triggers = append(triggers, alarmProperty(ics.ComponentPropertyTrigger, formatICalDuration(offset), params))
+	}
+
+	for _, trigger := range triggers {
+		alarm := event.AddAlarm()
+		alarm.Properties = append(alarm.Properties, alarmProperty(ics.ComponentPropertyAction, r.action, nil), trigger)
+		switch r.action {
+		case "DISPLAY":
+			alarm.Properties = append(alarm.Properties, alarmProperty(ics.ComponentPropertyDescription, escapeText(description), nil))
+		case "EMAIL":
+			subject := r.summary
+			if subject == "" {
+				subject = summary
+			}
+			alarm.Properties = append(alarm.Properties,
+				alarmProperty(ics.ComponentPropertySummary, escapeText(subject), nil),
+				alarmProperty(ics.ComponentPropertyDescription, escapeText(description), nil))
+			for _, attendee := range r.attendees {
+				alarm.Properties = append(alarm.Properties, alarmProperty(ics.ComponentPropertyAttendee, attendee, nil))
+			}
+		}
+	}
+	return nil
+}
+
+// alarmProperty returns a property of an alarm with the parameters.
+func alarmProperty(property ics.ComponentProperty, value string, params map[string][]string) ics.IANAProperty {
+	if params == nil {
+		params = map[string][]string{}
+	}
+	return ics.IANAProperty{
+		BaseProperty: ics.BaseProperty{IANAToken: string(property), ICalParameters: params, Value: value},
+	}
+}
+
+// formatICalDuration formats the duration as iCalendar DURATION, e.g. "-PT15M" or "P1DT2H".
+func formatICalDuration(d time.Duration) string {
+	var b strings.Builder
+	if d < 0 {
+		b.WriteString("-")
+		d = -d
+	}
+	b.WriteString("P")
+	if days := d / (24 * time.Hour); days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+		d -= days * 24 * time.Hour
+	}
+	if d > 0 || !strings.HasSuffix(b.String(), "D") {
+		b.WriteString("T")
+		if hours := d / time.Hour; hours > 0 {
+			fmt.Fprintf(&b, "%dH", hours)
+			d -= hours * time.Hour
+		}
+		if minutes := d / time.Minute; minutes > 0 {
+			fmt.Fprintf(&b, "%dM", minutes)
+			d -= minutes * time.Minute
+		}
+		if seconds := d / time.Second; seconds > 0 || strings.HasSuffix(b.String(), "T") {
+			fmt.Fprintf(&b, "%dS", seconds)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,447 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParameterType describes which values a module parameter accepts.
+type ParameterType string
+
+const (
+	ParameterString   ParameterType = "string"
+	ParameterRegex    ParameterType = "regex"    // a Go regular expression
+	ParameterTime     ParameterType = "time"     // RFC3339, "now" or a date expression, see ParseDate
+	ParameterDuration ParameterType = "duration" // Go duration, e.g. "1h30m"
+	ParameterBool     ParameterType = "bool"
+	ParameterInt      ParameterType = "int"
+)
+
+// Parameter describes a single parameter of a filter or action.
+type Parameter struct {
+	Name        string        `json:"name"` // names ending with "*" describe all parameters with that prefix
+	Type        ParameterType `json:"type"`
+	Required    bool          `json:"required"`
+	Values      []string      `json:"values,omitempty"` // allowed values, any value of the type if empty
+	Default     string        `json:"default,omitempty"`
+	Description string        `json:"description"`
+}
+
+// ModuleSchema describes a filter or action and its parameters.
+type ModuleSchema struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Parameters  []Parameter `json:"parameters"`
+	// Check validates dependencies between parameters, that can not be described by the parameter list.
+	Check func(params map[string]string) error `json:"-"`
+}
+
+// schemas of the built-in filters, keyed like builtinFilters
+var builtinFilterSchemas = map[string]ModuleSchema{
+	"regex": {
+		Description: "Filters events, where the target property matches the regex.",
+		Parameters: []Parameter{
+			{Name: "regex", Type: ParameterRegex, Required: true, Description: "The regex to match against"},
+			{Name: "target", Type: ParameterString, Default: "summary", Description: "Property to match against, e.g. summary, description, location or the name of any other property"},
+		},
+	},
+	"id": {
+		Description: "Filters events by their UID.",
+		Parameters: []Parameter{
+			{Name: "id", Type: ParameterString, Required: true, Description: "UID of the event"},
+		},
+	},
+	"timeframe": {
+		Description: "Filters events starting inside the timeframe. Repeating events are filtered, if any of their occurrences starts inside.",
+		Parameters: []Parameter{
+			{Name: "after", Type: ParameterTime, Description: "Start of the timeframe"},
+			{Name: "before", Type: ParameterTime, Description: "End of the timeframe"},
+		},
+		Check: func(params map[string]string) error {
+			if params["after"] == "" && params["before"] == "" {
+				return fmt.Errorf("one of the parameters 'after' or 'before' is required")
+			}
+			return nil
+		},
+	},
+	"duplicates": {
+		Description: "Filters the second and following events, that are duplicates of an earlier event.",
+		Parameters:  duplicateKeyParameters,
+		Check:       checkDuplicateKey,
+	},
+	"all": {
+		Description: "Filters all events.",
+	},
+	"duration": {
+		Description: "Filters events by their duration.",
+		Parameters: []Parameter{
+			{Name: "duration", Type: ParameterDuration, Required: true, Description: "Duration to compare with"},
+			{Name: "operator", Type: ParameterString, Values: []string{"longer", "shorter"}, Default: "longer", Description: "Filter events longer or shorter than the duration"},
+		},
+	},
+	"property": {
+		Description: "Filters events by any property or property parameter, including X- properties.",
+		Parameters: []Parameter{
+			{Name: "property", Type: ParameterString, Required: true, Description: "Name of the property, e.g. categories or attendee"},
+			{Name: "parameter", Type: ParameterString, Description: "Compare the values of this property parameter instead of the property value, e.g. partstat"},
+			{Name: "mode", Type: ParameterString, Values: []string{"exists", "equals", "contains", "regex", "less", "greater"}, Default: "exists", Description: "How the values are compared with value"},
+			{Name: "value", Type: ParameterString, Description: "The value to compare with. Required for all modes except exists"},
+			{Name: "case-sensitive", Type: ParameterBool, Default: "false", Description: "Case sensitive comparison for equals and contains"},
+			{Name: "match", Type: ParameterString, Values: []string{"any", "all"}, Default: "any", Description: "Whether any or all values of multi-valued properties have to match"},
+		},
+		Check: func(params map[string]string) error {
+			if params["mode"] == "" || params["mode"] == "exists" {
+				return nil
+			}
+			if params["value"] == "" {
+				return fmt.Errorf("missing mandatory parameter 'value' for mode '%s'", params["mode"])
+			}
+			switch params["mode"] {
+			case "regex":
+				if _, err := regexp.Compile(params["value"]); err != nil {
+					return fmt.Errorf("invalid regex in parameter 'value': %s", err.Error())
+				}
+			case "less", "greater":
+				if _, err := orderComparison(params["value"], true); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	"weekday": {
+		Description: "Filters events by the weekday and time of day they take place.",
+		Parameters: []Parameter{
+			{Name: "weekdays", Type: ParameterString, Description: "Comma separated weekdays and ranges, e.g. mo-fr or sa,su. Default all days"},
+			{Name: "from", Type: ParameterString, Default: "00:00", Description: "Start of the time range on each day, e.g. 08:00"},
+			{Name: "to", Type: ParameterString, Default: "24:00", Description: "End of the time range on each day. If not after from, the range spans midnight"},
+			{Name: "timezone", Type: ParameterString, Description: "Timezone of the weekdays and times, e.g. Europe/Berlin. Default is the server timezone"},
+			{Name: "match", Type: ParameterString, Values: []string{"start", "overlap", "inside"}, Default: "start", Description: "Whether the start, any part or the whole event has to be in the range"},
+		},
+		Check: func(params map[string]string) error {
+			_, err := parseWeekdaySelection(params)
+			return err
+		},
+	},
+	"overlap": {
+		Description: "Filters events overlapping other events of the same calendar or of another source.",
+		Parameters: []Parameter{
+			{Name: "source", Type: ParameterString, Description: "Compare with the events of this source, e.g. profile://labs. Default the same calendar"},
+			{Name: "with-*", Type: ParameterString, Description: "Filter selecting the events to compare with, e.g. with-type: regex and with-regex: Lab. Default all events"},
+			{Name: "min-overlap", Type: ParameterDuration, Description: "Minimum duration of the overlap. Default any overlap"},
+		},
+		Check: func(params map[string]string) error {
+			subfilter := overlapSubfilter(params)
+			if len(subfilter) == 0 {
+				return nil
+			}
+			if err := ValidateFilter(subfilter); err != nil {
+				return fmt.Errorf("invalid with-filter: %s", err.Error())
+			}
+			return nil
+		},
+	},
+	"source": {
+		Description: "Filters events by the source they came from.",
+		Parameters: []Parameter{
+			{Name: "source", Type: ParameterString, Description: "The source as listed in the profile, its label, or base64 for added entries"},
+			{Name: "regex", Type: ParameterRegex, Description: "Regex matched against the source and its label instead"},
+		},
+		Check: func(params map[string]string) error {
+			if (params["source"] == "") == (params["regex"] == "") {
+				return fmt.Errorf("exactly one of the parameters 'source' or 'regex' is required")
+			}
+			return nil
+		},
+	},
+	"status": {
+		Description: "Filters events by their status, e.g. cancelled events.",
+		Parameters: []Parameter{
+			{Name: "status", Type: ParameterString, Required: true, Description: "Comma separated list of tentative, confirmed, cancelled or none"},
+		},
+		Check: func(params map[string]string) error {
+			_, err := parseValueList("status", params["status"], statusValues)
+			return err
+		},
+	},
+	"class": {
+		Description: "Filters events by their class, e.g. private events. Events without class are public.",
+		Parameters: []Parameter{
+			{Name: "class", Type: ParameterString, Required: true, Description: "Comma separated list of public, private or confidential"},
+		},
+		Check: func(params map[string]string) error {
+			_, err := parseValueList("class", params["class"], classValues)
+			return err
+		},
+	},
+	"transp": {
+		Description: "Filters events by their transparency or Microsoft busy status, e.g. events shown as free.",
+		Parameters: []Parameter{
+			{Name: "transp", Type: ParameterString, Description: "Comma separated list of opaque or transparent"},
+			{Name: "busy-status", Type: ParameterString, Description: "Comma separated list of free, tentative, busy, oof or workingelsewhere"},
+		},
+		Check: func(params map[string]string) error {
+			if (params["transp"] == "") == (params["busy-status"] == "") {
+				return fmt.Errorf("exactly one of the parameters 'transp' or 'busy-status' is required")
+			}
+			var err error
+			if params["transp"] != "" {
+				_, err = parseValueList("transp", params["transp"], transpValues)
+			} else {
+				_, err = parseValueList("busy-status", params["busy-status"], busyStatusValues)
+			}
+			return err
+		},
+	},
+	"expr": {
+		Description: "Filters events, for which the expression is true, e.g. duration > 2h && summary =~ \"Exam\".",
+		Parameters: []Parameter{
+			{Name: "expression", Type: ParameterString, Required: true, Description: "Expression over the fields of the event, see the documentation"},
+		},
+		Check: func(params map[string]string) error {
+			if _, err := CompileExpression(params["expression"]); err != nil {
+				return fmt.Errorf("invalid expression: %s", err.Error())
+			}
+			return nil
+		},
+	},
+}
+
+// schemas of the built-in actions, keyed like builtinActions
+var builtinActionSchemas = map[string]ModuleSchema{
+	"delete": {
+		Description: "Deletes the filtered events.",
+	},
+	"edit": {
+		Description: "Edits the filtered events.",
+		Parameters: []Parameter{
+			{Name: "new-summary", Type: ParameterString, Description: "The new summary"},
+			{Name: "new-description", Type: ParameterString, Description: "The new description"},
+			{Name: "new-location", Type: ParameterString, Description: "The new location"},
+			{Name: "new-start", Type: ParameterTime, Description: "The new start time"},
+			{Name: "new-end", Type: ParameterTime, Description: "The new end time"},
+			{Name: "overwrite", Type: ParameterString, Values: []string{"true", "false", "fillempty"}, Default: "true", Description: "Overwrite, append to or only fill empty summary, description and location"},
+			{Name: "move-time", Type: ParameterDuration, Description: "Moves start and end of the event by this duration"},
+		},
+		Check: func(params map[string]string) error {
+			if params["move-time"] != "" && (params["new-start"] != "" || params["new-end"] != "") {
+				return fmt.Errorf("two exclusive params were given: 'move-time' and 'new-start'/'new-end'")
+			}
+			return nil
+		},
+	},
+	"add-reminder": {
+		Description: "Adds reminders to the filtered events.",
+		Parameters: []Parameter{
+			{Name: "before", Type: ParameterString, Description: "Comma separated durations before the event, e.g. 24h,15m. Adds one alarm each. The iCalendar format like 15M is accepted as well"},
+			{Name: "time", Type: ParameterString, Description: "Old name of before"},
+			{Name: "after", Type: ParameterString, Description: "Comma separated durations after the start or end of the event"},
+			{Name: "at", Type: ParameterTime, Description: "Absolute time of the alarm"},
+			{Name: "related", Type: ParameterString, Values: []string{"start", "end"}, Default: "start", Description: "Whether before and after are relative to the start or end of the event"},
+			{Name: "alarm-action", Type: ParameterString, Values: []string{"display", "audio", "email"}, Default: "display", Description: "What the calendar application does"},
+			{Name: "description", Type: ParameterString, Description: "Text of display and email alarms. Default the summary of the event"},
+			{Name: "summary", Type: ParameterString, Description: "Subject of email alarms. Default the summary of the event"},
+			{Name: "attendees", Type: ParameterString, Description: "Comma separated email addresses, required for email alarms"},
+			{Name: "remove-existing", Type: ParameterBool, Default: "false", Description: "Remove the alarms of the event first"},
+		},
+		Check: func(params map[string]string) error {
+			_, err := parseReminder(params)
+			return err
+		},
+	},
+	"strip-info": {
+		Description: "Strips information from the filtered events, similar to Outlooks export options.",
+		Parameters: []Parameter{
+			{Name: "mode", Type: ParameterString, Required: true, Values: []string{"availibility", "limited"}, Description: "availibility keeps only the busy status, limited keeps summary and busy status"},
+		},
+	},
+	"expand-recurrences": {
+		Description: "Turns repeating events into single events.",
+		Parameters: []Parameter{
+			{Name: "after", Type: ParameterTime, Description: "Only expand occurrences originally starting after this time"},
+			{Name: "before", Type: ParameterTime, Description: "Only expand occurrences originally starting before this time. Default is one year from now"},
+			{Name: "uid", Type: ParameterString, Values: []string{"derived", "recurrence-id"}, Default: "derived", Description: "UIDs of the expanded instances"},
+		},
+	},
+	"merge-duplicates": {
+		Description: "Merges duplicates among the filtered events into the first of them, combining categories and descriptions.",
+		Parameters: append([]Parameter{
+			{Name: "separator", Type: ParameterString, Default: "\n\n", Description: "Put between the merged descriptions"},
+		}, duplicateKeyParameters...),
+		Check: checkDuplicateKey,
+	},
+	"expose-source": {
+		Description: "Shows subscribers the source the filtered events came from.",
+		Parameters: []Parameter{
+			{Name: "label", Type: ParameterString, Description: "Text to show. Default the label of the source, or the source itself, which may publish secret URLs"},
+			{Name: "property", Type: ParameterString, Default: "categories", Description: "categories adds the label as category, an X- property name sets this property"},
+		},
+		Check: func(params map[string]string) error {
+			property := strings.ToUpper(params["property"])
+			if property != "" && property != "CATEGORIES" &&
+				(!strings.HasPrefix(property, "X-") || property == SourceProperty || property == SourceLabelProperty) {
+				return fmt.Errorf("invalid property '%s', use categories or an X- property", params["property"])
+			}
+			return nil
+		},
+	},
+	"replace": {
+		Description: "Replaces matches of a regex in a text property of the filtered events.",
+		Parameters: []Parameter{
+			{Name: "regex", Type: ParameterRegex, Required: true, Description: "The regex to replace"},
+			{Name: "replacement", Type: ParameterString, Description: "The replacement, $1 or ${name} insert capture groups. Default empty, removing the matches"},
+			{Name: "target", Type: ParameterString, Default: "summary", Description: "Property to edit, e.g. summary, description, location, categories or an X- property"},
+			{Name: "count", Type: ParameterString, Values: []string{"all", "first"}, Default: "all", Description: "Replace all matches or only the first"},
+			{Name: "ignore-case", Type: ParameterBool, Default: "false", Description: "Match the regex case-insensitive"},
+		},
+		Check: func(params map[string]string) error {
+			if params["target"] != "" && !isTextProperty(params["target"]) {
+				return fmt.Errorf("invalid target '%s', use a text or X- property", params["target"])
+			}
+			return nil
+		},
+	},
+	"template": {
+		Description: "Sets a property of the filtered events to the result of a template, e.g. {{.Summary}} ({{.Location}}).",
+		Parameters: []Parameter{
+			{Name: "template", Type: ParameterString, Required: true, Description: "Go text/template executed on the fields of the event, see the documentation"},
+			{Name: "target", Type: ParameterString, Default: "summary", Description: "Property to set, e.g. summary, description, location, categories or an X- property"},
+			{Name: "regex", Type: ParameterRegex, Description: "Regex, whose capture groups are available as .Match and .Groups. Events not matching are left unchanged"},
+			{Name: "regex-target", Type: ParameterString, Default: "summary", Description: "Property to match the regex against"},
+			{Name: "timezone", Type: ParameterString, Description: "Timezone of start and end, e.g. Europe/Berlin. Default the timezone of the event"},
+		},
+		Check: func(params map[string]string) error {
+			if params["target"] != "" && !isTextProperty(params["target"]) {
+				return fmt.Errorf("invalid target '%s', use a text or X- property", params["target"])
+			}
+			_, err := parseEventTemplate(params)
+			return err
+		},
+	},
+	"property": {
+		Description: "Sets, appends or removes a property of the filtered events, or edits its parameters.",
+		Parameters: []Parameter{
+			{Name: "property", Type: ParameterString, Required: true, Description: "The property, e.g. categories, transp, url or an X- property. UID, dates and recurrences can't be edited"},
+			{Name: "mode", Type: ParameterString, Values: []string{"set", "append", "remove", "set-parameter", "remove-parameter"}, Default: "set", Description: "How to edit the property"},
+			{Name: "value", Type: ParameterString, Description: "The value to set or append, or to remove instead of the whole property"},
+			{Name: "parameter", Type: ParameterString, Description: "The property parameter to edit, e.g. LANGUAGE"},
+		},
+		Check: checkPropertyAction,
+	},
+	"timezone": {
+		Description: "Converts start, end and recurrence times of the filtered events to a timezone.",
+		Parameters: []Parameter{
+			{Name: "timezone", Type: ParameterString, Required: true, Description: "The timezone, e.g. Europe/Berlin or UTC"},
+			{Name: "floating", Type: ParameterString, Description: "Timezone of floating times without timezone. Default the target timezone"},
+		},
+		Check: func(params map[string]string) error {
+			if _, err := loadTimezone(params["timezone"]); err != nil {
+				return err
+			}
+			if params["floating"] != "" {
+				if _, err := loadTimezone(params["floating"]); err != nil {
+					return fmt.Errorf("floating: %s", err.Error())
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// parameters deciding which events are duplicates, shared by the duplicates filter and the merge-duplicates action
+var duplicateKeyParameters = []Parameter{
+	{Name: "keys", Type: ParameterString, Default: "start,end,summary", Description: "Comma separated properties that have to be equal: uid, start, end, summary, location, description"},
+	{Name: "tolerance", Type: ParameterDuration, Description: "Start and end may differ by this duration"},
+	{Name: "normalize", Type: ParameterBool, Default: "false", Description: "Compare texts ignoring case and whitespace"},
+}
+
+func checkDuplicateKey(params map[string]string) error {
+	_, err := parseDuplicateKey(params)
+	return err
+}
+
+// ValidateFilter checks the parameters of a filter, including its type, against the filter schema.
+func ValidateFilter(params map[string]string) error {
+	filter, ok := GetFilter(params["type"])
+	if !ok {
+		return fmt.Errorf("filter type '%s' doesn't exist", params["type"])
+	}
+	return validateParameters("filter", filter.Schema(), params)
+}
+
+// ValidateAction checks the parameters of an action, including its type, against the action schema.
+func ValidateAction(params map[string]string) error {
+	action, ok := GetAction(params["type"])
+	if !ok {
+		return fmt.Errorf("action type '%s' doesn't exist", params["type"])
+	}
+	return validateParameters("action", action.Schema(), params)
+}
+
+func validateParameters(kind string, schema ModuleSchema, params map[string]string) error {
+	for name, value := range params {
+		if name == "type" {
+			continue
+		}
+		var parameter *Parameter
+		for i := range schema.Parameters {
+			if schema.Parameters[i].matches(name) {
+				parameter = &schema.Parameters[i]
+			}
+		}
+		if parameter == nil {
+			return fmt.Errorf("unknown parameter '%s' for %s '%s'", name, kind, params["type"])
+		}
+		if err := parameter.validate(value); err != nil {
+			return fmt.Errorf("invalid parameter '%s' for %s '%s': %s", name, kind, params["type"], err.Error())
+		}
+	}
+	for _, parameter := range schema.Parameters {
+		if parameter.Required && params[parameter.Name] == "" {
+			return fmt.Errorf("missing mandatory parameter '%s' for %s '%s'", parameter.Name, kind, params["type"])
+		}
+	}
+	if schema.Check != nil {
+		if err := schema.Check(params); err != nil {
+			return fmt.Errorf("invalid %s '%s': %s", kind, params["type"], err.Error())
+		}
+	}
+	return nil
+}
+
+// matches checks if the parameter describes the parameter name. Names ending with "*" describe all names with that prefix.
+func (parameter Parameter) matches(name string) bool {
+	if strings.HasSuffix(parameter.Name, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(parameter.Name, "*"))
+	}
+	return parameter.Name == name
+}
+
+// validate checks a single value against the parameter type and allowed values.
+func (parameter Parameter) validate(value string) error {
+	if len(parameter.Values) > 0 {
+		for _, allowed := range parameter.Values {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%s' is not one of %s", value, strings.Join(parameter.Values, ", "))
+	}
+	var err error
+	switch parameter.Type {
+	case ParameterRegex:
+		_, err = regexp.Compile(value)
+	case ParameterTime:
+		_, err = ParseDate(value, time.Now())
+	case ParameterDuration:
+		_, err = time.ParseDuration(value)
+	case ParameterBool:
+		_, err = strconv.ParseBool(value)
+	case ParameterInt:
+		_, err = strconv.Atoi(value)
+	}
+	return err
+}
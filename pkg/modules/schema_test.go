@@ -0,0 +1,40 @@
+package modules
+
+import "testing"
+
+func TestSchemasComplete(t *testing.T) {
+	for name := range builtinFilters {
+		if _, ok := builtinFilterSchemas[name]; !ok {
+			t.Errorf("Filter '%s' has no schema", name)
+		}
+	}
+	for name := range builtinActions {
+		if _, ok := builtinActionSchemas[name]; !ok {
+			t.Errorf("Action '%s' has no schema", name)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		valid  bool
+	}{
+		{map[string]string{"type": "regex", "regex": "^Exam", "target": "location"}, true},
+		{map[string]string{"type": "regex", "regex": "^Exam", "targte": "location"}, false},
+		{map[string]string{"type": "regex", "regex": "(unclosed"}, false},
+		{map[string]string{"type": "regex"}, false},
+		{map[string]string{"type": "timeframe"}, false},
+		{map[string]string{"type": "timeframe", "after": "now"}, true},
+		{map[string]string{"type": "duration", "duration": "1h", "operator": "equal"}, false},
+		{map[string]string{"type": "overlap", "with-type": "regex", "with-regex": "Lab", "min-overlap": "30m"}, true},
+		{map[string]string{"type": "overlap", "with-type": "regex"}, false},
+		{map[string]string{"type": "unknown"}, false},
+	}
+	for _, test := range tests {
+		err := ValidateFilter(test.params)
+		if (err == nil) != test.valid {
+			t.Errorf("Filter %v: got error %v, should be valid: %t", test.params, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package modules
+
+import (
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// SourceProperty is the internal property tagging every event with the source it came from,
+// SourceLabelProperty with the label of the source, if it has one.
+// They are removed with StripSources before a calendar is returned to subscribers.
+const (
+	SourceProperty      = "X-ICAL-RELAY-SOURCE"
+	SourceLabelProperty = "X-ICAL-RELAY-SOURCE-LABEL"
+)
+
+// SourceName returns the name events of the source are tagged with.
+// This is the source itself, except for base64 sources, which are only tagged with "base64".
+func SourceName(source string) string {
+	if strings.HasPrefix(source, "base64://") {
+		return "base64"
+	}
+	return source
+}
+
+// TagSource tags all events of the calendar with the source and its label, replacing earlier tags.
+func TagSource(cal *ics.Calendar, source string, label string) {
+	for _, event := range cal.Events() {
+		event.SetProperty(SourceProperty, SourceName(source))
+		removeProperties(event, SourceLabelProperty)
+		if label != "" {
+			event.SetProperty(SourceLabelProperty, escapeText(label))
+		}
+	}
+}
+
+// StripSources removes the source tags from all events of the calendar.
+func StripSources(cal *ics.Calendar) {
+	for _, event := range cal.Events() {
+		removeProperties(event, SourceProperty)
+		removeProperties(event, SourceLabelProperty)
+	}
+}
+
+// eventSource returns the source the event is tagged with, or "" if it has no tag.
+func eventSource(event *ics.VEvent) string {
+	prop := event.GetProperty(SourceProperty)
+	if prop == nil {
+		return ""
+	}
+	return prop.Value
+}
+
+// eventSourceLabel returns the label of the source the event came from, or "" if it has none.
+func eventSourceLabel(event *ics.VEvent) string {
+	prop := event.GetProperty(SourceLabelProperty)
+	if prop == nil {
+		return ""
+	}
+	return unescapeText(prop.Value)
+}
@@ -0,0 +1,114 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+	log "github.com/sirupsen/logrus"
+)
+
+// busyStatusProperty is the busy status set by Microsoft Outlook and Exchange, it replaces TRANSP there.
+const busyStatusProperty = "X-MICROSOFT-CDO-BUSYSTATUS"
+
+// values accepted by the status, class and transp filters, lowercase
+var (
+	statusValues     = []string{"tentative", "confirmed", "cancelled", "none"}
+	classValues      = []string{"public", "private", "confidential"}
+	transpValues     = []string{"opaque", "transparent"}
+	busyStatusValues = []string{"free", "tentative", "busy", "oof", "workingelsewhere"}
+)
+
+// parseValueList parses the comma separated values of the parameter, ignoring case.
+func parseValueList(parameter string, value string, valid []string) (map[string]bool, error) {
+	values := make(map[string]bool)
+	for _, v := range strings.Split(value, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		known := false
+		for _, validValue := range valid {
+			known = known || v == validValue
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid %s '%s', use %s", parameter, v, strings.Join(valid, ", "))
+		}
+		values[v] = true
+	}
+	return values, nil
+}
+
+// lowerPropertyValue returns the lowercase value of the property, or "" if the event doesn't have it.
+func lowerPropertyValue(event *ics.VEvent, property string) string {
+	prop := event.GetProperty(ics.ComponentProperty(property))
+	if prop == nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(prop.Value))
+}
+
+// eventStatus returns the STATUS of the event, or "none" if it has none.
+func eventStatus(event *ics.VEvent) string {
+	if status := lowerPropertyValue(event, string(ics.ComponentPropertyStatus)); status != "" {
+		return status
+	}
+	return "none"
+}
+
+// eventClass returns the CLASS of the event. Events without CLASS are public,
+// unknown classes are private, as required by RFC 5545.
+func eventClass(event *ics.VEvent) string {
+	switch class := lowerPropertyValue(event, string(ics.ComponentPropertyClass)); class {
+	case "":
+		return "public"
+	case "public", "private", "confidential":
+		return class
+	default:
+		return "private"
+	}
+}
+
+// eventTransp returns the TRANSP of the event. Events without TRANSP are opaque,
+// unless their Microsoft busy status is free.
+func eventTransp(event *ics.VEvent) string {
+	if transp := lowerPropertyValue(event, string(ics.ComponentPropertyTransp)); transp != "" {
+		return transp
+	}
+	if lowerPropertyValue(event, busyStatusProperty) == "free" {
+		return "transparent"
+	}
+	return "opaque"
+}
+
+// eventBusyStatus returns the Microsoft busy status of the event.
+// Events without busy status are free, if they are transparent, and busy otherwise.
+func eventBusyStatus(event *ics.VEvent) string {
+	if busyStatus := lowerPropertyValue(event, busyStatusProperty); busyStatus != "" {
+		return busyStatus
+	}
+	if eventTransp(event) == "transparent" {
+		return "free"
+	}
+	return "busy"
+}
+
+// filterValues filters events, for which value returns one of the comma separated values of the parameter.
+func filterValues(cal *ics.Calendar, params map[string]string, parameter string, valid []string, value func(*ics.VEvent) string) ([]int, error) {
+	var indices []int
+	if params[parameter] == "" {
+		return indices, fmt.Errorf("missing mandatory Parameter '%s'", parameter)
+	}
+	values, err := parseValueList(parameter, params[parameter], valid)
+	if err != nil {
+		return indices, err
+	}
+	for i, component := range cal.Components {
+		event, ok := component.(*ics.VEvent)
+		if !ok {
+			continue
+		}
+		if values[value(event)] {
+			indices = append(indices, i)
+			log.Debug("Filter event with id " + event.Id() + " with " + parameter + " " + value(event))
+		}
+	}
+	return indices, nil
+}
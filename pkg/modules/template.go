@@ -0,0 +1,156 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// maxTemplateOutput limits the length of the text generated by a template for a single event.
+const maxTemplateOutput = 64 * 1024
+
+// eventTemplateData is the model the templates of the template action are executed on.
+type eventTemplateData struct {
+	Summary     string
+	Description string
+	Location    string
+	UID         string
+	Status      string
+	Source      string // label of the source, or the source itself
+	Start       time.Time
+	End         time.Time
+	AllDay      bool
+	Categories  []string
+	// Match holds the match of the regex and its capture groups, Groups the named capture groups.
+	Match  []string
+	Groups map[string]string
+}
+
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"join":  strings.Join,
+}
+
+// eventTemplate is a parsed template action.
+type eventTemplate struct {
+	template    *template.Template
+	regex       *regexp.Regexp // nil, if the template uses no captures
+	regexTarget string
+	location    *time.Location // nil keeps the timezone of the event
+}
+
+// parseEventTemplate reads the parameters 'template', 'regex', 'regex-target' and 'timezone' of the template action.
+func parseEventTemplate(params map[string]string) (eventTemplate, error) {
+	var parsed eventTemplate
+	var err error
+	if params["template"] == "" {
+		return parsed, fmt.Errorf("missing mandatory Parameter 'template'")
+	}
+	parsed.template, err = template.New("template").Funcs(templateFuncs).Option("missingkey=error").Parse(params["template"])
+	if err != nil {
+		return parsed, fmt.Errorf("invalid template: %s", err.Error())
+	}
+	if params["regex"] != "" {
+		if parsed.regex, err = regexp.Compile(params["regex"]); err != nil {
+			return parsed, fmt.Errorf("invalid regex: %s", err.Error())
+		}
+	}
+	parsed.regexTarget = params["regex-target"]
+	if parsed.regexTarget == "" {
+		parsed.regexTarget = "summary"
+	}
+	if params["timezone"] != "" {
+		if parsed.location, err = time.LoadLocation(params["timezone"]); err != nil {
+			return parsed, fmt.Errorf("invalid timezone: %s", err.Error())
+		}
+	}
+
+	// execute the template once on an empty event, to find unknown fields and wrong capture group indices
+	data := eventTemplateData{Groups: make(map[string]string)}
+	if parsed.regex != nil {
+		data.Match = make([]string, parsed.regex.NumSubexp()+1)
+		for _, name := range parsed.regex.SubexpNames() {
+			if name != "" {
+				data.Groups[name] = ""
+			}
+		}
+	}
+	if _, err := parsed.execute(data); err != nil {
+		return parsed, fmt.Errorf("invalid template: %s", err.Error())
+	}
+	return parsed, nil
+}
+
+// data builds the model of the event. Returns false, if the regex doesn't match the event.
+func (parsed eventTemplate) data(event *ics.VEvent) (eventTemplateData, bool) {
+	text := func(property string) string {
+		if values := getPropertyValues(event, property, ""); len(values) > 0 {
+			return values[0].Value
+		}
+		return ""
+	}
+	data := eventTemplateData{
+		Summary:     text("SUMMARY"),
+		Description: text("DESCRIPTION"),
+		Location:    text("LOCATION"),
+		UID:         event.Id(),
+		Status:      text("STATUS"),
+		Source:      eventSourceLabel(event),
+		Start:       eventTime(event, "start"),
+		End:         eventTime(event, "end"),
+		Categories:  []string{},
+		Groups:      make(map[string]string),
+	}
+	if data.Source == "" {
+		data.Source = eventSource(event)
+	}
+	format, err := getTimeFormat(event, ics.ComponentPropertyDtStart)
+	data.AllDay = err == nil && format.AllDay
+	if parsed.location != nil && !data.AllDay {
+		data.Start = data.Start.In(parsed.location)
+		data.End = data.End.In(parsed.location)
+	}
+	for _, category := range getPropertyValues(event, "CATEGORIES", "") {
+		data.Categories = append(data.Categories, category.Value)
+	}
+
+	if parsed.regex != nil {
+		data.Match = parsed.regex.FindStringSubmatch(text(parsed.regexTarget))
+		if data.Match == nil {
+			return data, false
+		}
+		for i, name := range parsed.regex.SubexpNames() {
+			if name != "" {
+				data.Groups[name] = data.Match[i]
+			}
+		}
+	}
+	return data, true
+}
+
+// execute runs the template on the data.
+func (parsed eventTemplate) execute(data eventTemplateData) (string, error) {
+	var output limitedBuilder
+	if err := parsed.template.Execute(&output, data); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// limitedBuilder is a strings.Builder failing once more than maxTemplateOutput bytes are written.
+type limitedBuilder struct {
+	strings.Builder
+}
+
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxTemplateOutput {
+		return 0, fmt.Errorf("output longer than %d bytes", maxTemplateOutput)
+	}
+	return b.Builder.Write(p)
+}
@@ -0,0 +1,139 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jm-lemmi/ical-relay/helpers"
+)
+
+// properties holding the times of an event, that are converted to another timezone
+var timeProperties = []string{"DTSTART", "DTEND", "RECURRENCE-ID", "EXDATE", "RDATE"}
+
+// loadTimezone loads the timezone by its IANA name, e.g. "Europe/Berlin" or "UTC".
+// Unlike time.LoadLocation it doesn't accept "" and "Local", which depend on the server.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("invalid timezone '%s'", name)
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %s", err.Error())
+	}
+	return location, nil
+}
+
+// convertEventTimezone converts all times of the event to the location. All-day dates are kept.
+// Floating times are read in the floating location. UNTIL of RRULE is written in UTC, if it was floating.
+func convertEventTimezone(event *ics.VEvent, location *time.Location, floating *time.Location) error {
+	startLocation := floating
+	for i := range event.Properties {
+		prop := &event.Properties[i]
+		if !helpers.Contains(timeProperties, prop.IANAToken) {
+			continue
+		}
+		if value, ok := prop.ICalParameters["VALUE"]; ok && len(value) > 0 && value[0] != "DATE-TIME" {
+			continue // dates and periods
+		}
+		from := floating
+		if tzid, ok := prop.ICalParameters["TZID"]; ok && len(tzid) > 0 {
+			var err error
+			if from, err = time.LoadLocation(tzid[0]); err != nil {
+				return fmt.Errorf("unknown timezone '%s' in %s", tzid[0], prop.IANAToken)
+			}
+		}
+		if prop.IANAToken == "DTSTART" {
+			startLocation = from
+		}
+
+		values := strings.Split(prop.Value, ",")
+		converted := false
+		for j, value := range values {
+			var t time.Time
+			var err error
+			switch {
+			case len(value) == len(icalDateFormat):
+				continue
+			case strings.HasSuffix(value, "Z"):
+				t, err = time.Parse(icalTimestampFormatUtc, value)
+			default:
+				t, err = time.ParseInLocation(icalTimestampFormat, value, from)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s': %s", prop.IANAToken, value, err.Error())
+			}
+			if location == time.UTC {
+				values[j] = t.UTC().Format(icalTimestampFormatUtc)
+			} else {
+				values[j] = t.In(location).Format(icalTimestampFormat)
+			}
+			converted = true
+		}
+		if !converted {
+			continue
+		}
+		prop.Value = strings.Join(values, ",")
+		if prop.ICalParameters == nil {
+			prop.ICalParameters = make(map[string][]string)
+		}
+		delete(prop.ICalParameters, "TZID")
+		if location != time.UTC {
+			prop.ICalParameters["TZID"] = []string{location.String()}
+		}
+	}
+
+	// UNTIL has to be in UTC, if DTSTART has a timezone
+	for i := range event.Properties {
+		prop := &event.Properties[i]
+		if prop.IANAToken != "RRULE" {
+			continue
+		}
+		parts := strings.Split(prop.Value, ";")
+		for j, part := range parts {
+			until := strings.TrimPrefix(strings.ToUpper(part), "UNTIL=")
+			if until == strings.ToUpper(part) || len(until) != len(icalTimestampFormat) {
+				continue
+			}
+			t, err := time.ParseInLocation(icalTimestampFormat, until, startLocation)
+			if err != nil {
+				return fmt.Errorf("invalid UNTIL '%s': %s", until, err.Error())
+			}
+			parts[j] = "UNTIL=" + t.UTC().Format(icalTimestampFormatUtc)
+		}
+		prop.Value = strings.Join(parts, ";")
+	}
+	return nil
+}
+
+// addMissingVTimezones adds the VTIMEZONE for every TZID used by the events, that isn't defined by the calendar,
+// from the embedded timezone database. Returns the TZIDs, that are not in the database.
+func addMissingVTimezones(cal *ics.Calendar) []string {
+	defined := make(map[string]bool)
+	for _, tz := range cal.Timezones() {
+		if tzid := tz.GetProperty(ics.ComponentPropertyTzid); tzid != nil {
+			defined[tzid.Value] = true
+		}
+	}
+	var missing []string
+	for _, event := range cal.Events() {
+		for _, prop := range event.Properties {
+			tzid, ok := prop.ICalParameters["TZID"]
+			if !ok || len(tzid) == 0 || defined[tzid[0]] {
+				continue
+			}
+			defined[tzid[0]] = true
+			tz, err := helpers.GetVTimezoneFromString(tzid[0])
+			if err != nil {
+				missing = append(missing, tzid[0])
+				continue
+			}
+			cal.AddVTimezone(&tz)
+			log.Debug("Added VTIMEZONE " + tzid[0])
+		}
+	}
+	return missing
+}